@@ -1,8 +1,14 @@
-//go:build windows && (amd64 || 386 || arm64)
-
 package divert
 
-import "unsafe"
+import (
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+	"unsafe"
+
+	"github.com/imgk/divert-go/filter"
+	"github.com/imgk/divert-go/header"
+)
 
 // Ethernet is ...
 type Ethernet struct {
@@ -64,6 +70,70 @@ type Flow struct {
 	_                uint32
 }
 
+// LocalAddrPort returns the local address and port. IPv4 addresses are
+// unmapped.
+func (s *Socket) LocalAddrPort() netip.AddrPort {
+	return addrPort(&s.LocalAddress, s.LocalPort)
+}
+
+// SetLocalAddrPort sets the local address and port.
+func (s *Socket) SetLocalAddrPort(ap netip.AddrPort) {
+	s.LocalPort = setAddrPort(&s.LocalAddress, ap)
+}
+
+// RemoteAddrPort returns the remote address and port. IPv4 addresses are
+// unmapped.
+func (s *Socket) RemoteAddrPort() netip.AddrPort {
+	return addrPort(&s.RemoteAddress, s.RemotePort)
+}
+
+// SetRemoteAddrPort sets the remote address and port.
+func (s *Socket) SetRemoteAddrPort(ap netip.AddrPort) {
+	s.RemotePort = setAddrPort(&s.RemoteAddress, ap)
+}
+
+// LocalAddrPort returns the local address and port. IPv4 addresses are
+// unmapped.
+func (f *Flow) LocalAddrPort() netip.AddrPort {
+	return addrPort(&f.LocalAddress, f.LocalPort)
+}
+
+// SetLocalAddrPort sets the local address and port.
+func (f *Flow) SetLocalAddrPort(ap netip.AddrPort) {
+	f.LocalPort = setAddrPort(&f.LocalAddress, ap)
+}
+
+// RemoteAddrPort returns the remote address and port. IPv4 addresses are
+// unmapped.
+func (f *Flow) RemoteAddrPort() netip.AddrPort {
+	return addrPort(&f.RemoteAddress, f.RemotePort)
+}
+
+// SetRemoteAddrPort sets the remote address and port.
+func (f *Flow) SetRemoteAddrPort(ap netip.AddrPort) {
+	f.RemotePort = setAddrPort(&f.RemoteAddress, ap)
+}
+
+// addrWords returns an address of Socket or Flow as host byte order words,
+// least significant first, see filter.AddrFrom128.
+func addrWords(b *[16]uint8) (a [4]uint32) {
+	for i := range a {
+		a[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return
+}
+
+func addrPort(b *[16]uint8, port uint16) netip.AddrPort {
+	return netip.AddrPortFrom(filter.AddrFrom128(addrWords(b)), port)
+}
+
+func setAddrPort(b *[16]uint8, ap netip.AddrPort) uint16 {
+	for i, w := range filter.AddrTo128(ap.Addr()) {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+	return ap.Port()
+}
+
 // Reflect is ...
 // Finally, the WINDIVERT_LAYER_REFLECT layer can capture events relating to WinDivert itself,
 // such as when another process opens a new WinDivert handle, or closes an old WinDivert handle.
@@ -90,6 +160,11 @@ func (r *Reflect) Layer() Layer {
 	return Layer(r.layer)
 }
 
+// SetLayer is ...
+func (r *Reflect) SetLayer(layer Layer) {
+	r.layer = uint32(layer)
+}
+
 // Address is ...
 type Address struct {
 	Timestamp int64
@@ -131,6 +206,109 @@ func (a *Address) SetLength(n uint32) {
 	a.length = n << 12
 }
 
+// Bits of Address.Flags, the bitfields following Layer and Event in
+// WINDIVERT_ADDRESS.
+const (
+	flagSniffed uint8 = 1 << iota
+	flagOutbound
+	flagLoopback
+	flagImpostor
+	flagIPv6
+	flagIPChecksum
+	flagTCPChecksum
+	flagUDPChecksum
+)
+
+var flagNames = [...]string{
+	"Sniffed", "Outbound", "Loopback", "Impostor",
+	"IPv6", "IPChecksum", "TCPChecksum", "UDPChecksum",
+}
+
+func (a *Address) flag(f uint8) bool {
+	return a.Flags&f != 0
+}
+
+func (a *Address) setFlag(f uint8, v bool) {
+	if v {
+		a.Flags |= f
+	} else {
+		a.Flags &^= f
+	}
+}
+
+// Sniffed reports whether the packet was sniffed, i.e. not blocked.
+func (a *Address) Sniffed() bool { return a.flag(flagSniffed) }
+
+// SetSniffed sets the Sniffed flag.
+func (a *Address) SetSniffed(v bool) { a.setFlag(flagSniffed, v) }
+
+// Outbound reports whether the packet is outbound.
+func (a *Address) Outbound() bool { return a.flag(flagOutbound) }
+
+// SetOutbound sets the Outbound flag.
+func (a *Address) SetOutbound(v bool) { a.setFlag(flagOutbound, v) }
+
+// Loopback reports whether the packet is a loopback packet.
+func (a *Address) Loopback() bool { return a.flag(flagLoopback) }
+
+// SetLoopback sets the Loopback flag.
+func (a *Address) SetLoopback(v bool) { a.setFlag(flagLoopback, v) }
+
+// Impostor reports whether the packet was injected by another handle.
+func (a *Address) Impostor() bool { return a.flag(flagImpostor) }
+
+// SetImpostor sets the Impostor flag.
+func (a *Address) SetImpostor(v bool) { a.setFlag(flagImpostor, v) }
+
+// IPv6 reports whether the packet is IPv6.
+func (a *Address) IPv6() bool { return a.flag(flagIPv6) }
+
+// SetIPv6 sets the IPv6 flag.
+func (a *Address) SetIPv6(v bool) { a.setFlag(flagIPv6, v) }
+
+// IPChecksum reports whether the IPv4 checksum is valid.
+func (a *Address) IPChecksum() bool { return a.flag(flagIPChecksum) }
+
+// SetIPChecksum sets the IPChecksum flag.
+func (a *Address) SetIPChecksum(v bool) { a.setFlag(flagIPChecksum, v) }
+
+// TCPChecksum reports whether the TCP checksum is valid.
+func (a *Address) TCPChecksum() bool { return a.flag(flagTCPChecksum) }
+
+// SetTCPChecksum sets the TCPChecksum flag.
+func (a *Address) SetTCPChecksum(v bool) { a.setFlag(flagTCPChecksum, v) }
+
+// UDPChecksum reports whether the UDP checksum is valid.
+func (a *Address) UDPChecksum() bool { return a.flag(flagUDPChecksum) }
+
+// SetUDPChecksum sets the UDPChecksum flag.
+func (a *Address) SetUDPChecksum(v bool) { a.setFlag(flagUDPChecksum, v) }
+
+// String returns the layer, event, flags and timestamp of the address, e.g.
+// "WINDIVERT_LAYER_NETWORK WINDIVERT_EVENT_NETWORK_PACKET Outbound|IPv6 123".
+func (a *Address) String() string {
+	b := make([]byte, 0, 96)
+	b = append(b, a.Layer().String()...)
+	b = append(b, ' ')
+	b = append(b, a.Event().String()...)
+	b = append(b, ' ')
+	n := len(b)
+	for i, name := range flagNames {
+		if a.Flags&(1<<i) != 0 {
+			if len(b) > n {
+				b = append(b, '|')
+			}
+			b = append(b, name...)
+		}
+	}
+	if len(b) == n {
+		b = append(b, '0')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, a.Timestamp, 10)
+	return string(b)
+}
+
 // Ethernet is ...
 func (a *Address) Ethernet() *Ethernet {
 	return (*Ethernet)(unsafe.Pointer(&a.union))
@@ -155,3 +333,58 @@ func (a *Address) Flow() *Flow {
 func (a *Address) Reflect() *Reflect {
 	return (*Reflect)(unsafe.Pointer(&a.union))
 }
+
+// NewPacketAddress returns a network layer address for sending packet, for
+// example one built with header.Builder. The IPv6 flag follows the packet
+// and the checksum flags are set, as the packet is taken to carry valid
+// checksums. Inbound packets also need the interface set in Network().
+func NewPacketAddress(packet []byte, outbound bool) (*Address, error) {
+	p, ok := header.ParsePacket(packet)
+	if !ok {
+		return nil, errPacket
+	}
+	a := &Address{layer: uint8(LayerNetwork), event: uint8(EventNetworkPacket)}
+	a.SetOutbound(outbound)
+	a.SetIPv6(p.IPv6 != nil)
+	a.SetIPChecksum(p.IPv4 != nil)
+	a.SetTCPChecksum(p.TCP != nil)
+	a.SetUDPChecksum(p.UDP != nil)
+	return a, nil
+}
+
+// FilterAddress returns the fields of the address that filters test, for
+// evaluating a filter.Program in user space.
+func (a *Address) FilterAddress() filter.Address {
+	fa := filter.Address{
+		Layer:     filter.Layer(a.layer),
+		Event:     a.event,
+		Timestamp: a.Timestamp,
+		Outbound:  a.Outbound(),
+		Loopback:  a.Loopback(),
+		Impostor:  a.Impostor(),
+		IPv6:      a.IPv6(),
+	}
+	switch a.Layer() {
+	case LayerNetwork, LayerNetworkForward:
+		nw := a.Network()
+		fa.IfIdx = nw.InterfaceIndex
+		fa.SubIfIdx = nw.SubInterfaceIndex
+	case LayerFlow, LayerSocket:
+		// Flow and Socket share the same layout.
+		sk := a.Socket()
+		fa.EndpointID = sk.EndpointID
+		fa.ParentEndpointID = sk.ParentEndpointID
+		fa.ProcessID = sk.ProcessID
+		fa.LocalAddr = addrWords(&sk.LocalAddress)
+		fa.RemoteAddr = addrWords(&sk.RemoteAddress)
+		fa.LocalPort = sk.LocalPort
+		fa.RemotePort = sk.RemotePort
+		fa.Protocol = sk.Protocol
+	case LayerReflect:
+		rf := a.Reflect()
+		fa.ProcessID = rf.ProcessID
+		fa.ReflectLayer = filter.Layer(rf.Layer())
+		fa.Priority = rf.Priority
+	}
+	return fa
+}
@@ -0,0 +1,283 @@
+package divert
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"github.com/imgk/divert-go/header"
+)
+
+// addrBytes returns the memory of a as WinDivert sees it.
+func addrBytes(a *Address) *[80]byte {
+	return (*[80]byte)(unsafe.Pointer(a))
+}
+
+func TestAddressSize(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		size uintptr
+		max  uintptr
+	}{
+		{"Address", unsafe.Sizeof(Address{}), 80},
+		{"Network", unsafe.Sizeof(Network{}), 64},
+		{"Ethernet", unsafe.Sizeof(Ethernet{}), 64},
+		{"Socket", unsafe.Sizeof(Socket{}), 64},
+		{"Flow", unsafe.Sizeof(Flow{}), 64},
+		{"Reflect", unsafe.Sizeof(Reflect{}), 64},
+	} {
+		if tt.size != tt.max {
+			t.Errorf("sizeof %s = %d, want %d", tt.name, tt.size, tt.max)
+		}
+	}
+}
+
+// TestAddressFlags checks the bitfields following Layer and Event in
+// WINDIVERT_ADDRESS, from the least significant bit of the third byte.
+func TestAddressFlags(t *testing.T) {
+	for bit, tt := range []struct {
+		name string
+		get  func(*Address) bool
+		set  func(*Address, bool)
+	}{
+		{"Sniffed", (*Address).Sniffed, (*Address).SetSniffed},
+		{"Outbound", (*Address).Outbound, (*Address).SetOutbound},
+		{"Loopback", (*Address).Loopback, (*Address).SetLoopback},
+		{"Impostor", (*Address).Impostor, (*Address).SetImpostor},
+		{"IPv6", (*Address).IPv6, (*Address).SetIPv6},
+		{"IPChecksum", (*Address).IPChecksum, (*Address).SetIPChecksum},
+		{"TCPChecksum", (*Address).TCPChecksum, (*Address).SetTCPChecksum},
+		{"UDPChecksum", (*Address).UDPChecksum, (*Address).SetUDPChecksum},
+	} {
+		var a Address
+		b := addrBytes(&a)
+		b[10] = 1 << bit
+		if !tt.get(&a) {
+			t.Errorf("%s() = false with byte 10 = %#x", tt.name, b[10])
+		}
+		b[10] = ^uint8(1 << bit)
+		if tt.get(&a) {
+			t.Errorf("%s() = true with byte 10 = %#x", tt.name, b[10])
+		}
+
+		a = Address{}
+		tt.set(&a, true)
+		if want := [80]byte{10: 1 << bit}; *b != want {
+			t.Errorf("Set%s(true) = % x, want % x", tt.name, b[:16], want[:16])
+		}
+		b[10] = 0xff
+		tt.set(&a, false)
+		if want := [80]byte{10: ^uint8(1 << bit)}; *b != want {
+			t.Errorf("Set%s(false) = % x, want % x", tt.name, b[:16], want[:16])
+		}
+	}
+}
+
+func TestAddressHeader(t *testing.T) {
+	for _, tt := range []struct {
+		layer Layer
+		event Event
+		b8    byte
+		b9    byte
+	}{
+		{LayerNetwork, EventNetworkPacket, 0, 0},
+		{LayerNetworkForward, EventNetworkPacket, 1, 0},
+		{LayerFlow, EventFlowEstablished, 2, 1},
+		{LayerFlow, EventFlowDeleted, 2, 2},
+		{LayerSocket, EventSocketBind, 3, 3},
+		{LayerSocket, EventSocketConnect, 3, 4},
+		{LayerSocket, EventSocketListen, 3, 5},
+		{LayerSocket, EventSocketAccept, 3, 6},
+		{LayerSocket, EventSocketClose, 3, 7},
+		{LayerReflect, EventReflectOpen, 4, 8},
+		{LayerReflect, EventReflectClose, 4, 9},
+	} {
+		var a Address
+		b := addrBytes(&a)
+		b[8], b[9] = tt.b8, tt.b9
+		if a.Layer() != tt.layer || a.Event() != tt.event {
+			t.Errorf("bytes %d %d: layer %v event %v, want %v %v", tt.b8, tt.b9, a.Layer(), a.Event(), tt.layer, tt.event)
+		}
+
+		a = Address{}
+		a.SetLayer(tt.layer)
+		a.SetEvent(tt.event)
+		if want := [80]byte{8: tt.b8, 9: tt.b9}; *b != want {
+			t.Errorf("SetLayer(%v), SetEvent(%v) = % x, want % x", tt.layer, tt.event, b[:16], want[:16])
+		}
+	}
+
+	var a Address
+	b := addrBytes(&a)
+	binary.LittleEndian.PutUint64(b[0:], 0x0102030405060708)
+	if a.Timestamp != 0x0102030405060708 {
+		t.Errorf("Timestamp = %#x", a.Timestamp)
+	}
+}
+
+// TestAddressUnion checks the views of the union of WINDIVERT_ADDRESS,
+// which starts at byte 16.
+func TestAddressUnion(t *testing.T) {
+	var a Address
+	b := addrBytes(&a)
+	u := b[16:]
+
+	binary.LittleEndian.PutUint32(u[0:], 7)
+	binary.LittleEndian.PutUint32(u[4:], 3)
+	if nw := a.Network(); nw.InterfaceIndex != 7 || nw.SubInterfaceIndex != 3 {
+		t.Errorf("Network() = %+v", *nw)
+	}
+	if eth := a.Ethernet(); eth.InterfaceIndex != 7 || eth.SubInterfaceIndex != 3 {
+		t.Errorf("Ethernet() = %+v", *eth)
+	}
+
+	a = Address{}
+	binary.LittleEndian.PutUint64(u[0:], 0x1111)
+	binary.LittleEndian.PutUint64(u[8:], 0x2222)
+	binary.LittleEndian.PutUint32(u[16:], 1234)
+	// Addresses are host order words, least significant first, so
+	// 10.0.0.1 is the IPv4-mapped ::ffff:10.0.0.1.
+	binary.LittleEndian.PutUint32(u[20:], 0x0a000001)
+	binary.LittleEndian.PutUint32(u[24:], 0x0000ffff)
+	binary.LittleEndian.PutUint32(u[36:], 0x0a000002)
+	binary.LittleEndian.PutUint32(u[40:], 0x0000ffff)
+	binary.LittleEndian.PutUint16(u[52:], 40000)
+	binary.LittleEndian.PutUint16(u[54:], 443)
+	u[56] = 6
+
+	sk, fl := a.Socket(), a.Flow()
+	if sk.EndpointID != 0x1111 || sk.ParentEndpointID != 0x2222 || sk.ProcessID != 1234 || sk.Protocol != 6 {
+		t.Errorf("Socket() = %+v", *sk)
+	}
+	if *fl != Flow(*sk) {
+		t.Errorf("Flow() = %+v, Socket() = %+v", *fl, *sk)
+	}
+	local := netip.MustParseAddrPort("10.0.0.1:40000")
+	remote := netip.MustParseAddrPort("10.0.0.2:443")
+	if ap := sk.LocalAddrPort(); ap != local {
+		t.Errorf("LocalAddrPort() = %v, want %v", ap, local)
+	}
+	if ap := fl.RemoteAddrPort(); ap != remote {
+		t.Errorf("RemoteAddrPort() = %v, want %v", ap, remote)
+	}
+
+	want := *b
+	a = Address{}
+	sk = a.Socket()
+	sk.EndpointID, sk.ParentEndpointID, sk.ProcessID, sk.Protocol = 0x1111, 0x2222, 1234, 6
+	sk.SetLocalAddrPort(local)
+	sk.SetRemoteAddrPort(remote)
+	if *b != want {
+		t.Errorf("Socket fields = % x, want % x", b[16:], want[16:])
+	}
+
+	a = Address{}
+	binary.LittleEndian.PutUint64(u[0:], 0x3333)
+	binary.LittleEndian.PutUint32(u[8:], 5678)
+	binary.LittleEndian.PutUint32(u[12:], uint32(LayerSocket))
+	binary.LittleEndian.PutUint64(u[16:], FlagSniff|FlagRecvOnly)
+	binary.LittleEndian.PutUint16(u[24:], 0xfffe)
+	rf := a.Reflect()
+	if rf.TimeStamp != 0x3333 || rf.ProcessID != 5678 || rf.Layer() != LayerSocket || rf.Flags != FlagSniff|FlagRecvOnly || rf.Priority != -2 {
+		t.Errorf("Reflect() = %+v", *rf)
+	}
+}
+
+func TestNewPacketAddress(t *testing.T) {
+	for _, tt := range []struct {
+		network   header.NetworkFields
+		transport header.TransportFields
+		outbound  bool
+		// ipv6, ip, tcp and udp are the IPv6 and checksum flags.
+		ipv6, ip, tcp, udp bool
+	}{
+		{&header.IPv4Fields{SrcAddr: netip.MustParseAddr("10.0.0.1"), DstAddr: netip.MustParseAddr("10.0.0.2")},
+			&header.TCPFields{}, true, false, true, true, false},
+		{&header.IPv4Fields{SrcAddr: netip.MustParseAddr("10.0.0.1"), DstAddr: netip.MustParseAddr("10.0.0.2")},
+			&header.ICMPv4Fields{}, false, false, true, false, false},
+		{&header.IPv6Fields{SrcAddr: netip.MustParseAddr("fe80::1"), DstAddr: netip.MustParseAddr("2001:db8::2")},
+			&header.UDPFields{}, false, true, false, false, true},
+		{&header.IPv6Fields{SrcAddr: netip.MustParseAddr("fe80::1"), DstAddr: netip.MustParseAddr("2001:db8::2")},
+			&header.TCPFields{}, true, true, false, true, false},
+	} {
+		b := header.Builder{Network: tt.network, Transport: tt.transport}
+		pkt, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := NewPacketAddress(pkt, tt.outbound)
+		if err != nil {
+			t.Errorf("NewPacketAddress(%x): %v", pkt, err)
+			continue
+		}
+		if a.Layer() != LayerNetwork || a.Event() != EventNetworkPacket || a.Outbound() != tt.outbound || a.IPv6() != tt.ipv6 ||
+			a.IPChecksum() != tt.ip || a.TCPChecksum() != tt.tcp || a.UDPChecksum() != tt.udp {
+			t.Errorf("NewPacketAddress(%x, %v) = %v", pkt, tt.outbound, a)
+		}
+		if a.Sniffed() || a.Loopback() || a.Impostor() || *a.Network() != (Network{}) {
+			t.Errorf("NewPacketAddress(%x) set other fields: %v", pkt, a)
+		}
+	}
+
+	if _, err := NewPacketAddress([]byte{0x45, 0}, true); err != errPacket {
+		t.Errorf("NewPacketAddress of a short packet: %v, want %v", err, errPacket)
+	}
+}
+
+// TestAddrPortLayout checks the endpoints of Socket and Flow against the
+// raw bytes of the address: host order words, least significant first, so
+// each word of an IPv6 address is stored byte swapped.
+func TestAddrPortLayout(t *testing.T) {
+	for _, tt := range []struct {
+		ap  string
+		raw [16]byte
+	}{
+		// ::ffff:10.0.0.1
+		{"10.0.0.1:40000", [16]byte{0x01, 0x00, 0x00, 0x0a, 0xff, 0xff}},
+		// 2001:db8::1234:5678
+		{"[2001:db8::1234:5678]:443", [16]byte{0x78, 0x56, 0x34, 0x12, 12: 0xb8, 0x0d, 0x01, 0x20}},
+	} {
+		ap := netip.MustParseAddrPort(tt.ap)
+		port := binary.LittleEndian.AppendUint16(nil, ap.Port())
+
+		for _, local := range []bool{true, false} {
+			// The local endpoint is at byte 36 of the address, the remote
+			// one at 52, the ports at 68 and 70.
+			addrOff, portOff := 36, 68
+			if !local {
+				addrOff, portOff = 52, 70
+			}
+
+			var a Address
+			b := addrBytes(&a)
+			copy(b[addrOff:], tt.raw[:])
+			copy(b[portOff:], port)
+			sk, fl := a.Socket(), a.Flow()
+			get := [2]netip.AddrPort{sk.LocalAddrPort(), fl.LocalAddrPort()}
+			set := [2]func(netip.AddrPort){sk.SetLocalAddrPort, fl.SetLocalAddrPort}
+			if !local {
+				get = [2]netip.AddrPort{sk.RemoteAddrPort(), fl.RemoteAddrPort()}
+				set = [2]func(netip.AddrPort){sk.SetRemoteAddrPort, fl.SetRemoteAddrPort}
+			}
+			if get[0] != ap || get[1] != ap {
+				t.Errorf("%v (local %v) read as %v and %v", ap, local, get[0], get[1])
+			}
+
+			var want [80]byte
+			copy(want[addrOff:], tt.raw[:])
+			copy(want[portOff:], port)
+			// An IPv4-mapped address is written like the IPv4 one.
+			mapped := netip.AddrPortFrom(netip.AddrFrom16(ap.Addr().As16()), ap.Port())
+			for _, f := range set {
+				for _, v := range []netip.AddrPort{ap, mapped} {
+					a = Address{}
+					f(v)
+					if *b != want {
+						t.Errorf("%v (local %v) written as % x, want % x", v, local, b[36:72], want[36:72])
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package divert
+
+// PacketHandle is an open WinDivert handle. On Windows it is implemented
+// by *Handle, other implementations such as a simulated driver allow code
+// using the package to be tested on any platform.
+type PacketHandle interface {
+	Recv(buffer []byte, address *Address) (uint, error)
+	RecvEx(buffer []byte, address []Address) (uint, uint, error)
+	Send(buffer []byte, address *Address) (uint, error)
+	SendEx(buffer []byte, address []Address) (uint, error)
+	Shutdown(how Shutdown) error
+	GetParam(p Param) (uint64, error)
+	SetParam(p Param, v uint64) error
+	Close() error
+}
+
+// Backend opens handles, it is the driver behind the PacketHandles.
+type Backend interface {
+	// Open opens a handle like the Open function.
+	Open(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error)
+}
+
+// checkedBackend is a Backend that validates the filter in Open and can
+// skip it when OpenWith already did.
+type checkedBackend interface {
+	openChecked(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error)
+}
+
+// OpenWith is like OpenWithOptions but opens the handle with b.
+func OpenWith(b Backend, filter string, layer Layer, opts *Options) (PacketHandle, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := opts.Validate(layer); err != nil {
+		return nil, err
+	}
+	if err := checkFilter(filter, layer); err != nil {
+		return nil, err
+	}
+	open := b.Open
+	if c, ok := b.(checkedBackend); ok {
+		open = c.openChecked
+	}
+	h, err := open(filter, layer, opts.Priority, opts.Flags)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.apply(h); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows || !(amd64 || 386 || arm64)
+
+package divert
+
+import "errors"
+
+var errUnsupported = errors.New("WinDivert is only available on Windows for amd64, 386 and arm64")
+
+// unsupported is the Backend of platforms without WinDivert.
+type unsupported struct{}
+
+func (unsupported) Open(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error) {
+	return nil, errUnsupported
+}
+
+// SystemBackend returns the Backend of the WinDivert driver. On this
+// platform there is none and opening a handle fails.
+func SystemBackend() Backend {
+	return unsupported{}
+}
@@ -0,0 +1,43 @@
+package divert
+
+import (
+	"errors"
+	"testing"
+)
+
+var errOpened = errors.New("opened")
+
+// checkingBackend records which of its open methods OpenWith calls.
+type checkingBackend struct {
+	open, checked int
+}
+
+func (b *checkingBackend) Open(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error) {
+	b.open++
+	return nil, errOpened
+}
+
+func (b *checkingBackend) openChecked(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error) {
+	b.checked++
+	return nil, errOpened
+}
+
+// TestOpenWithChecked checks that OpenWith validates the filter once.
+func TestOpenWithChecked(t *testing.T) {
+	var b checkingBackend
+	if _, err := OpenWith(&b, "tcp.DstPort == 80", LayerNetwork, nil); err != errOpened {
+		t.Fatalf("OpenWith: %v", err)
+	}
+	if b.open != 0 || b.checked != 1 {
+		t.Errorf("Open called %d times, openChecked %d times", b.open, b.checked)
+	}
+
+	_, err := OpenWith(&b, "tcp.DstPort ==", LayerNetwork, nil)
+	var fe *FilterError
+	if !errors.As(err, &fe) {
+		t.Errorf("OpenWith error = %v, want *FilterError", err)
+	}
+	if b.open != 0 || b.checked != 1 {
+		t.Errorf("bad filter opened")
+	}
+}
@@ -0,0 +1,49 @@
+//go:build windows && (amd64 || 386 || arm64)
+
+package divert
+
+var _ PacketHandle = (*Handle)(nil)
+
+// Open opens a handle of the WinDivert driver. A bad filter is reported
+// as a *FilterError.
+func Open(filter string, layer Layer, priority int16, flags uint64) (*Handle, error) {
+	if err := checkFilter(filter, layer); err != nil {
+		return nil, err
+	}
+	return openDriver(filter, layer, priority, flags)
+}
+
+// driver is the Backend of the WinDivert driver.
+type driver struct{}
+
+func (driver) Open(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error) {
+	h, err := Open(filter, layer, priority, flags)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (driver) openChecked(filter string, layer Layer, priority int16, flags uint64) (PacketHandle, error) {
+	h, err := openDriver(filter, layer, priority, flags)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// SystemBackend returns the Backend of the WinDivert driver, its handles
+// are of type *Handle.
+func SystemBackend() Backend {
+	return driver{}
+}
+
+// OpenWithOptions validates the options and the filter for layer, opens
+// a handle and sets its queue parameters. A nil opts uses the defaults.
+func OpenWithOptions(filter string, layer Layer, opts *Options) (*Handle, error) {
+	h, err := OpenWith(driver{}, filter, layer, opts)
+	if err != nil {
+		return nil, err
+	}
+	return h.(*Handle), nil
+}
@@ -0,0 +1,88 @@
+package divert
+
+import (
+	"math/bits"
+	"time"
+)
+
+// ClockSource is the performance counter that WinDivert timestamps are
+// read from, together with the wall clock to anchor them to. On Windows
+// SystemClock uses QueryPerformanceCounter and time.Now.
+type ClockSource interface {
+	// Counter returns the current value of the performance counter.
+	Counter() int64
+	// Frequency returns the number of counter ticks per second.
+	Frequency() int64
+	// Now returns the current wall clock time.
+	Now() time.Time
+}
+
+// Clock converts WinDivert timestamps, which are performance counter
+// values, to time.Time and time.Duration. It captures the counter
+// frequency and a wall clock anchor once when created, so converted times
+// do not follow later adjustments of the system time.
+type Clock struct {
+	src     ClockSource
+	freq    int64
+	counter int64
+	wall    time.Time
+}
+
+// NewClock returns a Clock reading the frequency and the anchor from src.
+func NewClock(src ClockSource) *Clock {
+	c := &Clock{src: src, freq: src.Frequency()}
+	// Read the wall clock between two counter reads and take the
+	// midpoint of the counter.
+	before := src.Counter()
+	c.wall = src.Now()
+	after := src.Counter()
+	c.counter = before + (after-before)/2
+	return c
+}
+
+// Frequency returns the number of counter ticks per second.
+func (c *Clock) Frequency() int64 {
+	return c.freq
+}
+
+// Duration converts a number of counter ticks to a duration. It saturates
+// instead of overflowing.
+func (c *Clock) Duration(ticks int64) time.Duration {
+	if c.freq <= 0 {
+		return 0
+	}
+	neg := ticks < 0
+	u := uint64(ticks)
+	if neg {
+		u = -u
+	}
+	hi, lo := bits.Mul64(u, uint64(time.Second))
+	if hi >= uint64(c.freq) {
+		if neg {
+			return time.Duration(-1 << 63)
+		}
+		return time.Duration(1<<63 - 1)
+	}
+	q, _ := bits.Div64(hi, lo, uint64(c.freq))
+	if neg {
+		if q >= 1<<63 {
+			return time.Duration(-1 << 63)
+		}
+		return -time.Duration(q)
+	}
+	if q > 1<<63-1 {
+		q = 1<<63 - 1
+	}
+	return time.Duration(q)
+}
+
+// Time converts a timestamp to wall clock time.
+func (c *Clock) Time(timestamp int64) time.Time {
+	return c.wall.Add(c.Duration(timestamp - c.counter))
+}
+
+// Since returns the time elapsed since the timestamp, measured with the
+// performance counter.
+func (c *Clock) Since(timestamp int64) time.Duration {
+	return c.Duration(c.src.Counter() - timestamp)
+}
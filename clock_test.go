@@ -0,0 +1,108 @@
+package divert
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock advances its counter by step on every read.
+type fakeClock struct {
+	counter int64
+	step    int64
+	freq    int64
+	now     time.Time
+}
+
+func (c *fakeClock) Counter() int64 {
+	n := c.counter
+	c.counter += c.step
+	return n
+}
+
+func (c *fakeClock) Frequency() int64 { return c.freq }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+const (
+	minDuration = time.Duration(-1 << 63)
+	maxDuration = time.Duration(1<<63 - 1)
+)
+
+func TestClockDuration(t *testing.T) {
+	for _, tt := range []struct {
+		freq  int64
+		ticks int64
+		d     time.Duration
+	}{
+		{10_000_000, 0, 0},
+		{10_000_000, 1, 100 * time.Nanosecond},
+		{10_000_000, -1, -100 * time.Nanosecond},
+		{10_000_000, 10_000_000, time.Second},
+		{10_000_000, 36_000_000_000, time.Hour},
+		{1_000_000_000, 1, time.Nanosecond},
+		// Ticks shorter than a nanosecond are truncated toward zero.
+		{3_000_000_000, 1, 0},
+		{3_000_000_000, 2, 0},
+		{3_000_000_000, 3, time.Nanosecond},
+		{3_000_000_000, -5, -time.Nanosecond},
+		{3, 1, 333_333_333},
+		{3, -2, -666_666_666},
+		// The intermediate product overflows 64 bits, the result not.
+		{10_000_000, 1 << 40, time.Duration(1<<40) * 100},
+		// The result overflows and saturates.
+		{10_000_000, 1 << 62, maxDuration},
+		{10_000_000, -1 << 62, minDuration},
+		{1, 1<<63 - 1, maxDuration},
+		{1, -1 << 63, minDuration},
+		{1_000_000_000, 1<<63 - 1, maxDuration},
+		{1_000_000_000, -1 << 63, minDuration},
+		// An invalid frequency converts to zero.
+		{0, 100, 0},
+		{-1, 100, 0},
+	} {
+		c := NewClock(&fakeClock{freq: tt.freq})
+		if d := c.Duration(tt.ticks); d != tt.d {
+			t.Errorf("Duration(%d) at %d Hz = %d, want %d", tt.ticks, tt.freq, d, tt.d)
+		}
+	}
+}
+
+func TestClockTime(t *testing.T) {
+	wall := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := &fakeClock{counter: 1000, step: 20, freq: 10_000_000, now: wall}
+	c := NewClock(src)
+	if c.Frequency() != 10_000_000 {
+		t.Errorf("Frequency() = %d", c.Frequency())
+	}
+
+	// The anchor is the midpoint of the two reads around Now, 1010.
+	for _, tt := range []struct {
+		timestamp int64
+		want      time.Time
+	}{
+		{1010, wall},
+		{1011, wall.Add(100 * time.Nanosecond)},
+		{1000, wall.Add(-time.Microsecond)},
+		{1010 + 10_000_000, wall.Add(time.Second)},
+		{1010 - 10_000_000, wall.Add(-time.Second)},
+	} {
+		if got := c.Time(tt.timestamp); !got.Equal(tt.want) {
+			t.Errorf("Time(%d) = %v, want %v", tt.timestamp, got, tt.want)
+		}
+	}
+
+	// The next read of the counter is 1040.
+	if d := c.Since(1030); d != time.Microsecond {
+		t.Errorf("Since(1030) = %v, want 1µs", d)
+	}
+	src.counter = 1000
+	if d := c.Since(1030); d != -3*time.Microsecond {
+		t.Errorf("Since(1030) = %v, want -3µs", d)
+	}
+	src.counter = 1<<63 - 1
+	if d := c.Since(-1 << 62); d != minDuration {
+		// The difference of the counters wraps around, as it does for
+		// timestamps far apart.
+		t.Errorf("Since(-1<<62) = %v, want %v", d, minDuration)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build windows && (amd64 || 386 || arm64)
+
+package divert
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	kernel32                      = windows.NewLazySystemDLL("kernel32.dll")
+	procQueryPerformanceCounter   = kernel32.NewProc("QueryPerformanceCounter")
+	procQueryPerformanceFrequency = kernel32.NewProc("QueryPerformanceFrequency")
+)
+
+// systemClockSource reads QueryPerformanceCounter, the clock of the
+// WinDivert timestamps.
+type systemClockSource struct{}
+
+func (systemClockSource) Counter() (n int64) {
+	procQueryPerformanceCounter.Call(uintptr(unsafe.Pointer(&n)))
+	return
+}
+
+func (systemClockSource) Frequency() (n int64) {
+	procQueryPerformanceFrequency.Call(uintptr(unsafe.Pointer(&n)))
+	return
+}
+
+func (systemClockSource) Now() time.Time {
+	return time.Now()
+}
+
+var systemClock = sync.OnceValue(func() *Clock {
+	return NewClock(systemClockSource{})
+})
+
+// SystemClock returns the Clock of the local machine, created on first use.
+func SystemClock() *Clock {
+	return systemClock()
+}
+
+// Time returns the timestamp as wall clock time, see SystemClock.
+func (a *Address) Time() time.Time {
+	return SystemClock().Time(a.Timestamp)
+}
+
+// Time returns the time the handle was opened as wall clock time, see
+// SystemClock.
+func (r *Reflect) Time() time.Time {
+	return SystemClock().Time(r.TimeStamp)
+}
@@ -1,5 +1,3 @@
-//go:build windows && (amd64 || 386 || arm64)
-
 package divert
 
 type Layer int
@@ -6,6 +6,15 @@ package divert
 // #include "windivert.h"
 import "C"
 
+import "unsafe"
+
+// Address must have the size of WINDIVERT_ADDRESS, addr_test.go pins the
+// layout.
+var (
+	_ [unsafe.Sizeof(Address{}) - C.sizeof_WINDIVERT_ADDRESS]byte
+	_ [C.sizeof_WINDIVERT_ADDRESS - unsafe.Sizeof(Address{})]byte
+)
+
 const (
 	LayerNetwork        = Layer(C.WINDIVERT_LAYER_NETWORK)
 	LayerNetworkForward = Layer(C.WINDIVERT_LAYER_NETWORK_FORWARD)
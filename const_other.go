@@ -1,4 +1,4 @@
-//go:build windows && !divert_cgo && (amd64 || 386 || arm64)
+//go:build !(windows && divert_cgo && (amd64 || 386 || arm64))
 
 package divert
 
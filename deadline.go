@@ -0,0 +1,96 @@
+//go:build windows && (amd64 || 386 || arm64)
+
+package divert
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// deadline is a read or write deadline of a Handle. Like pipeDeadline of
+// net.Pipe it also applies to calls that are already blocked: when it
+// passes, the pending I/O of the calls is canceled with CancelIoEx. The
+// zero value has no deadline.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+	pending map[*windows.Overlapped]windows.Handle
+}
+
+// set sets the deadline. A zero t means no deadline and a time in the
+// past expires the deadline at once.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.expired = false
+
+	// Time is zero, then there is no deadline.
+	if t.IsZero() {
+		return
+	}
+
+	// Time in the future, setup a timer to expire in the future.
+	if dur := time.Until(t); dur > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(dur, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			// The deadline may have been set again meanwhile.
+			if d.timer == timer {
+				d.timer = nil
+				d.expire()
+			}
+		})
+		d.timer = timer
+		return
+	}
+
+	// Time in the past, so expire immediately.
+	d.expire()
+}
+
+// expire cancels the pending I/O. d.mu must be held.
+func (d *deadline) expire() {
+	d.expired = true
+	for overlapped, h := range d.pending {
+		windows.CancelIoEx(h, overlapped)
+	}
+}
+
+// passed reports whether the deadline has passed.
+func (d *deadline) passed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// add registers the pending I/O of overlapped on h, canceling it at once
+// if the deadline has passed.
+func (d *deadline) add(h windows.Handle, overlapped *windows.Overlapped) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending == nil {
+		d.pending = map[*windows.Overlapped]windows.Handle{}
+	}
+	d.pending[overlapped] = h
+	if d.expired {
+		windows.CancelIoEx(h, overlapped)
+	}
+}
+
+// remove unregisters the finished I/O of overlapped and reports whether
+// the deadline has passed. The I/O is not canceled after it returns.
+func (d *deadline) remove(overlapped *windows.Overlapped) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, overlapped)
+	return d.expired
+}
@@ -3,9 +3,12 @@
 package divert
 
 import (
+	"context"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -48,38 +51,174 @@ func ioControlEx(h windows.Handle, code CtlCode, ioctl unsafe.Pointer, buf *byte
 	return
 }
 
-func ioControl(h windows.Handle, code CtlCode, ioctl unsafe.Pointer, buf *byte, bufLen uint32) (iolen uint32, err error) {
-	event, _ := windows.CreateEvent(nil, 0, 0, nil)
+// ioControlContext is ioControlEx that cancels the pending I/O with
+// CancelIoEx when ctx is done or the deadline passes, which returns
+// ctx.Err() or os.ErrDeadlineExceeded. The I/O is finished before it
+// returns, so the overlapped structure can be used again.
+func ioControlContext(ctx context.Context, d *deadline, h windows.Handle, code CtlCode, ioctl unsafe.Pointer, buf *byte, bufLen uint32, overlapped *windows.Overlapped) (iolen uint32, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if d.passed() {
+		return 0, os.ErrDeadlineExceeded
+	}
 
-	overlapped := windows.Overlapped{
-		HEvent: event,
+	err = windows.DeviceIoControl(h, uint32(code), (*byte)(ioctl), uint32(unsafe.Sizeof(ioCtl{})), buf, bufLen, &iolen, overlapped)
+	if err != windows.ERROR_IO_PENDING {
+		return
 	}
 
-	iolen, err = ioControlEx(h, code, ioctl, buf, bufLen, &overlapped)
+	// The deadline cancels the I/O itself, only a context that can be
+	// done needs a callback.
+	d.add(h, overlapped)
+	var (
+		stop     func() bool
+		canceled chan struct{}
+	)
+	if ctx.Done() != nil {
+		canceled = make(chan struct{})
+		stop = context.AfterFunc(ctx, func() {
+			windows.CancelIoEx(h, overlapped)
+			close(canceled)
+		})
+	}
+	err = windows.GetOverlappedResult(h, overlapped, &iolen, true)
+	expired := d.remove(overlapped)
+	if stop != nil && !stop() {
+		<-canceled
+	}
 
-	windows.CloseHandle(event)
+	// The I/O may complete before it is canceled, then its result stands.
+	if err == windows.ERROR_OPERATION_ABORTED {
+		if ctx.Err() != nil {
+			return iolen, ctx.Err()
+		}
+		if expired {
+			return iolen, os.ErrDeadlineExceeded
+		}
+	}
 	return
 }
 
 // Handle is ...
+// Recv, RecvEx, Send, SendEx and the other methods can be called from
+// any number of goroutines at once, each call uses its own OVERLAPPED.
 type Handle struct {
-	sync.Mutex
 	windows.Handle
-	rOverlapped windows.Overlapped
-	wOverlapped windows.Overlapped
+	rDeadline deadline
+	wDeadline deadline
+	layer     Layer
+	filter    string
+	reqs      freeList[request, *request]
+}
+
+// request holds what the driver accesses while an I/O is pending: the
+// OVERLAPPED with its event and the words written on completion. It is
+// allocated on the heap so that it does not move.
+type request struct {
+	overlapped windows.Overlapped
+	addrLen    uint
+	value      uint64
+}
+
+// open creates the event of the request. The low bit of the event keeps
+// the completion out of the CompletionPort the handle may be associated
+// with.
+func (r *request) open() error {
+	event, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	r.overlapped.HEvent = event | 1
+	return nil
+}
+
+func (r *request) release() {
+	windows.CloseHandle(r.overlapped.HEvent &^ 1)
+}
+
+// getRequest returns an unused request of the handle.
+func (h *Handle) getRequest() (*request, error) {
+	return h.reqs.get()
+}
+
+// putRequest returns a request whose I/O has finished.
+func (h *Handle) putRequest(req *request) {
+	*req = request{overlapped: windows.Overlapped{HEvent: req.overlapped.HEvent}}
+	h.reqs.put(req)
+}
+
+// ioControl runs an I/O control that completes without waiting for
+// packets.
+func (h *Handle) ioControl(code CtlCode, ioctl unsafe.Pointer, buf *byte, bufLen uint32) (iolen uint32, err error) {
+	req, err := h.getRequest()
+	if err != nil {
+		return 0, err
+	}
+	defer h.putRequest(req)
+	return ioControlEx(h.Handle, code, ioctl, buf, bufLen, &req.overlapped)
+}
+
+// opError wraps an error of op on the handle in an *OpError.
+func (h *Handle) opError(op string, err error) error {
+	return opError(op, h.layer, h.filter, err)
+}
+
+// ioError is opError but returns the errors of ctx as they are.
+func (h *Handle) ioError(ctx context.Context, op string, err error) error {
+	if err == ctx.Err() {
+		return err
+	}
+	return h.opError(op, err)
+}
+
+// SetDeadline sets the read and write deadlines, see SetReadDeadline and
+// SetWriteDeadline.
+func (h *Handle) SetDeadline(t time.Time) error {
+	h.rDeadline.set(t)
+	h.wDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Recv, RecvEx and their Context
+// variants like net.Conn does, including calls that are already blocked.
+// Once it passes they fail with an error wrapping os.ErrDeadlineExceeded.
+// A zero value for t means no deadline.
+func (h *Handle) SetReadDeadline(t time.Time) error {
+	h.rDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Send, SendEx and their Context
+// variants, see SetReadDeadline.
+func (h *Handle) SetWriteDeadline(t time.Time) error {
+	h.wDeadline.set(t)
+	return nil
 }
 
 // Recv is ...
 func (h *Handle) Recv(buffer []byte, address *Address) (uint, error) {
-	addrLen := uint(unsafe.Sizeof(Address{}))
+	return h.RecvContext(context.Background(), buffer, address)
+}
+
+// RecvContext is Recv that returns ctx.Err() if ctx is done before a
+// packet is received. The handle stays usable.
+func (h *Handle) RecvContext(ctx context.Context, buffer []byte, address *Address) (uint, error) {
+	req, err := h.getRequest()
+	if err != nil {
+		return 0, h.opError("recv", err)
+	}
+	defer h.putRequest(req)
+
+	req.addrLen = uint(unsafe.Sizeof(Address{}))
 	recv := recv{
 		Addr:       uint64(uintptr(unsafe.Pointer(address))),
-		AddrLenPtr: uint64(uintptr(unsafe.Pointer(&addrLen))),
+		AddrLenPtr: uint64(uintptr(unsafe.Pointer(&req.addrLen))),
 	}
 
-	iolen, err := ioControlEx(h.Handle, ioCtlRecv, unsafe.Pointer(&recv), &buffer[0], uint32(len(buffer)), &h.rOverlapped)
+	iolen, err := ioControlContext(ctx, &h.rDeadline, h.Handle, ioCtlRecv, unsafe.Pointer(&recv), unsafe.SliceData(buffer), uint32(len(buffer)), &req.overlapped)
 	if err != nil {
-		return uint(iolen), Error(err.(windows.Errno))
+		return uint(iolen), h.ioError(ctx, "recv", err)
 	}
 
 	return uint(iolen), nil
@@ -87,30 +226,58 @@ func (h *Handle) Recv(buffer []byte, address *Address) (uint, error) {
 
 // RecvEx is ...
 func (h *Handle) RecvEx(buffer []byte, address []Address) (uint, uint, error) {
-	addrLen := uint(len(address)) * uint(unsafe.Sizeof(Address{}))
+	return h.RecvExContext(context.Background(), buffer, address)
+}
+
+// RecvExContext is RecvEx that returns ctx.Err() if ctx is done before a
+// packet is received. The handle stays usable.
+func (h *Handle) RecvExContext(ctx context.Context, buffer []byte, address []Address) (uint, uint, error) {
+	if len(address) == 0 {
+		return 0, 0, h.opError("recv", ErrInvalidParameter)
+	}
+
+	req, err := h.getRequest()
+	if err != nil {
+		return 0, 0, h.opError("recv", err)
+	}
+	defer h.putRequest(req)
+
+	req.addrLen = uint(len(address)) * uint(unsafe.Sizeof(Address{}))
 	recv := recv{
-		Addr:       uint64(uintptr(unsafe.Pointer(&address[0]))),
-		AddrLenPtr: uint64(uintptr(unsafe.Pointer(&addrLen))),
+		Addr:       uint64(uintptr(unsafe.Pointer(unsafe.SliceData(address)))),
+		AddrLenPtr: uint64(uintptr(unsafe.Pointer(&req.addrLen))),
 	}
 
-	iolen, err := ioControlEx(h.Handle, ioCtlRecv, unsafe.Pointer(&recv), &buffer[0], uint32(len(buffer)), &h.rOverlapped)
+	iolen, err := ioControlContext(ctx, &h.rDeadline, h.Handle, ioCtlRecv, unsafe.Pointer(&recv), unsafe.SliceData(buffer), uint32(len(buffer)), &req.overlapped)
 	if err != nil {
-		return uint(iolen), addrLen / uint(unsafe.Sizeof(Address{})), Error(err.(windows.Errno))
+		return uint(iolen), req.addrLen / uint(unsafe.Sizeof(Address{})), h.ioError(ctx, "recv", err)
 	}
 
-	return uint(iolen), addrLen / uint(unsafe.Sizeof(Address{})), nil
+	return uint(iolen), req.addrLen / uint(unsafe.Sizeof(Address{})), nil
 }
 
 // Send is ...
 func (h *Handle) Send(buffer []byte, address *Address) (uint, error) {
+	return h.SendContext(context.Background(), buffer, address)
+}
+
+// SendContext is Send that returns ctx.Err() if ctx is done before the
+// packet is sent. The handle stays usable.
+func (h *Handle) SendContext(ctx context.Context, buffer []byte, address *Address) (uint, error) {
+	req, err := h.getRequest()
+	if err != nil {
+		return 0, h.opError("send", err)
+	}
+	defer h.putRequest(req)
+
 	send := send{
 		Addr:    uint64(uintptr(unsafe.Pointer(address))),
 		AddrLen: uint64(unsafe.Sizeof(Address{})),
 	}
 
-	iolen, err := ioControlEx(h.Handle, ioCtlSend, unsafe.Pointer(&send), &buffer[0], uint32(len(buffer)), &h.wOverlapped)
+	iolen, err := ioControlContext(ctx, &h.wDeadline, h.Handle, ioCtlSend, unsafe.Pointer(&send), unsafe.SliceData(buffer), uint32(len(buffer)), &req.overlapped)
 	if err != nil {
-		return uint(iolen), Error(err.(windows.Errno))
+		return uint(iolen), h.ioError(ctx, "send", err)
 	}
 
 	return uint(iolen), nil
@@ -118,14 +285,30 @@ func (h *Handle) Send(buffer []byte, address *Address) (uint, error) {
 
 // SendEx is ...
 func (h *Handle) SendEx(buffer []byte, address []Address) (uint, error) {
+	return h.SendExContext(context.Background(), buffer, address)
+}
+
+// SendExContext is SendEx that returns ctx.Err() if ctx is done before the
+// packets are sent. The handle stays usable.
+func (h *Handle) SendExContext(ctx context.Context, buffer []byte, address []Address) (uint, error) {
+	if len(address) == 0 {
+		return 0, h.opError("send", ErrInvalidParameter)
+	}
+
+	req, err := h.getRequest()
+	if err != nil {
+		return 0, h.opError("send", err)
+	}
+	defer h.putRequest(req)
+
 	send := send{
-		Addr:    uint64(uintptr(unsafe.Pointer(&address[0]))),
+		Addr:    uint64(uintptr(unsafe.Pointer(unsafe.SliceData(address)))),
 		AddrLen: uint64(unsafe.Sizeof(Address{})) * uint64(len(address)),
 	}
 
-	iolen, err := ioControlEx(h.Handle, ioCtlSend, unsafe.Pointer(&send), &buffer[0], uint32(len(buffer)), &h.wOverlapped)
+	iolen, err := ioControlContext(ctx, &h.wDeadline, h.Handle, ioCtlSend, unsafe.Pointer(&send), unsafe.SliceData(buffer), uint32(len(buffer)), &req.overlapped)
 	if err != nil {
-		return uint(iolen), Error(err.(windows.Errno))
+		return uint(iolen), h.ioError(ctx, "send", err)
 	}
 
 	return uint(iolen), nil
@@ -137,22 +320,25 @@ func (h *Handle) Shutdown(how Shutdown) error {
 		How: uint32(how),
 	}
 
-	_, err := ioControl(h.Handle, ioCtlShutdown, unsafe.Pointer(&shutdown), nil, 0)
+	_, err := h.ioControl(ioCtlShutdown, unsafe.Pointer(&shutdown), nil, 0)
 	if err != nil {
-		return Error(err.(windows.Errno))
+		return h.opError("shutdown", err)
 	}
 
 	return nil
 }
 
 // Close is ...
+// Calls blocked on the handle are aborted. Closing the handle again
+// returns ErrInvalidHandle.
 func (h *Handle) Close() error {
-	windows.CloseHandle(h.rOverlapped.HEvent)
-	windows.CloseHandle(h.wOverlapped.HEvent)
+	if !h.reqs.close() {
+		return h.opError("close", ErrInvalidHandle)
+	}
 
 	err := windows.CloseHandle(h.Handle)
 	if err != nil {
-		return Error(err.(windows.Errno))
+		return h.opError("close", err)
 	}
 
 	return nil
@@ -165,12 +351,18 @@ func (h *Handle) GetParam(p Param) (uint64, error) {
 		Value: 0,
 	}
 
-	_, err := ioControl(h.Handle, ioCtlGetParam, unsafe.Pointer(&getParam), (*byte)(unsafe.Pointer(&getParam.Value)), uint32(unsafe.Sizeof(getParam.Value)))
+	req, err := h.getRequest()
+	if err != nil {
+		return 0, h.opError("getparam", err)
+	}
+	defer h.putRequest(req)
+
+	_, err = ioControlEx(h.Handle, ioCtlGetParam, unsafe.Pointer(&getParam), (*byte)(unsafe.Pointer(&req.value)), uint32(unsafe.Sizeof(req.value)), &req.overlapped)
 	if err != nil {
-		return getParam.Value, Error(err.(windows.Errno))
+		return req.value, h.opError("getparam", err)
 	}
 
-	return getParam.Value, nil
+	return req.value, nil
 }
 
 // SetParam is ...
@@ -178,18 +370,18 @@ func (h *Handle) SetParam(p Param, v uint64) error {
 	switch p {
 	case QueueLength:
 		if v < QueueLengthMin || v > QueueLengthMax {
-			return errQueueLength
+			return h.opError("setparam", errQueueLength)
 		}
 	case QueueTime:
 		if v < QueueTimeMin || v > QueueTimeMax {
-			return errQueueTime
+			return h.opError("setparam", errQueueTime)
 		}
 	case QueueSize:
 		if v < QueueSizeMin || v > QueueSizeMax {
-			return errQueueSize
+			return h.opError("setparam", errQueueSize)
 		}
 	default:
-		return errQueueParam
+		return h.opError("setparam", errQueueParam)
 	}
 
 	setParam := setParam{
@@ -197,9 +389,9 @@ func (h *Handle) SetParam(p Param, v uint64) error {
 		Param: uint32(p),
 	}
 
-	_, err := ioControl(h.Handle, ioCtlSetParam, unsafe.Pointer(&setParam), nil, 0)
+	_, err := h.ioControl(ioCtlSetParam, unsafe.Pointer(&setParam), nil, 0)
 	if err != nil {
-		return Error(err.(windows.Errno))
+		return h.opError("setparam", err)
 	}
 
 	return nil
@@ -12,14 +12,14 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
 )
 
-// Open is ...
-func Open(filter string, layer Layer, priority int16, flags uint64) (h *Handle, err error) {
+// openDriver loads WinDivert on first use and opens a handle with a
+// validated filter.
+func openDriver(filter string, layer Layer, priority int16, flags uint64) (h *Handle, err error) {
 	once.Do(func() {
 		vers := map[string]struct{}{
 			"2.0": {},
@@ -73,26 +73,12 @@ func open(filter string, layer Layer, priority int16, flags uint64) (h *Handle,
 	runtime.UnlockOSThread()
 
 	if hd == C.HANDLE(C.INVALID_HANDLE_VALUE) {
-		return nil, Error(C.GetLastError())
+		return nil, opError("open", layer, filter, windows.Errno(C.GetLastError()))
 	}
 
-	rEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
-	wEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
-
 	return &Handle{
-		Mutex:  sync.Mutex{},
 		Handle: windows.Handle(uintptr(unsafe.Pointer(hd))),
-		rOverlapped: windows.Overlapped{
-			HEvent: rEvent,
-		},
-		wOverlapped: windows.Overlapped{
-			HEvent: wEvent,
-		},
+		layer:  layer,
+		filter: filter,
 	}, nil
 }
-
-// CalcChecksums is ...
-func CalcChecksums(buffer []byte, address *Address, flags uint64) bool {
-	re := C.WinDivertHelperCalcChecksums(unsafe.Pointer(&buffer[0]), C.UINT(len(buffer)), (*C.WINDIVERT_ADDRESS)(unsafe.Pointer(address)), C.uint64_t(flags))
-	return re == C.TRUE
-}
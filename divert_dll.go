@@ -11,13 +11,13 @@ import (
 )
 
 var (
-	winDivert              = (*windows.DLL)(nil)
-	winDivertOpen          = (*windows.Proc)(nil)
-	winDivertCalcChecksums = (*windows.Proc)(nil)
+	winDivert     = (*windows.DLL)(nil)
+	winDivertOpen = (*windows.Proc)(nil)
 )
 
-// Open is ...
-func Open(filter string, layer Layer, priority int16, flags uint64) (h *Handle, err error) {
+// openDriver loads WinDivert on first use and opens a handle with a
+// validated filter.
+func openDriver(filter string, layer Layer, priority int16, flags uint64) (h *Handle, err error) {
 	once.Do(func() {
 		dll, er := windows.LoadDLL("WinDivert.dll")
 		if er != nil {
@@ -33,13 +33,6 @@ func Open(filter string, layer Layer, priority int16, flags uint64) (h *Handle,
 		}
 		winDivertOpen = proc
 
-		proc, er = winDivert.FindProc("WinDivertHelperCalcChecksums")
-		if er != nil {
-			err = er
-			return
-		}
-		winDivertCalcChecksums = proc
-
 		vers := map[string]struct{}{
 			"2.0": {},
 			"2.1": {},
@@ -4,7 +4,6 @@ package divert
 
 import (
 	"runtime"
-	"sync"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -17,7 +16,7 @@ func open(filter string, layer Layer, priority int16, flags uint64) (h *Handle,
 
 	filterPtr, err := windows.BytePtrFromString(filter)
 	if err != nil {
-		return nil, err
+		return nil, opError("open", layer, filter, err)
 	}
 
 	runtime.LockOSThread()
@@ -26,29 +25,12 @@ func open(filter string, layer Layer, priority int16, flags uint64) (h *Handle,
 	runtime.UnlockOSThread()
 
 	if windows.Handle(hd) == windows.InvalidHandle {
-		return nil, Error(err.(windows.Errno))
+		return nil, opError("open", layer, filter, err)
 	}
 
-	rEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
-	wEvent, _ := windows.CreateEvent(nil, 0, 0, nil)
-
 	return &Handle{
-		Mutex:  sync.Mutex{},
 		Handle: windows.Handle(hd),
-		rOverlapped: windows.Overlapped{
-			HEvent: rEvent,
-		},
-		wOverlapped: windows.Overlapped{
-			HEvent: wEvent,
-		},
+		layer:  layer,
+		filter: filter,
 	}, nil
 }
-
-// CalcChecksums is ...
-func CalcChecksums(buffer []byte, address *Address, flags uint64) bool {
-	re, _, err := winDivertCalcChecksums.Call(uintptr(unsafe.Pointer(&buffer[0])), uintptr(len(buffer)), uintptr(unsafe.Pointer(address)), uintptr(flags), 0)
-	if err != nil {
-		return false
-	}
-	return re != 0
-}
@@ -17,13 +17,13 @@ import (
 )
 
 var (
-	winDivert              = (*lazyDLL)(nil)
-	winDivertOpen          = (*lazyProc)(nil)
-	winDivertCalcChecksums = (*lazyProc)(nil)
+	winDivert     = (*lazyDLL)(nil)
+	winDivertOpen = (*lazyProc)(nil)
 )
 
-// Open is ...
-func Open(filter string, layer Layer, priority int16, flags uint64) (h *Handle, err error) {
+// openDriver loads WinDivert on first use and opens a handle with a
+// validated filter.
+func openDriver(filter string, layer Layer, priority int16, flags uint64) (h *Handle, err error) {
 	once.Do(func() {
 		dll := newLazyDLL("WinDivert.dll", nil)
 		if er := dll.Load(); er != nil {
@@ -39,13 +39,6 @@ func Open(filter string, layer Layer, priority int16, flags uint64) (h *Handle,
 		}
 		winDivertOpen = proc
 
-		proc = winDivert.NewProc("WinDivertHelperCalcChecksums")
-		if er := proc.Find(); er != nil {
-			err = er
-			return
-		}
-		winDivertCalcChecksums = proc
-
 		vers := map[string]struct{}{
 			"2.0": {},
 			"2.1": {},
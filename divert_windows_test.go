@@ -0,0 +1,134 @@
+//go:build windows && (amd64 || 386 || arm64)
+
+package divert
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imgk/divert-go/header"
+)
+
+// openTest opens a handle of the driver, skipping the test if WinDivert
+// is not available, e.g. without Administrator privileges.
+func openTest(t *testing.T, filter string, flags uint64) *Handle {
+	t.Helper()
+	h, err := Open(filter, LayerNetwork, PriorityDefault, flags)
+	if err != nil {
+		t.Skipf("WinDivert is not available: %v", err)
+	}
+	return h
+}
+
+func TestHandleCloseAbortsRecv(t *testing.T) {
+	h := openTest(t, "false", FlagDefault)
+
+	const calls = 8
+	errs := make(chan error, calls)
+	for i := range calls {
+		go func() {
+			var addr Address
+			if i%2 == 0 {
+				_, err := h.Recv(make([]byte, 1500), &addr)
+				errs <- err
+				return
+			}
+			_, _, err := h.RecvEx(make([]byte, 1500), make([]Address, 4))
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range calls {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrOperationAborted) && !errors.Is(err, ErrInvalidHandle) {
+				t.Errorf("blocked Recv: %v, want ErrOperationAborted", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close did not abort a blocked Recv")
+		}
+	}
+
+	if err := h.Close(); !errors.Is(err, ErrInvalidHandle) {
+		t.Errorf("second Close: %v, want ErrInvalidHandle", err)
+	}
+}
+
+func TestHandleConcurrentSend(t *testing.T) {
+	h := openTest(t, "false", FlagSendOnly)
+	defer h.Close()
+
+	b := header.Builder{
+		Network: &header.IPv4Fields{
+			TTL:     64,
+			SrcAddr: netip.MustParseAddr("127.0.0.1"),
+			DstAddr: netip.MustParseAddr("127.0.0.1"),
+		},
+		Transport: &header.UDPFields{SrcPort: 40000, DstPort: 9},
+		Payload:   []byte("divert"),
+	}
+	pkt, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := NewPacketAddress(pkt, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr.SetLoopback(true)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				a := *addr
+				if _, err := h.Send(pkt, &a); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := h.SendEx(pkt, []Address{a}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := h.SendEx(pkt, nil); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("SendEx without addresses: %v, want ErrInvalidParameter", err)
+	}
+	if _, _, err := h.RecvEx(make([]byte, 1500), nil); !errors.Is(err, ErrInvalidParameter) {
+		t.Errorf("RecvEx without addresses: %v, want ErrInvalidParameter", err)
+	}
+}
+
+func TestHandleSetParamError(t *testing.T) {
+	h := openTest(t, "false", FlagDefault)
+	defer h.Close()
+
+	for _, tt := range []struct {
+		p   Param
+		v   uint64
+		err error
+	}{
+		{QueueLength, QueueLengthMax + 1, errQueueLength},
+		{QueueTime, QueueTimeMin - 1, errQueueTime},
+		{QueueSize, QueueSizeMax + 1, errQueueSize},
+		{VersionMajor, 2, errQueueParam},
+	} {
+		err := h.SetParam(tt.p, tt.v)
+		var opErr *OpError
+		if !errors.As(err, &opErr) || opErr.Op != "setparam" || opErr.Err != tt.err {
+			t.Errorf("SetParam(%v, %v) = %v, want setparam error %v", tt.p, tt.v, err, tt.err)
+		}
+	}
+}
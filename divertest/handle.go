@@ -0,0 +1,314 @@
+package divertest
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/imgk/divert-go"
+	"github.com/imgk/divert-go/filter"
+	"github.com/imgk/divert-go/header"
+)
+
+// Handle is a handle of a Host.
+type Handle struct {
+	host     *Host
+	prog     *filter.Program
+	object   []byte
+	filter   string
+	layer    divert.Layer
+	priority int16
+	flags    uint64
+	opened   int64
+
+	// The fields below are guarded by host.mu, which cond uses.
+	cond     sync.Cond
+	queue    []entry
+	bytes    uint64
+	length   uint64
+	time     uint64
+	size     uint64
+	shutRecv bool
+	shutSend bool
+	closed   bool
+}
+
+var _ divert.PacketHandle = (*Handle)(nil)
+
+// entry is a queued packet.
+type entry struct {
+	packet []byte
+	addr   divert.Address
+	at     time.Time
+}
+
+// Layer returns the layer of the handle.
+func (hd *Handle) Layer() divert.Layer {
+	return hd.layer
+}
+
+// Filter returns the filter string of the handle.
+func (hd *Handle) Filter() string {
+	return hd.filter
+}
+
+// Priority returns the priority of the handle.
+func (hd *Handle) Priority() int16 {
+	return hd.priority
+}
+
+// Queued returns the number of packets waiting to be received.
+func (hd *Handle) Queued() int {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	hd.expire()
+	return len(hd.queue)
+}
+
+func (hd *Handle) opError(op string, err error) error {
+	return &divert.OpError{Op: op, Layer: hd.layer, Filter: hd.filter, Err: err}
+}
+
+// enqueue queues a packet received with verdict v, unless the queue is
+// full.
+func (hd *Handle) enqueue(v Verdict, packet []byte, addr *divert.Address) {
+	h := hd.host
+	hd.expire()
+	if uint64(len(hd.queue)) >= hd.length || hd.bytes+uint64(len(packet)) > hd.size {
+		h.record(QueueFull, hd, packet, addr)
+		return
+	}
+	h.record(v, hd, packet, addr)
+	e := entry{packet: slices.Clone(packet), addr: *addr, at: time.Now()}
+	if v == Sniffed {
+		e.addr.SetSniffed(true)
+	}
+	hd.queue = append(hd.queue, e)
+	hd.bytes += uint64(len(packet))
+	hd.cond.Broadcast()
+}
+
+// expire drops the packets queued for longer than the queue time.
+func (hd *Handle) expire() {
+	deadline := time.Now().Add(-time.Duration(hd.time) * time.Millisecond)
+	n := 0
+	for n < len(hd.queue) && hd.queue[n].at.Before(deadline) {
+		e := &hd.queue[n]
+		hd.host.record(Expired, hd, e.packet, &e.addr)
+		hd.bytes -= uint64(len(e.packet))
+		n++
+	}
+	hd.queue = hd.queue[n:]
+}
+
+// wait waits for a queued packet. It fails once the queue is empty after
+// Shutdown and if the handle is closed, with ErrOperationAborted if it was
+// closed while waiting.
+func (hd *Handle) wait() error {
+	if hd.closed {
+		return divert.ErrInvalidHandle
+	}
+	if hd.flags&divert.FlagSendOnly != 0 {
+		return divert.ErrInvalidParameter
+	}
+	for {
+		if hd.closed {
+			return divert.ErrOperationAborted
+		}
+		hd.expire()
+		if len(hd.queue) != 0 {
+			return nil
+		}
+		if hd.shutRecv {
+			return divert.ErrNoData
+		}
+		hd.cond.Wait()
+	}
+}
+
+// pop copies the first queued packet into buffer and removes it. A packet
+// larger than buffer is cut short and reported as ErrInsufficientBuffer.
+func (hd *Handle) pop(buffer []byte, addr *divert.Address) (int, error) {
+	e := hd.queue[0]
+	hd.queue = hd.queue[1:]
+	hd.bytes -= uint64(len(e.packet))
+	*addr = e.addr
+	n := copy(buffer, e.packet)
+	if n < len(e.packet) {
+		return n, divert.ErrInsufficientBuffer
+	}
+	return n, nil
+}
+
+// Recv receives a packet, blocking until one is queued.
+func (hd *Handle) Recv(buffer []byte, address *divert.Address) (uint, error) {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	if err := hd.wait(); err != nil {
+		return 0, hd.opError("recv", err)
+	}
+	n, err := hd.pop(buffer, address)
+	if err != nil {
+		return uint(n), hd.opError("recv", err)
+	}
+	return uint(n), nil
+}
+
+// RecvEx receives up to len(address) packets that fit into buffer,
+// blocking until one is queued.
+func (hd *Handle) RecvEx(buffer []byte, address []divert.Address) (uint, uint, error) {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	if len(address) == 0 {
+		return 0, 0, hd.opError("recv", divert.ErrInvalidParameter)
+	}
+	if err := hd.wait(); err != nil {
+		return 0, 0, hd.opError("recv", err)
+	}
+	n, err := hd.pop(buffer, &address[0])
+	if err != nil {
+		return uint(n), 1, hd.opError("recv", err)
+	}
+	count := 1
+	for count < len(address) && len(hd.queue) != 0 && len(hd.queue[0].packet) <= len(buffer)-n {
+		m, _ := hd.pop(buffer[n:], &address[count])
+		n += m
+		count++
+	}
+	return uint(n), uint(count), nil
+}
+
+// Send injects a packet. The address must be of the layer of the handle.
+func (hd *Handle) Send(buffer []byte, address *divert.Address) (uint, error) {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	if err := hd.checkSend(address); err != nil {
+		return 0, hd.opError("send", err)
+	}
+	if err := hd.host.send(hd, buffer, address); err != nil {
+		return 0, hd.opError("send", err)
+	}
+	return uint(len(buffer)), nil
+}
+
+// SendEx injects len(address) packets stored back to back in buffer.
+func (hd *Handle) SendEx(buffer []byte, address []divert.Address) (uint, error) {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	n := 0
+	for i := range address {
+		if err := hd.checkSend(&address[i]); err != nil {
+			return uint(n), hd.opError("send", err)
+		}
+		p, ok := header.ParsePacket(buffer[n:])
+		if !ok {
+			return uint(n), hd.opError("send", divert.ErrInvalidParameter)
+		}
+		end := len(buffer) - len(p.Next)
+		if err := hd.host.send(hd, buffer[n:end], &address[i]); err != nil {
+			return uint(n), hd.opError("send", err)
+		}
+		n = end
+	}
+	return uint(n), nil
+}
+
+func (hd *Handle) checkSend(address *divert.Address) error {
+	switch {
+	case hd.closed:
+		return divert.ErrInvalidHandle
+	case hd.shutSend:
+		return divert.ErrNoData
+	case hd.flags&divert.FlagRecvOnly != 0:
+		return divert.ErrInvalidParameter
+	case address.Layer() != hd.layer:
+		return divert.ErrInvalidParameter
+	}
+	return nil
+}
+
+// Shutdown stops receiving, sending or both. Packets queued before can
+// still be received, then Recv fails with ErrNoData.
+func (hd *Handle) Shutdown(how divert.Shutdown) error {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	if hd.closed {
+		return hd.opError("shutdown", divert.ErrInvalidHandle)
+	}
+	switch how {
+	case divert.ShutdownRecv:
+		hd.shutRecv = true
+	case divert.ShutdownSend:
+		hd.shutSend = true
+	case divert.ShutdownBoth:
+		hd.shutRecv, hd.shutSend = true, true
+	default:
+		return hd.opError("shutdown", divert.ErrInvalidParameter)
+	}
+	hd.cond.Broadcast()
+	return nil
+}
+
+// Close closes the handle, discarding queued packets. Blocked calls of
+// Recv fail with ErrOperationAborted.
+func (hd *Handle) Close() error {
+	h := hd.host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hd.closed {
+		return hd.opError("close", divert.ErrInvalidHandle)
+	}
+	hd.closed = true
+	hd.queue, hd.bytes = nil, 0
+	h.handles = slices.DeleteFunc(h.handles, func(other *Handle) bool { return other == hd })
+	hd.cond.Broadcast()
+	if hd.layer != divert.LayerReflect {
+		h.reflect(divert.EventReflectClose, hd, nil)
+	}
+	return nil
+}
+
+// GetParam returns a queue parameter or the version of the driver, which
+// is 2.2.
+func (hd *Handle) GetParam(p divert.Param) (uint64, error) {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	if hd.closed {
+		return 0, hd.opError("getparam", divert.ErrInvalidHandle)
+	}
+	switch p {
+	case divert.QueueLength:
+		return hd.length, nil
+	case divert.QueueTime:
+		return hd.time, nil
+	case divert.QueueSize:
+		return hd.size, nil
+	case divert.VersionMajor:
+		return 2, nil
+	case divert.VersionMinor:
+		return 2, nil
+	default:
+		return 0, hd.opError("getparam", divert.ErrInvalidParameter)
+	}
+}
+
+// SetParam sets a queue parameter. The limits apply to packets queued
+// afterwards.
+func (hd *Handle) SetParam(p divert.Param, v uint64) error {
+	hd.host.mu.Lock()
+	defer hd.host.mu.Unlock()
+	if hd.closed {
+		return hd.opError("setparam", divert.ErrInvalidHandle)
+	}
+	switch {
+	case p == divert.QueueLength && v >= divert.QueueLengthMin && v <= divert.QueueLengthMax:
+		hd.length = v
+	case p == divert.QueueTime && v >= divert.QueueTimeMin && v <= divert.QueueTimeMax:
+		hd.time = v
+	case p == divert.QueueSize && v >= divert.QueueSizeMin && v <= divert.QueueSizeMax:
+		hd.size = v
+	default:
+		return hd.opError("setparam", divert.ErrInvalidParameter)
+	}
+	return nil
+}
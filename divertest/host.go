@@ -0,0 +1,365 @@
+// Package divertest provides a simulated WinDivert driver for tests.
+//
+// A Host stands for a machine running the driver. Tests open handles on it
+// with real filter strings, priorities and flags, pass packets through its
+// virtual interfaces and observe what each handle receives and what
+// happens to every packet. Host implements divert.Backend and its handles
+// divert.PacketHandle, so code written against those interfaces can be
+// tested on any platform.
+//
+//	host := divertest.NewHost()
+//	eth := host.AddInterface()
+//	h, _ := host.Open("tcp.DstPort == 80", divert.LayerNetwork, 0, 0)
+//	eth.Inbound(packet)
+//	n, err := h.Recv(buf, &addr) // the diverted packet
+//	h.Send(buf[:n], &addr)       // re-injected and delivered
+//	host.Records()               // Diverted, Injected, Delivered
+//
+// Packets pass the handles of their layer from the highest priority to the
+// lowest. A handle whose filter matches sniffs a copy of the packet with
+// FlagSniff, drops it with FlagDrop and diverts it otherwise. Packets sent
+// by a handle continue at the handles of lower priority, impostor packets
+// at the highest priority, with their TTL decremented. Packets that pass
+// all handles are delivered.
+package divertest
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/imgk/divert-go"
+	"github.com/imgk/divert-go/filter"
+	"github.com/imgk/divert-go/header"
+)
+
+// Verdict is what happened to a packet or event.
+type Verdict int
+
+const (
+	// Diverted means a handle received the packet, which stops it.
+	Diverted Verdict = iota
+	// Sniffed means a handle received a copy of the packet.
+	Sniffed
+	// Dropped means a handle opened with FlagDrop dropped the packet.
+	Dropped
+	// QueueFull means the packet was lost as the queue of a handle
+	// reached its length or size limit.
+	QueueFull
+	// Expired means the packet was lost as it stayed longer than the
+	// queue time in the queue of a handle.
+	Expired
+	// Injected means a handle sent the packet.
+	Injected
+	// Delivered means the packet passed all handles and reached the
+	// network stack or, if outbound, the network.
+	Delivered
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Diverted:
+		return "Diverted"
+	case Sniffed:
+		return "Sniffed"
+	case Dropped:
+		return "Dropped"
+	case QueueFull:
+		return "QueueFull"
+	case Expired:
+		return "Expired"
+	case Injected:
+		return "Injected"
+	case Delivered:
+		return "Delivered"
+	default:
+		return ""
+	}
+}
+
+// Record is an entry of the log of a Host.
+type Record struct {
+	Verdict Verdict
+	// Handle is the handle that received, dropped, lost or sent the
+	// packet, nil for delivered packets.
+	Handle  *Handle
+	Packet  []byte
+	Address divert.Address
+}
+
+// Host is a simulated machine running WinDivert. It is safe for
+// concurrent use.
+type Host struct {
+	mu      sync.Mutex
+	start   time.Time
+	clock   *divert.Clock
+	pid     uint32
+	ifaces  int
+	handles []*Handle
+	records []Record
+}
+
+var _ divert.Backend = (*Host)(nil)
+
+// NewHost returns a host with a loopback interface.
+func NewHost() *Host {
+	h := &Host{start: time.Now(), pid: uint32(os.Getpid()), ifaces: 1}
+	h.clock = divert.NewClock(hostClock{h})
+	return h
+}
+
+// hostClock counts 100ns ticks since the host was created, like
+// QueryPerformanceCounter on many Windows machines.
+type hostClock struct{ h *Host }
+
+func (c hostClock) Counter() int64   { return int64(time.Since(c.h.start) / 100) }
+func (c hostClock) Frequency() int64 { return int64(time.Second / 100) }
+func (c hostClock) Now() time.Time   { return time.Now() }
+
+// Clock returns the clock of the timestamps of the host.
+func (h *Host) Clock() *divert.Clock {
+	return h.clock
+}
+
+func (h *Host) now() int64 {
+	return hostClock{h}.Counter()
+}
+
+// Records returns a copy of the log of the host.
+func (h *Host) Records() []Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.records)
+}
+
+// Delivered returns the packets that passed all handles.
+func (h *Host) Delivered() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var pkts [][]byte
+	for _, r := range h.records {
+		if r.Verdict == Delivered {
+			pkts = append(pkts, r.Packet)
+		}
+	}
+	return pkts
+}
+
+func (h *Host) record(v Verdict, hd *Handle, packet []byte, addr *divert.Address) {
+	h.records = append(h.records, Record{Verdict: v, Handle: hd, Packet: slices.Clone(packet), Address: *addr})
+}
+
+// Interface is a virtual network interface of a Host.
+type Interface struct {
+	host     *Host
+	Index    uint32
+	SubIndex uint32
+	Loopback bool
+}
+
+// Loopback returns the loopback interface of the host, with index 1.
+func (h *Host) Loopback() *Interface {
+	return &Interface{host: h, Index: 1, Loopback: true}
+}
+
+// AddInterface adds a network interface to the host.
+func (h *Host) AddInterface() *Interface {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ifaces++
+	return &Interface{host: h, Index: uint32(h.ifaces)}
+}
+
+var errPacket = errors.New("divertest: invalid IPv4 or IPv6 packet")
+
+// Inbound passes a packet arriving from the network through the handles
+// of the network layer.
+func (i *Interface) Inbound(packet []byte) error {
+	return i.inject(packet, divert.LayerNetwork, false)
+}
+
+// Outbound passes a packet sent by the local network stack through the
+// handles of the network layer.
+func (i *Interface) Outbound(packet []byte) error {
+	return i.inject(packet, divert.LayerNetwork, true)
+}
+
+// Forward passes a packet arriving on the interface to be routed to
+// another one through the handles of the forward layer.
+func (i *Interface) Forward(packet []byte) error {
+	return i.inject(packet, divert.LayerNetworkForward, false)
+}
+
+func (i *Interface) inject(packet []byte, layer divert.Layer, outbound bool) error {
+	addr, err := divert.NewPacketAddress(packet, outbound)
+	if err != nil {
+		return errPacket
+	}
+	addr.SetLayer(layer)
+	addr.SetLoopback(i.Loopback)
+	addr.Network().InterfaceIndex = i.Index
+	addr.Network().SubInterfaceIndex = i.SubIndex
+
+	h := i.host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addr.Timestamp = h.now()
+	h.route(slices.Clone(packet), addr, nil)
+	return nil
+}
+
+// InjectEvent passes an event of the flow or socket layer through the
+// handles of the layer. A zero Timestamp is set to the current time. It
+// reports false if a socket layer handle without FlagSniff blocked the
+// event.
+func (h *Host) InjectEvent(addr *divert.Address) bool {
+	a := *addr
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if a.Timestamp == 0 {
+		a.Timestamp = h.now()
+	}
+	return h.route(nil, &a, nil)
+}
+
+// route passes a packet or event through the handles of its layer,
+// starting below the priority of from if it is not nil. It reports
+// whether the packet passed all handles.
+func (h *Host) route(packet []byte, addr *divert.Address, from *Handle) bool {
+	fa := addr.FilterAddress()
+	for _, hd := range h.handles {
+		if from != nil && hd.priority >= from.priority {
+			continue
+		}
+		if hd.layer != addr.Layer() || hd.shutRecv || hd.flags&divert.FlagSendOnly != 0 {
+			continue
+		}
+		if ok, err := hd.prog.Eval(packet, &fa); err != nil || !ok {
+			continue
+		}
+		switch {
+		case hd.flags&divert.FlagSniff != 0:
+			hd.enqueue(Sniffed, packet, addr)
+		case hd.flags&divert.FlagDrop != 0:
+			h.record(Dropped, hd, packet, addr)
+			return false
+		default:
+			hd.enqueue(Diverted, packet, addr)
+			return false
+		}
+	}
+	if addr.Layer() == divert.LayerNetwork || addr.Layer() == divert.LayerNetworkForward {
+		h.record(Delivered, nil, packet, addr)
+	}
+	return true
+}
+
+// Open opens a handle of the host. The filter, priority and flags are
+// checked like the driver does.
+func (h *Host) Open(filterStr string, layer divert.Layer, priority int16, flags uint64) (divert.PacketHandle, error) {
+	opts := divert.Options{Priority: priority, Flags: flags}
+	if err := opts.Validate(layer); err != nil {
+		return nil, err
+	}
+	prog, err := filter.Compile(filterStr, filter.Layer(layer))
+	if err != nil {
+		return nil, err
+	}
+	object, err := filter.CompileFilter(filterStr, filter.Layer(layer))
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hd := &Handle{
+		host:     h,
+		prog:     prog,
+		object:   object,
+		filter:   filterStr,
+		layer:    layer,
+		priority: priority,
+		flags:    flags,
+		opened:   h.now(),
+		length:   divert.QueueLengthDefault,
+		time:     divert.QueueTimeDefault,
+		size:     divert.QueueSizeDefault,
+	}
+	hd.cond.L = &h.mu
+	// Handles of equal priority keep the order they were opened in.
+	i, _ := slices.BinarySearchFunc(h.handles, priority, func(hd *Handle, p int16) int {
+		if hd.priority < p {
+			return 1
+		}
+		return -1
+	})
+	h.handles = slices.Insert(h.handles, i, hd)
+
+	if layer == divert.LayerReflect {
+		// The reflect layer also reports handles opened before.
+		for _, other := range h.handles {
+			if other.layer != divert.LayerReflect {
+				h.reflect(divert.EventReflectOpen, other, hd)
+			}
+		}
+	} else {
+		h.reflect(divert.EventReflectOpen, hd, nil)
+	}
+	return hd, nil
+}
+
+// reflect passes a reflect event about hd through the reflect handles,
+// or only to the handle to if it is not nil.
+func (h *Host) reflect(event divert.Event, hd *Handle, to *Handle) {
+	addr := divert.Address{Timestamp: h.now()}
+	addr.SetLayer(divert.LayerReflect)
+	addr.SetEvent(event)
+	addr.SetSniffed(true)
+	rf := addr.Reflect()
+	rf.TimeStamp = hd.opened
+	rf.ProcessID = h.pid
+	rf.SetLayer(hd.layer)
+	rf.Flags = hd.flags
+	rf.Priority = hd.priority
+
+	if to == nil {
+		h.route(hd.object, &addr, nil)
+		return
+	}
+	fa := addr.FilterAddress()
+	if ok, err := to.prog.Eval(hd.object, &fa); err == nil && ok {
+		to.enqueue(Sniffed, hd.object, &addr)
+	}
+}
+
+// send injects a packet sent by hd.
+func (h *Host) send(hd *Handle, packet []byte, addr *divert.Address) error {
+	if _, ok := header.ParsePacket(packet); !ok {
+		return divert.ErrInvalidParameter
+	}
+	packet = slices.Clone(packet)
+	a := *addr
+	a.Timestamp = h.now()
+	from := hd
+	if a.Impostor() {
+		// Impostor packets pass all handles again, the TTL guards
+		// against loops.
+		p, _ := header.ParsePacket(packet)
+		var ttl uint8
+		if p.IPv4 != nil {
+			ttl = p.IPv4.TTL()
+		} else {
+			ttl = p.IPv6.HopLimit()
+		}
+		if ttl <= 1 {
+			return divert.ErrHostUnreachable
+		}
+		p.RewriteTTL(ttl - 1)
+		from = nil
+	}
+	h.record(Injected, hd, packet, &a)
+	h.route(packet, &a, from)
+	return nil
+}
@@ -0,0 +1,401 @@
+package divertest_test
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/imgk/divert-go"
+	"github.com/imgk/divert-go/divertest"
+	"github.com/imgk/divert-go/header"
+)
+
+func tcpPacket(t testing.TB, dstPort uint16, ttl uint8, payload int) []byte {
+	t.Helper()
+	b := header.Builder{
+		Network: &header.IPv4Fields{
+			TTL:     ttl,
+			SrcAddr: netip.MustParseAddr("10.0.0.1"),
+			DstAddr: netip.MustParseAddr("10.0.0.2"),
+		},
+		Transport: &header.TCPFields{SrcPort: 40000, DstPort: dstPort},
+		Payload:   make([]byte, payload),
+	}
+	pkt, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func udpPacket(t testing.TB, dstPort uint16) []byte {
+	t.Helper()
+	b := header.Builder{
+		Network: &header.IPv6Fields{
+			HopLimit: 64,
+			SrcAddr:  netip.MustParseAddr("fe80::1"),
+			DstAddr:  netip.MustParseAddr("2001:db8::2"),
+		},
+		Transport: &header.UDPFields{SrcPort: 40000, DstPort: dstPort},
+	}
+	pkt, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func open(t testing.TB, host *divertest.Host, filter string, layer divert.Layer, priority int16, flags uint64) *divertest.Handle {
+	t.Helper()
+	h, err := host.Open(filter, layer, priority, flags)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", filter, err)
+	}
+	return h.(*divertest.Handle)
+}
+
+type verdict struct {
+	v  divertest.Verdict
+	hd *divertest.Handle
+}
+
+func checkRecords(t testing.TB, host *divertest.Host, want ...verdict) {
+	t.Helper()
+	var got []verdict
+	for _, r := range host.Records() {
+		got = append(got, verdict{r.Verdict, r.Handle})
+	}
+	if len(got) != len(want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("record %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// reinject receives a packet from hd and sends it back.
+func reinject(t testing.TB, hd *divertest.Handle) {
+	t.Helper()
+	buf := make([]byte, divert.MTUMax)
+	var addr divert.Address
+	n, err := hd.Recv(buf, &addr)
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if _, err := hd.Send(buf[:n], &addr); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	lo := open(t, host, "tcp", divert.LayerNetwork, -100, 0)
+	mid := open(t, host, "tcp.DstPort == 80", divert.LayerNetwork, 0, 0)
+	hi := open(t, host, "tcp", divert.LayerNetwork, 100, divert.FlagSniff)
+	// Handles of equal priority see packets in the order they were
+	// opened.
+	mid2 := open(t, host, "tcp", divert.LayerNetwork, 0, 0)
+
+	if err := eth.Inbound(tcpPacket(t, 80, 64, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if hi.Queued() != 1 || mid.Queued() != 1 || mid2.Queued() != 0 || lo.Queued() != 0 {
+		t.Errorf("queued %d %d %d %d, want 1 1 0 0", hi.Queued(), mid.Queued(), mid2.Queued(), lo.Queued())
+	}
+
+	// A sent packet continues below the priority of the sender, so
+	// handles of the same priority do not see it either.
+	reinject(t, mid)
+	reinject(t, lo)
+	if mid2.Queued() != 0 {
+		t.Errorf("handle of the priority of the sender queued the packet")
+	}
+	checkRecords(t, host,
+		verdict{divertest.Sniffed, hi},
+		verdict{divertest.Diverted, mid},
+		verdict{divertest.Injected, mid},
+		verdict{divertest.Diverted, lo},
+		verdict{divertest.Injected, lo},
+		verdict{divertest.Delivered, nil},
+	)
+	if n := len(host.Delivered()); n != 1 {
+		t.Errorf("%d packets delivered, want 1", n)
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	sniff := open(t, host, "tcp", divert.LayerNetwork, 10, divert.FlagSniff)
+	drop := open(t, host, "udp", divert.LayerNetwork, 0, divert.FlagDrop)
+	div := open(t, host, "tcp.DstPort == 443", divert.LayerNetwork, -10, 0)
+
+	eth.Inbound(tcpPacket(t, 80, 64, 0))
+	eth.Inbound(udpPacket(t, 53))
+	eth.Outbound(tcpPacket(t, 443, 64, 0))
+	checkRecords(t, host,
+		verdict{divertest.Sniffed, sniff},
+		verdict{divertest.Delivered, nil},
+		verdict{divertest.Dropped, drop},
+		verdict{divertest.Sniffed, sniff},
+		verdict{divertest.Diverted, div},
+	)
+
+	var addr divert.Address
+	buf := make([]byte, divert.MTUMax)
+	if _, err := sniff.Recv(buf, &addr); err != nil || !addr.Sniffed() || addr.Outbound() {
+		t.Errorf("sniffed: %v, Sniffed %v, Outbound %v", err, addr.Sniffed(), addr.Outbound())
+	}
+	if _, err := div.Recv(buf, &addr); err != nil || addr.Sniffed() || !addr.Outbound() {
+		t.Errorf("diverted: %v, Sniffed %v, Outbound %v", err, addr.Sniffed(), addr.Outbound())
+	}
+	if drop.Queued() != 0 {
+		t.Errorf("drop handle queued %d packets", drop.Queued())
+	}
+}
+
+func TestImpostor(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	hd := open(t, host, "tcp", divert.LayerNetwork, 0, 0)
+
+	eth.Inbound(tcpPacket(t, 80, 2, 0))
+	buf := make([]byte, divert.MTUMax)
+	var addr divert.Address
+	n, err := hd.Recv(buf, &addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An impostor packet passes the handle again with the TTL
+	// decremented.
+	addr.SetImpostor(true)
+	if _, err := hd.Send(buf[:n], &addr); err != nil {
+		t.Fatal(err)
+	}
+	n, err = hd.Recv(buf, &addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := header.ParsePacket(buf[:n])
+	if ttl := p.IPv4.TTL(); ttl != 1 || !addr.Impostor() {
+		t.Errorf("TTL %d, Impostor %v, want 1 true", ttl, addr.Impostor())
+	}
+
+	if _, err := hd.Send(buf[:n], &addr); !errors.Is(err, divert.ErrHostUnreachable) {
+		t.Errorf("Send with TTL 1: %v, want ErrHostUnreachable", err)
+	}
+	checkRecords(t, host,
+		verdict{divertest.Diverted, hd},
+		verdict{divertest.Injected, hd},
+		verdict{divertest.Diverted, hd},
+	)
+}
+
+func TestQueueLimits(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+
+	hd := open(t, host, "tcp.DstPort == 1", divert.LayerNetwork, 0, 0)
+	if err := hd.SetParam(divert.QueueLength, divert.QueueLengthMin); err != nil {
+		t.Fatal(err)
+	}
+	for range divert.QueueLengthMin + 8 {
+		eth.Inbound(tcpPacket(t, 1, 64, 0))
+	}
+	if n := hd.Queued(); n != divert.QueueLengthMin {
+		t.Errorf("queued %d packets, want %d", n, divert.QueueLengthMin)
+	}
+
+	// The 1040 byte packets fill the minimum queue size after 63.
+	hd = open(t, host, "tcp.DstPort == 2", divert.LayerNetwork, 0, 0)
+	if err := hd.SetParam(divert.QueueSize, divert.QueueSizeMin); err != nil {
+		t.Fatal(err)
+	}
+	for range 70 {
+		eth.Inbound(tcpPacket(t, 2, 64, 1000))
+	}
+	if n := hd.Queued(); n != 63 {
+		t.Errorf("queued %d packets, want 63", n)
+	}
+
+	full := 0
+	for _, r := range host.Records() {
+		if r.Verdict == divertest.QueueFull {
+			full++
+		}
+	}
+	if full != 8+7 {
+		t.Errorf("%d packets lost to full queues, want 15", full)
+	}
+
+	for _, p := range []struct {
+		param divert.Param
+		v     uint64
+	}{
+		{divert.QueueLength, divert.QueueLengthMin - 1},
+		{divert.QueueLength, divert.QueueLengthMax + 1},
+		{divert.QueueTime, divert.QueueTimeMax + 1},
+		{divert.QueueSize, divert.QueueSizeMin - 1},
+		{divert.VersionMajor, 2},
+	} {
+		if err := hd.SetParam(p.param, p.v); !errors.Is(err, divert.ErrInvalidParameter) {
+			t.Errorf("SetParam(%v, %d): %v, want ErrInvalidParameter", p.param, p.v, err)
+		}
+	}
+}
+
+func TestQueueExpiry(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	hd := open(t, host, "tcp", divert.LayerNetwork, 0, 0)
+	if err := hd.SetParam(divert.QueueTime, divert.QueueTimeMin); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := hd.GetParam(divert.QueueTime); err != nil || v != divert.QueueTimeMin {
+		t.Errorf("GetParam(QueueTime) = %d, %v", v, err)
+	}
+
+	eth.Inbound(tcpPacket(t, 80, 64, 0))
+	time.Sleep(time.Duration(divert.QueueTimeMin)*time.Millisecond + 50*time.Millisecond)
+	if n := hd.Queued(); n != 0 {
+		t.Errorf("queued %d packets after the queue time", n)
+	}
+	checkRecords(t, host,
+		verdict{divertest.Diverted, hd},
+		verdict{divertest.Expired, hd},
+	)
+}
+
+func TestShutdown(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	hd := open(t, host, "tcp", divert.LayerNetwork, 0, 0)
+	eth.Inbound(tcpPacket(t, 80, 64, 0))
+
+	if err := hd.Shutdown(divert.ShutdownRecv); err != nil {
+		t.Fatal(err)
+	}
+	// Packets queued before are still received, new ones pass.
+	eth.Inbound(tcpPacket(t, 80, 64, 0))
+	buf := make([]byte, divert.MTUMax)
+	var addr divert.Address
+	n, err := hd.Recv(buf, &addr)
+	if err != nil {
+		t.Fatalf("Recv after ShutdownRecv: %v", err)
+	}
+	if _, err := hd.Recv(buf, &addr); !errors.Is(err, divert.ErrNoData) {
+		t.Errorf("Recv of empty queue: %v, want ErrNoData", err)
+	}
+	if _, err := hd.Send(buf[:n], &addr); err != nil {
+		t.Errorf("Send after ShutdownRecv: %v", err)
+	}
+
+	if err := hd.Shutdown(divert.ShutdownSend); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hd.Send(buf[:n], &addr); !errors.Is(err, divert.ErrNoData) {
+		t.Errorf("Send after ShutdownSend: %v, want ErrNoData", err)
+	}
+	if err := hd.Shutdown(divert.Shutdown(3)); !errors.Is(err, divert.ErrInvalidParameter) {
+		t.Errorf("Shutdown(3): %v, want ErrInvalidParameter", err)
+	}
+	checkRecords(t, host,
+		verdict{divertest.Diverted, hd},
+		verdict{divertest.Delivered, nil},
+		verdict{divertest.Injected, hd},
+		verdict{divertest.Delivered, nil},
+	)
+}
+
+func TestClose(t *testing.T) {
+	host := divertest.NewHost()
+	hd := open(t, host, "tcp", divert.LayerNetwork, 0, 0)
+
+	done := make(chan error)
+	go func() {
+		var addr divert.Address
+		_, err := hd.Recv(make([]byte, divert.MTUMax), &addr)
+		done <- err
+	}()
+	// Give Recv time to block, only a blocked Recv is aborted.
+	time.Sleep(10 * time.Millisecond)
+	if err := hd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, divert.ErrOperationAborted) {
+		t.Errorf("blocked Recv: %v, want ErrOperationAborted", err)
+	}
+
+	if err := hd.Close(); !errors.Is(err, divert.ErrInvalidHandle) {
+		t.Errorf("second Close: %v, want ErrInvalidHandle", err)
+	}
+	if _, err := hd.GetParam(divert.QueueLength); !errors.Is(err, divert.ErrInvalidHandle) {
+		t.Errorf("GetParam after Close: %v, want ErrInvalidHandle", err)
+	}
+	var addr divert.Address
+	if _, err := hd.Recv(make([]byte, divert.MTUMax), &addr); !errors.Is(err, divert.ErrInvalidHandle) {
+		t.Errorf("Recv after Close: %v, want ErrInvalidHandle", err)
+	}
+	if _, _, err := hd.RecvEx(make([]byte, divert.MTUMax), make([]divert.Address, 1)); !errors.Is(err, divert.ErrInvalidHandle) {
+		t.Errorf("RecvEx after Close: %v, want ErrInvalidHandle", err)
+	}
+	addr.SetLayer(divert.LayerNetwork)
+	if _, err := hd.Send(tcpPacket(t, 80, 64, 0), &addr); !errors.Is(err, divert.ErrInvalidHandle) {
+		t.Errorf("Send after Close: %v, want ErrInvalidHandle", err)
+	}
+
+	// A closed handle no longer sees packets.
+	host.AddInterface().Inbound(tcpPacket(t, 80, 64, 0))
+	if n := len(host.Delivered()); n != 1 {
+		t.Errorf("%d packets delivered, want 1", n)
+	}
+}
+
+func TestReflect(t *testing.T) {
+	host := divertest.NewHost()
+	open(t, host, "tcp.DstPort == 80", divert.LayerNetwork, 5, divert.FlagSniff)
+	rh := open(t, host, "true", divert.LayerReflect, 0, divert.FlagSniff|divert.FlagRecvOnly)
+	second := open(t, host, "udp", divert.LayerNetwork, -5, 0)
+	second.Close()
+
+	recv := func() *divert.ReflectEvent {
+		t.Helper()
+		buf := make([]byte, 1<<16)
+		var addr divert.Address
+		n, err := rh.Recv(buf, &addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev, err := divert.DecodeReflectEvent(&addr, buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ev
+	}
+	for _, want := range []struct {
+		event    divert.Event
+		priority int16
+		filter   string
+	}{
+		// Handles opened before the reflect handle are reported too.
+		{divert.EventReflectOpen, 5, "tcp.DstPort = 80"},
+		{divert.EventReflectOpen, -5, "udp"},
+		{divert.EventReflectClose, -5, "udp"},
+	} {
+		ev := recv()
+		if ev.Event != want.event || ev.Layer != divert.LayerNetwork || ev.Priority != want.priority {
+			t.Errorf("event %v layer %v priority %d, want %v %v %d", ev.Event, ev.Layer, ev.Priority, want.event, divert.LayerNetwork, want.priority)
+		}
+		if ev.Filter == nil || ev.Filter.String() != want.filter {
+			t.Errorf("filter %v, want %q", ev.Filter, want.filter)
+		}
+	}
+	if n := rh.Queued(); n != 0 {
+		t.Errorf("%d more reflect events", n)
+	}
+}
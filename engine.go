@@ -0,0 +1,447 @@
+package divert
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSourceClosed is returned by CompletionSource.Wait once the source is
+// closed.
+var ErrSourceClosed = errors.New("divert: completion source is closed")
+
+var (
+	errEngineClosed = errors.New("divert: engine is closed")
+	errHandleAdded  = errors.New("divert: handle is already added to the engine")
+	errHandleNotSet = errors.New("divert: handle is not added to the engine")
+	errReceiver     = errors.New("divert: receiver needs a Func")
+)
+
+// Request is a receive started on a CompletionSource. The source fills N,
+// Count and Err when it completes.
+type Request struct {
+	Handle  PacketHandle
+	Buffer  []byte
+	Address []Address
+
+	// N is the number of bytes received into Buffer.
+	N uint
+	// Count is the number of addresses received into Address.
+	Count uint
+	// Err is the error of the receive, an *OpError.
+	Err error
+
+	reg *registration
+	c   Completion
+}
+
+// CompletionSource runs receives asynchronously and reports them as they
+// complete, like an I/O completion port. Wait is called from several
+// goroutines at once.
+type CompletionSource interface {
+	// Associate prepares the source for receives of h.
+	Associate(h PacketHandle) error
+	// Start starts a receive of req.Handle into req.Buffer and
+	// req.Address, which is reported by Wait when it completes. If Start
+	// returns an error, the receive was not started.
+	Start(req *Request) error
+	// Wait returns the next completed receive, or ErrSourceClosed once
+	// the source is closed.
+	Wait() (*Request, error)
+	// Cancel aborts the pending receives of h, which complete with
+	// ErrOperationAborted. A source may not be able to abort them, then
+	// they complete when packets arrive or h is closed.
+	Cancel(h PacketHandle) error
+	// Close makes calls of Wait return ErrSourceClosed.
+	Close() error
+}
+
+// Completion is a receive completed by an Engine.
+type Completion struct {
+	Handle PacketHandle
+	// Data holds the received packets back to back, or the filter object
+	// of a reflect event.
+	Data []byte
+	// Address holds the addresses of the received packets or events.
+	Address []Address
+	// Err is the error of the receive. Data and Address are still valid
+	// for ErrInsufficientBuffer.
+	Err error
+}
+
+// Receiver configures how an Engine receives from a handle.
+type Receiver struct {
+	// Depth is the number of receives kept outstanding, 1 if 0.
+	Depth int
+	// BufferSize is the size of the buffer of each receive, 64KB if 0.
+	BufferSize int
+	// Batch is the number of packets one receive returns at most, 1 if
+	// 0, see RecvEx.
+	Batch int
+	// Func is called with every completed receive. The completion and
+	// its data are only valid until Func returns, then the receive is
+	// started again. Func is called from several goroutines at once.
+	Func func(c *Completion)
+}
+
+// EngineStats are the counters of an Engine.
+type EngineStats struct {
+	// Receives is the number of completed receives, Errors the number of
+	// those that failed.
+	Receives uint64
+	Errors   uint64
+	// Packets and Bytes count the received packets and bytes.
+	Packets uint64
+	Bytes   uint64
+	// Outstanding is the number of receives currently pending.
+	Outstanding int64
+	// Latency is the total time from the driver timestamped the packets
+	// until they were dispatched, MaxLatency the longest. They are 0 if
+	// the engine has no clock.
+	Latency    time.Duration
+	MaxLatency time.Duration
+}
+
+// Engine keeps receives outstanding on many handles through one
+// CompletionSource and dispatches their completions from a fixed number
+// of goroutines, instead of one goroutine blocked in Recv per handle. It
+// is safe for concurrent use.
+type Engine struct {
+	src   CompletionSource
+	clock *Clock
+
+	mu      sync.Mutex
+	regs    map[PacketHandle]*registration
+	closed  bool
+	reqs    sync.WaitGroup // receives not yet retired
+	workers sync.WaitGroup
+
+	receives    atomic.Uint64
+	errors      atomic.Uint64
+	packets     atomic.Uint64
+	bytes       atomic.Uint64
+	outstanding atomic.Int64
+	latency     atomic.Int64
+	maxLatency  atomic.Int64
+}
+
+// registration is a handle added to an Engine.
+type registration struct {
+	h       PacketHandle
+	fn      func(c *Completion)
+	pending sync.WaitGroup
+	ch      chan Completion // set by AddChan, closed after the last receive
+
+	// mu orders starting receives and removing the handle, so no receive
+	// starts after the pending ones were canceled.
+	mu      sync.Mutex
+	removed bool
+}
+
+func (reg *registration) isRemoved() bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.removed
+}
+
+// remove marks the handle removed and cancels its pending receives.
+func (reg *registration) remove(src CompletionSource) error {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.removed = true
+	return src.Cancel(reg.h)
+}
+
+// NewEngine returns an engine dispatching the completions of src from
+// workers goroutines, 1 if workers is less. If clock is not nil, the
+// latency of the packets is measured with it, see SystemClock.
+func NewEngine(src CompletionSource, workers int, clock *Clock) *Engine {
+	e := &Engine{src: src, clock: clock, regs: map[PacketHandle]*registration{}}
+	workers = max(workers, 1)
+	e.workers.Add(workers)
+	for range workers {
+		go e.dispatch()
+	}
+	return e
+}
+
+// Add associates h with the engine and keeps r.Depth receives of it
+// outstanding until h is removed, shut down or closed.
+func (e *Engine) Add(h PacketHandle, r Receiver) error {
+	if r.Func == nil {
+		return errReceiver
+	}
+	return e.add(h, r, nil)
+}
+
+// AddChan is Add delivering the completions to the returned channel,
+// which is closed once no receive of h is outstanding any more. The data
+// of the completions is copied. A slow reader of the channel holds up the
+// other handles of the engine.
+func (e *Engine) AddChan(h PacketHandle, r Receiver) (<-chan Completion, error) {
+	ch := make(chan Completion, max(r.Depth, 1))
+	r.Func = func(c *Completion) {
+		ch <- Completion{
+			Handle:  c.Handle,
+			Data:    append([]byte(nil), c.Data...),
+			Address: append([]Address(nil), c.Address...),
+			Err:     c.Err,
+		}
+	}
+	if err := e.add(h, r, ch); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (e *Engine) add(h PacketHandle, r Receiver, ch chan Completion) error {
+	depth := max(r.Depth, 1)
+	size := r.BufferSize
+	if size <= 0 {
+		size = 1 << 16
+	}
+	batch := max(r.Batch, 1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return errEngineClosed
+	}
+	if _, ok := e.regs[h]; ok {
+		return errHandleAdded
+	}
+	if err := e.src.Associate(h); err != nil {
+		return err
+	}
+	reg := &registration{h: h, fn: r.Func, ch: ch}
+	e.regs[h] = reg
+
+	reg.pending.Add(depth)
+	e.reqs.Add(depth)
+	if ch != nil {
+		go func() {
+			reg.pending.Wait()
+			close(ch)
+		}()
+	}
+
+	var err error
+	for i := range depth {
+		req := &Request{Handle: h, Buffer: make([]byte, size), Address: make([]Address, batch), reg: reg}
+		if err = e.start(req); err != nil {
+			// Give up on the handle, the receives started before are
+			// retired as they are aborted.
+			for range depth - i {
+				e.retire(req)
+			}
+			delete(e.regs, h)
+			reg.remove(e.src)
+			break
+		}
+	}
+	return err
+}
+
+// Remove stops receiving from h and aborts its pending receives. The
+// handle is not closed. Receives of h completing after Remove are dropped
+// without calling Func, only a completion already being dispatched may
+// still be delivered while Remove returns.
+func (e *Engine) Remove(h PacketHandle) error {
+	e.mu.Lock()
+	reg, ok := e.regs[h]
+	delete(e.regs, h)
+	e.mu.Unlock()
+	if !ok {
+		return errHandleNotSet
+	}
+	return reg.remove(e.src)
+}
+
+// Stats returns the counters of the engine.
+func (e *Engine) Stats() EngineStats {
+	return EngineStats{
+		Receives:    e.receives.Load(),
+		Errors:      e.errors.Load(),
+		Packets:     e.packets.Load(),
+		Bytes:       e.bytes.Load(),
+		Outstanding: e.outstanding.Load(),
+		Latency:     time.Duration(e.latency.Load()),
+		MaxLatency:  time.Duration(e.maxLatency.Load()),
+	}
+}
+
+// Close removes all handles, waits for their pending receives and closes
+// the source. With a source that cannot abort receives, close the handles
+// first.
+func (e *Engine) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return errEngineClosed
+	}
+	e.closed = true
+	regs := e.regs
+	e.regs = nil
+	e.mu.Unlock()
+
+	var errs []error
+	for _, reg := range regs {
+		if err := reg.remove(e.src); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	e.reqs.Wait()
+	if err := e.src.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	e.workers.Wait()
+	return errors.Join(errs...)
+}
+
+// start starts a receive.
+func (e *Engine) start(req *Request) error {
+	req.N, req.Count, req.Err = 0, 0, nil
+	e.outstanding.Add(1)
+	if err := e.src.Start(req); err != nil {
+		e.outstanding.Add(-1)
+		return err
+	}
+	return nil
+}
+
+// restart starts a completed receive again. If its handle was removed
+// meanwhile, the receive is retired instead.
+func (e *Engine) restart(req *Request) error {
+	reg := req.reg
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.removed {
+		e.retire(req)
+		return nil
+	}
+	return e.start(req)
+}
+
+// retire drops a receive that is not started again.
+func (e *Engine) retire(req *Request) {
+	req.reg.pending.Done()
+	e.reqs.Done()
+}
+
+// dispatch delivers completions until the source is closed.
+func (e *Engine) dispatch() {
+	defer e.workers.Done()
+	for {
+		req, err := e.src.Wait()
+		if err != nil {
+			return
+		}
+		e.outstanding.Add(-1)
+		// The receives of a removed handle are dropped, also the ones
+		// that got packets before they were aborted.
+		if req.reg.isRemoved() {
+			e.retire(req)
+			continue
+		}
+		e.count(req)
+		e.deliver(req)
+
+		// A receive that failed for another reason than a short buffer
+		// would fail again, e.g. after Shutdown.
+		if req.Err != nil && !errors.Is(req.Err, ErrInsufficientBuffer) {
+			e.retire(req)
+			continue
+		}
+		if err := e.restart(req); err != nil {
+			req.N, req.Count, req.Err = 0, 0, err
+			e.deliver(req)
+			e.retire(req)
+		}
+	}
+}
+
+func (e *Engine) deliver(req *Request) {
+	req.c = Completion{
+		Handle:  req.Handle,
+		Data:    req.Buffer[:min(req.N, uint(len(req.Buffer)))],
+		Address: req.Address[:min(req.Count, uint(len(req.Address)))],
+		Err:     req.Err,
+	}
+	req.reg.fn(&req.c)
+}
+
+// count updates the counters with a completed receive.
+func (e *Engine) count(req *Request) {
+	e.receives.Add(1)
+	if req.Err != nil {
+		e.errors.Add(1)
+	}
+	e.packets.Add(uint64(req.Count))
+	e.bytes.Add(uint64(req.N))
+	if e.clock == nil {
+		return
+	}
+	for i := range min(req.Count, uint(len(req.Address))) {
+		d := int64(e.clock.Since(req.Address[i].Timestamp))
+		e.latency.Add(d)
+		for {
+			m := e.maxLatency.Load()
+			if d <= m || e.maxLatency.CompareAndSwap(m, d) {
+				break
+			}
+		}
+	}
+}
+
+// goSource is a CompletionSource running each receive in a goroutine.
+type goSource struct {
+	done   chan *Request
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewGoSource returns a CompletionSource that works with any PacketHandle,
+// e.g. the simulated ones of divertest, by blocking one goroutine in
+// RecvEx per pending receive. It cannot abort receives.
+func NewGoSource() CompletionSource {
+	return &goSource{done: make(chan *Request), closed: make(chan struct{})}
+}
+
+func (s *goSource) Associate(h PacketHandle) error {
+	return nil
+}
+
+func (s *goSource) Start(req *Request) error {
+	select {
+	case <-s.closed:
+		return ErrSourceClosed
+	default:
+	}
+	go func() {
+		req.N, req.Count, req.Err = req.Handle.RecvEx(req.Buffer, req.Address)
+		select {
+		case s.done <- req:
+		case <-s.closed:
+		}
+	}()
+	return nil
+}
+
+func (s *goSource) Wait() (*Request, error) {
+	select {
+	case req := <-s.done:
+		return req, nil
+	case <-s.closed:
+		return nil, ErrSourceClosed
+	}
+}
+
+func (s *goSource) Cancel(h PacketHandle) error {
+	return nil
+}
+
+func (s *goSource) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
@@ -0,0 +1,300 @@
+package divert_test
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/imgk/divert-go"
+	"github.com/imgk/divert-go/divertest"
+	"github.com/imgk/divert-go/header"
+)
+
+func udpPacket(t testing.TB, dstPort uint16) []byte {
+	t.Helper()
+	b := header.Builder{
+		Network: &header.IPv4Fields{
+			TTL:     64,
+			SrcAddr: netip.MustParseAddr("10.0.0.1"),
+			DstAddr: netip.MustParseAddr("10.0.0.2"),
+		},
+		Transport: &header.UDPFields{SrcPort: 40000, DstPort: dstPort},
+		Payload:   []byte("divert"),
+	}
+	pkt, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func openUDP(t testing.TB, host *divertest.Host) divert.PacketHandle {
+	t.Helper()
+	h, err := host.Open("udp", divert.LayerNetwork, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// closeEngine closes e, failing the test if receives are still counted as
+// pending.
+func closeEngine(t testing.TB, e *divert.Engine) {
+	t.Helper()
+	done := make(chan error)
+	go func() { done <- e.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if n := e.Stats().Outstanding; n != 0 {
+		t.Errorf("%d receives outstanding after Close", n)
+	}
+}
+
+// recvAll reads completions until n packets arrived.
+func recvAll(t testing.TB, ch <-chan divert.Completion, n int) {
+	t.Helper()
+	for n > 0 {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed with %d packets missing", n)
+			}
+			if c.Err != nil {
+				t.Fatalf("completion error: %v", c.Err)
+			}
+			n -= len(c.Address)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d packets missing", n)
+		}
+	}
+}
+
+func waitClosed(t testing.TB, ch <-chan divert.Completion) {
+	t.Helper()
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel not closed")
+		}
+	}
+}
+
+func TestEngineAdd(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	h := openUDP(t, host)
+	e := divert.NewEngine(divert.NewGoSource(), 2, host.Clock())
+
+	var packets atomic.Int64
+	if err := e.Add(h, divert.Receiver{Depth: 2, Batch: 4, Func: func(c *divert.Completion) {
+		if c.Err != nil {
+			t.Errorf("completion error: %v", c.Err)
+		}
+		packets.Add(int64(len(c.Address)))
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Add(h, divert.Receiver{Func: func(*divert.Completion) {}}); err == nil {
+		t.Error("handle added twice")
+	}
+	if err := e.Add(openUDP(t, host), divert.Receiver{}); err == nil {
+		t.Error("receiver without Func added")
+	}
+
+	// The receives are started again until all packets arrived.
+	for range 20 {
+		eth.Inbound(udpPacket(t, 53))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for (packets.Load() < 20 || e.Stats().Outstanding != 2) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	st := e.Stats()
+	if packets.Load() != 20 || st.Packets != 20 || st.Errors != 0 {
+		t.Errorf("%d packets delivered, stats %+v", packets.Load(), st)
+	}
+	if st.Outstanding != 2 {
+		t.Errorf("%d receives outstanding, want depth 2", st.Outstanding)
+	}
+
+	// The go source cannot abort receives, closing the handle does.
+	e.Remove(h)
+	h.Close()
+	closeEngine(t, e)
+	if err := e.Add(openUDP(t, host), divert.Receiver{Func: func(*divert.Completion) {}}); err == nil {
+		t.Error("handle added to a closed engine")
+	}
+	if err := e.Close(); err == nil {
+		t.Error("second Close succeeded")
+	}
+}
+
+func TestEngineAddChan(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	h := openUDP(t, host)
+	e := divert.NewEngine(divert.NewGoSource(), 1, nil)
+	defer closeEngine(t, e)
+
+	ch, err := e.AddChan(h, divert.Receiver{Depth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		eth.Inbound(udpPacket(t, 53))
+		recvAll(t, ch, 1)
+	}
+
+	// After Shutdown the receive fails with ErrNoData, which is delivered
+	// before the channel is closed.
+	h.Shutdown(divert.ShutdownRecv)
+	c, ok := <-ch
+	if !ok || !errors.Is(c.Err, divert.ErrNoData) {
+		t.Errorf("completion after Shutdown: %v %v, want ErrNoData", ok, c.Err)
+	}
+	waitClosed(t, ch)
+	h.Close()
+}
+
+func TestEngineRemove(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	h := openUDP(t, host)
+	e := divert.NewEngine(divert.NewGoSource(), 2, nil)
+	defer closeEngine(t, e)
+
+	ch, err := e.AddChan(h, divert.Receiver{Depth: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth.Inbound(udpPacket(t, 53))
+	recvAll(t, ch, 1)
+
+	if err := e.Remove(h); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Remove(h); err == nil {
+		t.Error("handle removed twice")
+	}
+	// The pending receives are aborted by closing the handle and
+	// retired without a completion.
+	h.Close()
+	for c := range ch {
+		t.Errorf("completion after Remove: %v", c.Err)
+	}
+
+	// The handle can be added again once removed.
+	h = openUDP(t, host)
+	ch, err = e.AddChan(h, divert.Receiver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth.Inbound(udpPacket(t, 53))
+	recvAll(t, ch, 1)
+	h.Close()
+	waitClosed(t, ch)
+}
+
+// TestEngineRemoveDrops checks that receives completing with packets
+// after Remove do not reach Func.
+func TestEngineRemoveDrops(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	h := openUDP(t, host)
+	e := divert.NewEngine(divert.NewGoSource(), 2, nil)
+	defer closeEngine(t, e)
+
+	var delivered atomic.Int64
+	if err := e.Add(h, divert.Receiver{Depth: 2, Func: func(c *divert.Completion) {
+		delivered.Add(1)
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Remove(h); err != nil {
+		t.Fatal(err)
+	}
+
+	// The go source cannot abort the receives, they get the packets.
+	eth.Inbound(udpPacket(t, 53))
+	eth.Inbound(udpPacket(t, 53))
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Outstanding != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := e.Stats().Outstanding; n != 0 {
+		t.Errorf("%d receives outstanding, want 0", n)
+	}
+	if n, st := delivered.Load(), e.Stats(); n != 0 || st.Receives != 0 {
+		t.Errorf("%d completions delivered after Remove, stats %+v", n, st)
+	}
+	h.Close()
+}
+
+var errStart = errors.New("start failed")
+
+// failingSource fails the start of a receive after starting ok receives.
+type failingSource struct {
+	divert.CompletionSource
+	mu sync.Mutex
+	ok int
+}
+
+func (s *failingSource) Start(req *divert.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ok == 0 {
+		return errStart
+	}
+	s.ok--
+	return s.CompletionSource.Start(req)
+}
+
+// TestEngineAddFailure checks that the receives of a handle whose start
+// failed are retired, so Close does not wait for them forever.
+func TestEngineAddFailure(t *testing.T) {
+	host := divertest.NewHost()
+	eth := host.AddInterface()
+	h := openUDP(t, host)
+	src := &failingSource{CompletionSource: divert.NewGoSource(), ok: 2}
+	e := divert.NewEngine(src, 1, nil)
+
+	var delivered atomic.Int64
+	err := e.Add(h, divert.Receiver{Depth: 4, Func: func(c *divert.Completion) {
+		delivered.Add(1)
+	}})
+	if err != errStart {
+		t.Fatalf("Add: %v, want %v", err, errStart)
+	}
+	if n := e.Stats().Outstanding; n != 2 {
+		t.Errorf("%d receives outstanding, want 2", n)
+	}
+
+	// A receive started before the failure still completes, but is
+	// dropped and not started again.
+	eth.Inbound(udpPacket(t, 53))
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Outstanding != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := e.Stats().Outstanding; n != 1 {
+		t.Errorf("%d receives outstanding, want 1", n)
+	}
+	h.Close()
+	closeEngine(t, e)
+	if n := delivered.Load(); n != 0 {
+		t.Errorf("%d completions delivered, want 0", n)
+	}
+}
@@ -0,0 +1,152 @@
+//go:build windows && (amd64 || 386 || arm64)
+
+package divert
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var errNotHandle = errors.New("divert: completion port needs a *Handle")
+
+// CompletionPort is a CompletionSource backed by an I/O completion port,
+// for handles opened with Open or SystemBackend.
+type CompletionPort struct {
+	port windows.Handle
+
+	mu  sync.Mutex
+	ops map[*windows.Overlapped]*portOp
+}
+
+var _ CompletionSource = (*CompletionPort)(nil)
+
+// portOp holds what the driver accesses while a receive is pending. The
+// map of the port keeps it and the buffers of the request alive.
+type portOp struct {
+	overlapped windows.Overlapped
+	addrLen    uint
+	recv       recv
+	h          *Handle
+	req        *Request
+}
+
+// NewCompletionPort creates an I/O completion port.
+func NewCompletionPort() (*CompletionPort, error) {
+	port, err := windows.CreateIoCompletionPort(windows.InvalidHandle, 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &CompletionPort{port: port, ops: map[*windows.Overlapped]*portOp{}}, nil
+}
+
+// Associate associates the handle with the port. A handle can only be
+// associated with one port and stays so until it is closed.
+func (p *CompletionPort) Associate(h PacketHandle) error {
+	hd, ok := h.(*Handle)
+	if !ok {
+		return errNotHandle
+	}
+	if _, err := windows.CreateIoCompletionPort(hd.Handle, p.port, 0, 0); err != nil {
+		return hd.opError("associate", err)
+	}
+	return nil
+}
+
+// Start starts a receive, see RecvEx.
+func (p *CompletionPort) Start(req *Request) error {
+	hd, ok := req.Handle.(*Handle)
+	if !ok {
+		return errNotHandle
+	}
+	if len(req.Address) == 0 {
+		return hd.opError("recv", ErrInvalidParameter)
+	}
+
+	op := &portOp{h: hd, req: req}
+	op.addrLen = uint(len(req.Address)) * uint(unsafe.Sizeof(Address{}))
+	op.recv = recv{
+		Addr:       uint64(uintptr(unsafe.Pointer(unsafe.SliceData(req.Address)))),
+		AddrLenPtr: uint64(uintptr(unsafe.Pointer(&op.addrLen))),
+	}
+
+	p.mu.Lock()
+	p.ops[&op.overlapped] = op
+	p.mu.Unlock()
+
+	// The completion is queued to the port even if the receive completes
+	// at once.
+	err := windows.DeviceIoControl(hd.Handle, uint32(ioCtlRecv), (*byte)(unsafe.Pointer(&op.recv)), uint32(unsafe.Sizeof(ioCtl{})), unsafe.SliceData(req.Buffer), uint32(len(req.Buffer)), nil, &op.overlapped)
+	if err != nil && err != windows.ERROR_IO_PENDING {
+		p.mu.Lock()
+		delete(p.ops, &op.overlapped)
+		p.mu.Unlock()
+		return hd.opError("recv", err)
+	}
+	return nil
+}
+
+// Wait waits for the next completed receive.
+func (p *CompletionPort) Wait() (*Request, error) {
+	for {
+		var (
+			qty        uint32
+			key        uintptr
+			overlapped *windows.Overlapped
+		)
+		err := windows.GetQueuedCompletionStatus(p.port, &qty, &key, &overlapped, windows.INFINITE)
+		if overlapped == nil {
+			// The port was closed.
+			return nil, ErrSourceClosed
+		}
+
+		p.mu.Lock()
+		op, ok := p.ops[overlapped]
+		delete(p.ops, overlapped)
+		p.mu.Unlock()
+		if !ok {
+			// Not a receive started by the port.
+			continue
+		}
+
+		req := op.req
+		req.N = uint(qty)
+		req.Count = 0
+		req.Err = nil
+		// The addresses are only valid with the packets, which a short
+		// buffer still returns.
+		if err == nil || err == windows.ERROR_INSUFFICIENT_BUFFER {
+			req.Count = op.addrLen / uint(unsafe.Sizeof(Address{}))
+		}
+		if err != nil {
+			req.Err = op.h.opError("recv", err)
+		}
+		return req, nil
+	}
+}
+
+// Cancel aborts the pending receives of the handle started by the port.
+func (p *CompletionPort) Cancel(h PacketHandle) error {
+	hd, ok := h.(*Handle)
+	if !ok {
+		return errNotHandle
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for overlapped, op := range p.ops {
+		if op.h == hd {
+			// The receive may have just completed, then there is nothing
+			// to cancel.
+			windows.CancelIoEx(hd.Handle, overlapped)
+		}
+	}
+	return nil
+}
+
+// Close closes the port. Receives still pending are not reported.
+func (p *CompletionPort) Close() error {
+	return windows.CloseHandle(p.port)
+}
@@ -1,12 +1,13 @@
-//go:build windows && (amd64 || 386 || arm64)
-
 package divert
 
 import (
 	"errors"
 	"fmt"
+	"runtime"
+	"strconv"
+	"syscall"
 
-	"golang.org/x/sys/windows"
+	"github.com/imgk/divert-go/filter"
 )
 
 var (
@@ -15,87 +16,197 @@ var (
 	errQueueSize   = fmt.Errorf("Queue size is not correct, Max: %v, Min: %v", QueueSizeMax, QueueSizeMin)
 	errQueueParam  = errors.New("VersionMajor and VersionMinor only can be used in function GetParam")
 	errPriority    = fmt.Errorf("Priority is not Correct, Max: %v, Min: %v", PriorityHighest, PriorityLowest)
+	errPacket      = errors.New("Packet is not a valid IPv4 or IPv6 packet")
+)
+
+// Windows error codes reported by the driver, as in winerror.h, so the
+// errors are also available on other platforms.
+const (
+	errorFileNotFound            syscall.Errno = 2
+	errorAccessDenied            syscall.Errno = 5
+	errorInvalidHandle           syscall.Errno = 6
+	errorInvalidParameter        syscall.Errno = 87
+	errorInsufficientBuffer      syscall.Errno = 122
+	errorNoData                  syscall.Errno = 232
+	errorInvalidImageHash        syscall.Errno = 577
+	errorDriverFailedPriorUnload syscall.Errno = 654
+	errorOperationAborted        syscall.Errno = 995
+	errorIOPending               syscall.Errno = 997
+	errorServiceDoesNotExist     syscall.Errno = 1060
+	errorHostUnreachable         syscall.Errno = 1232
+	errorDriverBlocked           syscall.Errno = 1275
+	eptSNotRegistered            syscall.Errno = 1753
 )
 
 const (
 	// The driver files WinDivert32.sys or WinDivert64.sys were not found
-	ErrFileNotFound = Error(windows.ERROR_FILE_NOT_FOUND)
+	ErrFileNotFound = Error(errorFileNotFound)
 
 	// The calling application does not have Administrator privileges
-	ErrAccessDenied = Error(windows.ERROR_ACCESS_DENIED)
+	ErrAccessDenied = Error(errorAccessDenied)
 
 	// This indicates an invalid packet filter string, layer, priority, or flags
-	ErrInvalidParameter = Error(windows.ERROR_INVALID_PARAMETER)
+	ErrInvalidParameter = Error(errorInvalidParameter)
 
 	// The WinDivert32.sys or WinDivert64.sys driver does not have a valid digital signature (see the driver signing requirements above)
-	ErrInvalidImageHash = Error(windows.ERROR_INVALID_IMAGE_HASH)
+	ErrInvalidImageHash = Error(errorInvalidImageHash)
 
 	// An incompatible version of the WinDivert driver is currently loaded
-	ErrDriverFailedPriorUnload = Error(windows.ERROR_DRIVER_FAILED_PRIOR_UNLOAD)
+	ErrDriverFailedPriorUnload = Error(errorDriverFailedPriorUnload)
 
 	// The handle was opened with the WINDIVERT_FLAG_NO_INSTALL flag and the WinDivert driver is not already installed
-	ErrServiceDoseNotExist = Error(windows.ERROR_SERVICE_DOES_NOT_EXIST)
+	ErrServiceDoseNotExist = Error(errorServiceDoesNotExist)
 
 	// This error occurs for various reasons, including: the WinDivert driver is blocked by security software; or you are using a virtualization environment that does not support drivers
-	ErrDriverBlocked = Error(windows.ERROR_DRIVER_BLOCKED)
+	ErrDriverBlocked = Error(errorDriverBlocked)
 
 	// The captured packet is larger than the pPacket buffer
-	ErrInsufficientBuffer = Error(windows.ERROR_INSUFFICIENT_BUFFER)
+	ErrInsufficientBuffer = Error(errorInsufficientBuffer)
 
 	// The handle has been shutdown using WinDivertShutdown() and the packet queue is empty
-	ErrNoData = Error(windows.ERROR_NO_DATA)
+	ErrNoData = Error(errorNoData)
 
 	// The error code ERROR_IO_PENDING indicates that the overlapped operation has been successfully initiated and that completion will be indicated at a later time
-	ErrIOPending = Error(windows.ERROR_IO_PENDING)
+	ErrIOPending = Error(errorIOPending)
 
 	// This error occurs when an impostor packet (with pAddr->Impostor set to 1) is injected and the ip.TTL or ipv6.HopLimit field goes to zero. This is a defense of "last resort" against infinite loops caused by impostor packets
-	ErrHostUnreachable = Error(windows.ERROR_HOST_UNREACHABLE)
+	ErrHostUnreachable = Error(errorHostUnreachable)
 
 	// This error occurs when the Base Filtering Engine service has been disabled
-	ErrNotRegistered = Error(windows.EPT_S_NOT_REGISTERED)
+	ErrNotRegistered = Error(eptSNotRegistered)
 
 	// The I/O operation has been aborted because of either a thread exit or an application request
-	ErrOperationAborted = Error(windows.ERROR_OPERATION_ABORTED)
+	ErrOperationAborted = Error(errorOperationAborted)
 
 	// The handle is invalid
-	ErrInvalidHandle = Error(windows.ERROR_INVALID_HANDLE)
+	ErrInvalidHandle = Error(errorInvalidHandle)
 )
 
+// FilterError is returned by Open when the filter does not compile, like
+// the errorStr and errorPos WinDivertHelperCompileFilter reports.
+type FilterError struct {
+	// Offset is the byte offset of the error in the filter. Like the C
+	// helper, a few lexical errors point just past the offending
+	// character.
+	Offset int
+	// Token is the offending token, empty at the end of the filter.
+	Token string
+	// Msg is the message of the C helper, e.g. "Filter expression parse
+	// error".
+	Msg string
+
+	err *filter.Error
+}
+
+// Error returns the message followed by the offset and token.
+func (e *FilterError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the *filter.Error the error was made from.
+func (e *FilterError) Unwrap() error {
+	return e.err
+}
+
+// toFilterError converts an error of package filter to a FilterError.
+// Other errors are returned as they are.
+func toFilterError(err error) error {
+	var fe *filter.Error
+	if errors.As(err, &fe) {
+		return &FilterError{Offset: fe.Offset, Token: fe.Token, Msg: fe.Msg, err: fe}
+	}
+	return err
+}
+
+// OpError is the error of an operation on a handle. It carries the
+// operation, the layer and filter of the handle and the error of the
+// driver, usually an Error, which errors.Is and errors.As look at.
+//
+//	if errors.Is(err, divert.ErrNoData) {
+//		// the handle was shut down
+//	}
+type OpError struct {
+	// Op is "open", "recv", "send", "shutdown", "close", "getparam" or
+	// "setparam".
+	Op     string
+	Layer  Layer
+	Filter string
+	Err    error
+}
+
+// Error formats the operation, the handle and the error, e.g.
+// `divert: recv WINDIVERT_LAYER_NETWORK "tcp": The handle is invalid`.
+func (e *OpError) Error() string {
+	return "divert: " + e.Op + " " + e.Layer.String() + " " + strconv.Quote(e.Filter) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// toError converts the error of a system call to an Error. Other errors
+// are returned as they are.
+func toError(err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return Error(errno)
+	}
+	return err
+}
+
+// opError wraps the error of op on a handle of layer opened with filter.
+func opError(op string, layer Layer, filter string, err error) error {
+	return &OpError{Op: op, Layer: layer, Filter: filter, Err: toError(err)}
+}
+
 // Error is ...
-type Error windows.Errno
+type Error syscall.Errno
+
+// Is reports whether target is the same errno, so that errors.Is matches
+// both Error and windows.Errno values.
+func (e Error) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	return ok && errno == syscall.Errno(e)
+}
 
 // Error is ...
 func (e Error) Error() string {
-	switch windows.Errno(e) {
-	case windows.ERROR_FILE_NOT_FOUND:
+	switch syscall.Errno(e) {
+	case errorFileNotFound:
 		return "The driver files WinDivert32.sys or WinDivert64.sys were not found"
-	case windows.ERROR_ACCESS_DENIED:
+	case errorAccessDenied:
 		return "The calling application does not have Administrator privileges"
-	case windows.ERROR_INVALID_PARAMETER:
+	case errorInvalidParameter:
 		return "This indicates an invalid packet filter string, layer, priority, or flags"
-	case windows.ERROR_INVALID_IMAGE_HASH:
+	case errorInvalidImageHash:
 		return "The WinDivert32.sys or WinDivert64.sys driver does not have a valid digital signature (see the driver signing requirements above)"
-	case windows.ERROR_DRIVER_FAILED_PRIOR_UNLOAD:
+	case errorDriverFailedPriorUnload:
 		return "An incompatible version of the WinDivert driver is currently loaded"
-	case windows.ERROR_SERVICE_DOES_NOT_EXIST:
+	case errorServiceDoesNotExist:
 		return "The handle was opened with the WINDIVERT_FLAG_NO_INSTALL flag and the WinDivert driver is not already installed"
-	case windows.ERROR_DRIVER_BLOCKED:
+	case errorDriverBlocked:
 		return "This error occurs for various reasons, including: the WinDivert driver is blocked by security software; or you are using a virtualization environment that does not support drivers"
-	case windows.ERROR_INSUFFICIENT_BUFFER:
+	case errorInsufficientBuffer:
 		return "The captured packet is larger than the pPacket buffer"
-	case windows.ERROR_NO_DATA:
+	case errorNoData:
 		return "The handle has been shutdown using WinDivertShutdown() and the packet queue is empty"
-	case windows.ERROR_IO_PENDING:
+	case errorIOPending:
 		return "The error code ERROR_IO_PENDING indicates that the overlapped operation has been successfully initiated and that completion will be indicated at a later time"
-	case windows.ERROR_HOST_UNREACHABLE:
+	case errorHostUnreachable:
 		return "This error occurs when an impostor packet (with pAddr->Impostor set to 1) is injected and the ip.TTL or ipv6.HopLimit field goes to zero. This is a defense of \"last resort\" against infinite loops caused by impostor packets"
-	case windows.EPT_S_NOT_REGISTERED:
+	case eptSNotRegistered:
 		return "This error occurs when the Base Filtering Engine service has been disabled"
-	case windows.ERROR_OPERATION_ABORTED:
+	case errorOperationAborted:
 		return "The I/O operation has been aborted because of either a thread exit or an application request"
-	case windows.ERROR_INVALID_HANDLE:
+	case errorInvalidHandle:
 		return "The handle is invalid"
 	default:
-		return windows.Errno(e).Error()
+		if runtime.GOOS == "windows" {
+			return syscall.Errno(e).Error()
+		}
+		// Elsewhere syscall.Errno would format the code as an errno of
+		// the host.
+		return "winerror " + strconv.Itoa(int(e))
 	}
 }
@@ -0,0 +1,42 @@
+package divert
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/imgk/divert-go/filter"
+)
+
+func TestFilterError(t *testing.T) {
+	_, err := CompileFilter("tcp.DstPort == ", LayerNetwork)
+	var fe *FilterError
+	if !errors.As(err, &fe) {
+		t.Fatalf("CompileFilter error = %v, want *FilterError", err)
+	}
+	if fe.Offset != 15 || fe.Token != "" || fe.Msg != "Filter expression parse error" {
+		t.Errorf("FilterError = %+v", fe)
+	}
+	var ferr *filter.Error
+	if !errors.As(err, &ferr) {
+		t.Errorf("FilterError does not unwrap to *filter.Error")
+	}
+	if err := checkFilter("tcp.DstPort == 80", LayerNetwork); err != nil {
+		t.Errorf("checkFilter: %v", err)
+	}
+}
+
+func TestErrorString(t *testing.T) {
+	if s := Error(errorInvalidHandle).Error(); s != "The handle is invalid" {
+		t.Errorf("Error(6) = %q", s)
+	}
+	// 1 is ERROR_INVALID_FUNCTION on Windows and EPERM on Linux.
+	want := "winerror 1"
+	if runtime.GOOS == "windows" {
+		want = syscall.Errno(1).Error()
+	}
+	if s := Error(1).Error(); s != want {
+		t.Errorf("Error(1) = %q, want %q", s, want)
+	}
+}
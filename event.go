@@ -0,0 +1,146 @@
+package divert
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// EventData is the content of an address of the flow, socket or reflect
+// layer, one of FlowEstablished, FlowDeleted, SocketBind, SocketConnect,
+// SocketListen, SocketAccept, SocketClose, ReflectOpen and ReflectClose.
+// Use DecodeEvent to get it and a type switch to tell the events apart.
+type EventData interface {
+	Event() Event
+}
+
+// Endpoint is the data of flow and socket events.
+type Endpoint struct {
+	// Timestamp is the performance counter value of the event, see
+	// Clock.Time.
+	Timestamp        int64
+	Outbound         bool
+	Loopback         bool
+	EndpointID       uint64
+	ParentEndpointID uint64
+	ProcessID        uint32
+	// Local and Remote hold IPv4 addresses unmapped.
+	Local    netip.AddrPort
+	Remote   netip.AddrPort
+	Protocol uint8
+}
+
+// FlowEstablished is a WINDIVERT_EVENT_FLOW_ESTABLISHED event.
+type FlowEstablished struct{ Endpoint }
+
+// FlowDeleted is a WINDIVERT_EVENT_FLOW_DELETED event.
+type FlowDeleted struct{ Endpoint }
+
+// SocketBind is a WINDIVERT_EVENT_SOCKET_BIND event.
+type SocketBind struct{ Endpoint }
+
+// SocketConnect is a WINDIVERT_EVENT_SOCKET_CONNECT event.
+type SocketConnect struct{ Endpoint }
+
+// SocketListen is a WINDIVERT_EVENT_SOCKET_LISTEN event.
+type SocketListen struct{ Endpoint }
+
+// SocketAccept is a WINDIVERT_EVENT_SOCKET_ACCEPT event.
+type SocketAccept struct{ Endpoint }
+
+// SocketClose is a WINDIVERT_EVENT_SOCKET_CLOSE event.
+type SocketClose struct{ Endpoint }
+
+// HandleInfo is the data of reflect events, describing a WinDivert handle
+// of another process.
+type HandleInfo struct {
+	// Timestamp is the performance counter value of the event and Opened
+	// that of the time the handle was opened, see Clock.Time.
+	Timestamp int64
+	Opened    int64
+	ProcessID uint32
+	Layer     Layer
+	Flags     uint64
+	Priority  int16
+}
+
+// ReflectOpen is a WINDIVERT_EVENT_REFLECT_OPEN event.
+type ReflectOpen struct{ HandleInfo }
+
+// ReflectClose is a WINDIVERT_EVENT_REFLECT_CLOSE event.
+type ReflectClose struct{ HandleInfo }
+
+func (FlowEstablished) Event() Event { return EventFlowEstablished }
+func (FlowDeleted) Event() Event     { return EventFlowDeleted }
+func (SocketBind) Event() Event      { return EventSocketBind }
+func (SocketConnect) Event() Event   { return EventSocketConnect }
+func (SocketListen) Event() Event    { return EventSocketListen }
+func (SocketAccept) Event() Event    { return EventSocketAccept }
+func (SocketClose) Event() Event     { return EventSocketClose }
+func (ReflectOpen) Event() Event     { return EventReflectOpen }
+func (ReflectClose) Event() Event    { return EventReflectClose }
+
+// DecodeEvent returns the typed content of an address received from a
+// handle of the flow, socket or reflect layer. It fails for the network
+// layers and if the event does not belong to the layer.
+func DecodeEvent(a *Address) (EventData, error) {
+	switch a.Layer() {
+	case LayerFlow:
+		e := a.endpoint()
+		switch a.Event() {
+		case EventFlowEstablished:
+			return FlowEstablished{e}, nil
+		case EventFlowDeleted:
+			return FlowDeleted{e}, nil
+		}
+	case LayerSocket:
+		e := a.endpoint()
+		switch a.Event() {
+		case EventSocketBind:
+			return SocketBind{e}, nil
+		case EventSocketConnect:
+			return SocketConnect{e}, nil
+		case EventSocketListen:
+			return SocketListen{e}, nil
+		case EventSocketAccept:
+			return SocketAccept{e}, nil
+		case EventSocketClose:
+			return SocketClose{e}, nil
+		}
+	case LayerReflect:
+		rf := a.Reflect()
+		h := HandleInfo{
+			Timestamp: a.Timestamp,
+			Opened:    rf.TimeStamp,
+			ProcessID: rf.ProcessID,
+			Layer:     rf.Layer(),
+			Flags:     rf.Flags,
+			Priority:  rf.Priority,
+		}
+		switch a.Event() {
+		case EventReflectOpen:
+			return ReflectOpen{h}, nil
+		case EventReflectClose:
+			return ReflectClose{h}, nil
+		}
+	default:
+		return nil, fmt.Errorf("no event data at layer %d", a.Layer())
+	}
+	return nil, fmt.Errorf("event %d does not belong to layer %v", a.Event(), a.Layer())
+}
+
+// endpoint returns the content of a flow or socket address, which share
+// the same layout.
+func (a *Address) endpoint() Endpoint {
+	sk := a.Socket()
+	return Endpoint{
+		Timestamp:        a.Timestamp,
+		Outbound:         a.Outbound(),
+		Loopback:         a.Loopback(),
+		EndpointID:       sk.EndpointID,
+		ParentEndpointID: sk.ParentEndpointID,
+		ProcessID:        sk.ProcessID,
+		Local:            sk.LocalAddrPort(),
+		Remote:           sk.RemoteAddrPort(),
+		Protocol:         sk.Protocol,
+	}
+}
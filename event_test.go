@@ -0,0 +1,89 @@
+package divert
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDecodeEvent(t *testing.T) {
+	var sock Address
+	sock.Timestamp = 100
+	sock.SetOutbound(true)
+	sk := sock.Socket()
+	sk.EndpointID, sk.ParentEndpointID, sk.ProcessID, sk.Protocol = 1, 2, 1234, 6
+	sk.SetLocalAddrPort(netip.MustParseAddrPort("10.0.0.1:40000"))
+	sk.SetRemoteAddrPort(netip.MustParseAddrPort("[2001:db8::2]:443"))
+	endpoint := Endpoint{
+		Timestamp:        100,
+		Outbound:         true,
+		EndpointID:       1,
+		ParentEndpointID: 2,
+		ProcessID:        1234,
+		Local:            netip.MustParseAddrPort("10.0.0.1:40000"),
+		Remote:           netip.MustParseAddrPort("[2001:db8::2]:443"),
+		Protocol:         6,
+	}
+
+	var refl Address
+	refl.Timestamp = 200
+	rf := refl.Reflect()
+	rf.TimeStamp, rf.ProcessID, rf.Flags, rf.Priority = 50, 4321, FlagSniff|FlagRecvOnly, -3
+	rf.SetLayer(LayerSocket)
+	handle := HandleInfo{
+		Timestamp: 200,
+		Opened:    50,
+		ProcessID: 4321,
+		Layer:     LayerSocket,
+		Flags:     FlagSniff | FlagRecvOnly,
+		Priority:  -3,
+	}
+
+	for _, tt := range []struct {
+		addr  Address
+		layer Layer
+		event Event
+		want  EventData
+	}{
+		{sock, LayerFlow, EventFlowEstablished, FlowEstablished{endpoint}},
+		{sock, LayerFlow, EventFlowDeleted, FlowDeleted{endpoint}},
+		{sock, LayerSocket, EventSocketBind, SocketBind{endpoint}},
+		{sock, LayerSocket, EventSocketConnect, SocketConnect{endpoint}},
+		{sock, LayerSocket, EventSocketListen, SocketListen{endpoint}},
+		{sock, LayerSocket, EventSocketAccept, SocketAccept{endpoint}},
+		{sock, LayerSocket, EventSocketClose, SocketClose{endpoint}},
+		{refl, LayerReflect, EventReflectOpen, ReflectOpen{handle}},
+		{refl, LayerReflect, EventReflectClose, ReflectClose{handle}},
+	} {
+		a := tt.addr
+		a.SetLayer(tt.layer)
+		a.SetEvent(tt.event)
+		e, err := DecodeEvent(&a)
+		if err != nil {
+			t.Errorf("DecodeEvent(%v, %v): %v", tt.layer, tt.event, err)
+			continue
+		}
+		if e != tt.want || e.Event() != tt.event {
+			t.Errorf("DecodeEvent(%v, %v) = %#v, want %#v", tt.layer, tt.event, e, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		layer Layer
+		event Event
+	}{
+		{LayerNetwork, EventNetworkPacket},
+		{LayerNetworkForward, EventNetworkPacket},
+		{LayerFlow, EventSocketConnect},
+		{LayerFlow, EventNetworkPacket},
+		{LayerSocket, EventFlowEstablished},
+		{LayerSocket, EventReflectClose},
+		{LayerReflect, EventSocketClose},
+	} {
+		a := sock
+		a.SetLayer(tt.layer)
+		a.SetEvent(tt.event)
+		if e, err := DecodeEvent(&a); err == nil || e != nil {
+			t.Errorf("DecodeEvent(%v, %v) = %#v, %v, want error", tt.layer, tt.event, e, err)
+		}
+	}
+}
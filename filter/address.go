@@ -0,0 +1,95 @@
+package filter
+
+import (
+	"errors"
+	"math/bits"
+	"net/netip"
+)
+
+var (
+	errIPv4Address = errors.New("invalid IPv4 address")
+	errIPv6Address = errors.New("invalid IPv6 address")
+)
+
+// The functions below work on addresses in the representation of the
+// WinDivert helpers and of Address.LocalAddr: an IPv4 address is a uint32
+// in host byte order, an IPv6 address four such words, least significant
+// first, with IPv4 addresses mapped into IPv6 as ::ffff:a.b.c.d.
+
+// ParseIPv4Address parses a dotted IPv4 address like
+// WinDivertHelperParseIPv4Address.
+func ParseIPv4Address(s string) (uint32, error) {
+	addr, ok := parseIPv4(s)
+	if !ok {
+		return 0, errIPv4Address
+	}
+	return addr, nil
+}
+
+// ParseIPv6Address parses an IPv6 address like
+// WinDivertHelperParseIPv6Address. An IPv4 tail is only accepted after
+// ::ffff: or ::.
+func ParseIPv6Address(s string) ([4]uint32, error) {
+	addr, ok := parseIPv6(s)
+	if !ok {
+		return [4]uint32{}, errIPv6Address
+	}
+	return addr, nil
+}
+
+// FormatIPv4Address formats an IPv4 address like
+// WinDivertHelperFormatIPv4Address.
+func FormatIPv4Address(addr uint32) string {
+	return string(appendIPv4(make([]byte, 0, 15), addr))
+}
+
+// FormatIPv6Address formats an IPv6 address like
+// WinDivertHelperFormatIPv6Address. Unlike netip, IPv4-mapped addresses
+// are written in dotted form without the ::ffff: prefix.
+func FormatIPv6Address(addr [4]uint32) string {
+	return string(appendIPv6(make([]byte, 0, 39), addr))
+}
+
+// HtonIPv6Address converts an IPv6 address to network byte order like
+// WinDivertHelperHtonIPv6Address. Stored in memory on a little endian
+// machine, the result holds the bytes of the address in order.
+func HtonIPv6Address(addr [4]uint32) [4]uint32 {
+	return [4]uint32{
+		bits.ReverseBytes32(addr[3]),
+		bits.ReverseBytes32(addr[2]),
+		bits.ReverseBytes32(addr[1]),
+		bits.ReverseBytes32(addr[0]),
+	}
+}
+
+// NtohIPv6Address is the inverse of HtonIPv6Address, like
+// WinDivertHelperNtohIPv6Address.
+func NtohIPv6Address(addr [4]uint32) [4]uint32 {
+	return HtonIPv6Address(addr)
+}
+
+// AddrFrom128 converts an IPv6 address to a netip.Addr. IPv4-mapped
+// addresses are returned as IPv4 addresses.
+func AddrFrom128(addr [4]uint32) netip.Addr {
+	var b [16]byte
+	for i, w := range addr {
+		j := 12 - 4*i
+		b[j], b[j+1], b[j+2], b[j+3] = byte(w>>24), byte(w>>16), byte(w>>8), byte(w)
+	}
+	return netip.AddrFrom16(b).Unmap()
+}
+
+// AddrTo128 is the inverse of AddrFrom128, IPv4 addresses are mapped into
+// IPv6. The zero Addr gives the unspecified address.
+func AddrTo128(addr netip.Addr) [4]uint32 {
+	if !addr.IsValid() {
+		return [4]uint32{}
+	}
+	b := addr.As16()
+	var a [4]uint32
+	for i := range a {
+		j := 12 - 4*i
+		a[i] = uint32(b[j])<<24 | uint32(b[j+1])<<16 | uint32(b[j+2])<<8 | uint32(b[j+3])
+	}
+	return a
+}
@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// The results below were produced by the WinDivertHelperParseIPv4Address,
+// WinDivertHelperParseIPv6Address, WinDivertHelperFormatIPv6Address and
+// WinDivertHelperHtonIPv6Address of divert/windivert_helper.c on a little
+// endian machine.
+
+var ipv4AddressTests = []struct {
+	s    string
+	addr uint32
+	ok   bool
+}{
+	{"10.0.0.1", 0x0a000001, true},
+	{"255.255.255.255", 0xffffffff, true},
+	{"0.0.0.0", 0, true},
+	{"1.2.3", 0, false},
+	{"256.0.0.1", 0, false},
+	{"1.2.3.4.5", 0, false},
+	{" 1.2.3.4", 0, false},
+}
+
+func TestIPv4Address(t *testing.T) {
+	for _, tt := range ipv4AddressTests {
+		addr, err := ParseIPv4Address(tt.s)
+		if addr != tt.addr || (err == nil) != tt.ok {
+			t.Errorf("ParseIPv4Address(%q) = %#x, %v, want %#x", tt.s, addr, err, tt.addr)
+		}
+		if tt.ok {
+			if s := FormatIPv4Address(addr); s != tt.s {
+				t.Errorf("FormatIPv4Address(%#x) = %q, want %q", addr, s, tt.s)
+			}
+		}
+	}
+}
+
+var ipv6AddressTests = []struct {
+	s         string
+	addr      [4]uint32
+	formatted string
+	// network is the address in network byte order as stored in memory.
+	network string
+}{
+	{"::", [4]uint32{}, "::", "::"},
+	{"::1", [4]uint32{1}, "::1", "::1"},
+	{"2001:db8::1234:5678", [4]uint32{0x12345678, 0, 0, 0x20010db8}, "2001:db8::1234:5678", "2001:db8::1234:5678"},
+	{"fe80::1:2:3:4", [4]uint32{0x30004, 0x10002, 0, 0xfe800000}, "fe80::1:2:3:4", "fe80::1:2:3:4"},
+	{"1:2:3:4:5:6:7:8", [4]uint32{0x70008, 0x50006, 0x30004, 0x10002}, "1:2:3:4:5:6:7:8", "1:2:3:4:5:6:7:8"},
+	{"2001:db8::", [4]uint32{0, 0, 0, 0x20010db8}, "2001:db8::", "2001:db8::"},
+	// IPv4-mapped addresses are formatted without the prefix.
+	{"::ffff:10.0.0.1", [4]uint32{0x0a000001, 0xffff}, "10.0.0.1", "::ffff:10.0.0.1"},
+	{"::10.0.0.1", [4]uint32{0x0a000001}, "::a00:1", "::a00:1"},
+}
+
+func TestIPv6Address(t *testing.T) {
+	for _, tt := range ipv6AddressTests {
+		addr, err := ParseIPv6Address(tt.s)
+		if err != nil || addr != tt.addr {
+			t.Errorf("ParseIPv6Address(%q) = %#x, %v, want %#x", tt.s, addr, err, tt.addr)
+			continue
+		}
+		if s := FormatIPv6Address(addr); s != tt.formatted {
+			t.Errorf("FormatIPv6Address(%#x) = %q, want %q", addr, s, tt.formatted)
+		}
+
+		n := HtonIPv6Address(addr)
+		var b [16]byte
+		for i, w := range n {
+			binary.LittleEndian.PutUint32(b[4*i:], w)
+		}
+		if a := netip.AddrFrom16(b); a != netip.MustParseAddr(tt.network) {
+			t.Errorf("HtonIPv6Address(%#x) stores %v, want %v", addr, a, tt.network)
+		}
+		if h := NtohIPv6Address(n); h != addr {
+			t.Errorf("NtohIPv6Address(%#x) = %#x, want %#x", n, h, addr)
+		}
+
+		// AddrFrom128 unmaps IPv4 addresses, AddrTo128 maps them again.
+		want := netip.MustParseAddr(tt.network).Unmap()
+		if a := AddrFrom128(addr); a != want {
+			t.Errorf("AddrFrom128(%#x) = %v, want %v", addr, a, want)
+		}
+		if a := AddrTo128(want); a != addr {
+			t.Errorf("AddrTo128(%v) = %#x, want %#x", want, a, addr)
+		}
+	}
+
+	for _, s := range []string{"1::2::3", "::ffff:1.2.3", "1:2:3:4:5:6:1.2.3.4", ""} {
+		if addr, err := ParseIPv6Address(s); err == nil {
+			t.Errorf("ParseIPv6Address(%q) = %#x, want error", s, addr)
+		}
+	}
+	if a := AddrTo128(netip.Addr{}); a != ([4]uint32{}) {
+		t.Errorf("AddrTo128 of the zero Addr = %#x", a)
+	}
+}
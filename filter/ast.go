@@ -0,0 +1,263 @@
+package filter
+
+// Op is a comparison or logical operator.
+//
+// The comparison operators have the values of the WINDIVERT_FILTER_TEST_*
+// constants.
+type Op int
+
+const (
+	OpEq  Op = 0
+	OpNeq Op = 1
+	OpLt  Op = 2
+	OpLeq Op = 3
+	OpGt  Op = 4
+	OpGeq Op = 5
+	OpAnd Op = 6
+	OpOr  Op = 7
+)
+
+// String returns the operator as written by the formatter.
+func (op Op) String() string {
+	switch op {
+	case OpEq:
+		return "="
+	case OpNeq:
+		return "!="
+	case OpLt:
+		return "<"
+	case OpLeq:
+		return "<="
+	case OpGt:
+		return ">"
+	case OpGeq:
+		return ">="
+	case OpAnd:
+		return "and"
+	case OpOr:
+		return "or"
+	default:
+		return ""
+	}
+}
+
+// negate returns the comparison matching exactly when op does not.
+func (op Op) negate() Op {
+	switch op {
+	case OpEq:
+		return OpNeq
+	case OpNeq:
+		return OpEq
+	case OpLt:
+		return OpGeq
+	case OpLeq:
+		return OpGt
+	case OpGt:
+		return OpLeq
+	case OpGeq:
+		return OpLt
+	default:
+		return op
+	}
+}
+
+// Expr is a node of a filter expression: a *BinaryExpr, *CondExpr or *Test.
+type Expr interface {
+	// Pos is the byte offset of the expression in the filter string.
+	Pos() int
+	expr()
+}
+
+// BinaryExpr is X and Y or X or Y.
+type BinaryExpr struct {
+	Op Op
+	X  Expr
+	Y  Expr
+}
+
+// CondExpr is (Cond ? Then : Else).
+type CondExpr struct {
+	Lparen int
+	Cond   Expr
+	Then   Expr
+	Else   Expr
+}
+
+// Test compares a field with a constant, e.g. tcp.DstPort = 443.
+//
+// A bare field such as tcp is a test against zero, tcp != 0, and a leading
+// not is folded into the operator, so not tcp is tcp = 0.
+type Test struct {
+	TestPos int
+	Field   Field
+	// Index is the byte offset of array fields such as packet[10b],
+	// negative offsets count from the end.
+	Index int
+	Op    Op
+	Value Value
+}
+
+// Value is a 128 bit constant in host byte order, least significant word
+// first. IPv4 addresses are stored as IPv4-mapped IPv6 addresses.
+type Value struct {
+	Neg bool
+	Val [4]uint32
+}
+
+func (e *BinaryExpr) Pos() int { return e.X.Pos() }
+func (e *CondExpr) Pos() int   { return e.Lparen }
+func (e *Test) Pos() int       { return e.TestPos }
+
+func (*BinaryExpr) expr() {}
+func (*CondExpr) expr()   {}
+func (*Test) expr()       {}
+
+// Filter is a parsed filter.
+type Filter struct {
+	Layer Layer
+	Expr  Expr
+}
+
+// String formats the filter the same way WinDivertHelperFormatFilter
+// does, e.g. "tcp.DstPort = 443 and not loopback".
+func (f *Filter) String() string {
+	p := printer{layer: f.Layer}
+	p.expr(f.Expr, true, false)
+	return string(p.buf)
+}
+
+type printer struct {
+	layer Layer
+	buf   []byte
+}
+
+func (p *printer) expr(e Expr, top, and bool) {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		and1 := e.Op == OpAnd
+		paren := !top && and != and1
+		if paren {
+			p.buf = append(p.buf, '(')
+		}
+		p.expr(e.X, false, and1)
+		p.buf = append(p.buf, ' ')
+		p.buf = append(p.buf, e.Op.String()...)
+		p.buf = append(p.buf, ' ')
+		p.expr(e.Y, false, and1)
+		if paren {
+			p.buf = append(p.buf, ')')
+		}
+	case *CondExpr:
+		p.buf = append(p.buf, '(')
+		p.expr(e.Cond, true, false)
+		p.buf = append(p.buf, "? "...)
+		p.expr(e.Then, true, false)
+		p.buf = append(p.buf, ": "...)
+		p.expr(e.Else, true, false)
+		p.buf = append(p.buf, ')')
+	case *Test:
+		p.test(e)
+	}
+}
+
+func (p *printer) field(t *Test) {
+	p.buf = append(p.buf, t.Field.String()...)
+	if t.Field.IsArray() {
+		p.buf = append(p.buf, '[')
+		idx := t.Index
+		if idx < 0 {
+			p.buf = append(p.buf, '-')
+			idx = -idx
+		}
+		p.buf = appendDec32(p.buf, uint32(idx))
+		p.buf = append(p.buf, "b]"...)
+	}
+}
+
+func (p *printer) test(t *Test) {
+	f := format(formatDec)
+	if t.Field >= 0 && int(t.Field) < len(fields) {
+		f = fields[t.Field].format
+	}
+	v := t.Value.Val
+
+	if f == formatBool && v[1] == 0 && v[2] == 0 && v[3] == 0 && v[0] <= 1 {
+		switch t.Op {
+		case OpEq, OpNeq:
+			if (t.Op == OpEq) == (v[0] == 0) {
+				p.buf = append(p.buf, "not "...)
+			}
+			p.field(t)
+			return
+		}
+	}
+
+	p.field(t)
+	p.buf = append(p.buf, ' ')
+	p.buf = append(p.buf, t.Op.String()...)
+	p.buf = append(p.buf, ' ')
+	if t.Value.Neg {
+		p.buf = append(p.buf, '-')
+	}
+	switch f {
+	case formatIPv4:
+		p.buf = appendIPv4(p.buf, v[0])
+	case formatIPv6:
+		p.buf = appendIPv6(p.buf, v)
+	case formatLayer:
+		if name := Layer(v[0]).String(); name != "" && v[0] <= uint32(LayerReflect) {
+			p.buf = append(p.buf, name...)
+		} else {
+			p.buf = appendDec32(p.buf, v[0])
+		}
+	case formatEvent:
+		if name := eventName(p.layer, v[0]); name != "" {
+			p.buf = append(p.buf, name...)
+		} else {
+			p.buf = appendDec32(p.buf, v[0])
+		}
+	case formatHex:
+		p.buf = append(p.buf, "0x"...)
+		p.buf = appendHex128(p.buf, v)
+	default:
+		p.buf = appendDec128(p.buf, v)
+	}
+}
+
+// eventName returns the macro naming event e at layer l.
+func eventName(l Layer, e uint32) string {
+	switch l {
+	case LayerNetwork, LayerNetworkForward:
+		if e == eventNetworkPacket {
+			return "PACKET"
+		}
+	case LayerFlow:
+		switch e {
+		case eventFlowEstablished:
+			return "ESTABLISHED"
+		case eventFlowDeleted:
+			return "DELETED"
+		}
+	case LayerSocket:
+		switch e {
+		case eventSocketBind:
+			return "BIND"
+		case eventSocketConnect:
+			return "CONNECT"
+		case eventSocketListen:
+			return "LISTEN"
+		case eventSocketAccept:
+			return "ACCEPT"
+		case eventSocketClose:
+			return "CLOSE"
+		}
+	case LayerReflect:
+		switch e {
+		case eventReflectOpen:
+			return "OPEN"
+		case eventReflectClose:
+			return "CLOSE"
+		}
+	}
+	return ""
+}
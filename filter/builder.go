@@ -0,0 +1,461 @@
+package filter
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// errEmptyCond is reported for a zero Cond.
+var errEmptyCond = errors.New("empty filter condition")
+
+// Cond is a filter condition built with the functions of this package,
+// for example
+//
+//	filter.TCP().DstPort().Eq(443).And(filter.Outbound())
+//
+// Mistakes such as an IPv6 address for an IPv4 field are kept in the Cond
+// and reported by Build.
+type Cond struct {
+	expr Expr
+	err  error
+}
+
+// Condition is a Cond, or a header such as TCP() that matches the packets
+// of its protocol.
+type Condition interface {
+	cond() Cond
+}
+
+func (c Cond) cond() Cond {
+	return c
+}
+
+func cond(e Expr) Cond {
+	return Cond{expr: e}
+}
+
+func (c Cond) check() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.expr == nil {
+		return errEmptyCond
+	}
+	return nil
+}
+
+func join(op Op, c Cond, cs []Condition) Cond {
+	if err := c.check(); err != nil {
+		return Cond{err: err}
+	}
+	expr := c.expr
+	for _, dc := range cs {
+		d := dc.cond()
+		if err := d.check(); err != nil {
+			return Cond{err: err}
+		}
+		expr = &BinaryExpr{Op: op, X: expr, Y: d.expr}
+	}
+	return cond(expr)
+}
+
+// And matches if c and all of cs match.
+func (c Cond) And(cs ...Condition) Cond {
+	return join(OpAnd, c, cs)
+}
+
+// Or matches if c or any of cs match.
+func (c Cond) Or(cs ...Condition) Cond {
+	return join(OpOr, c, cs)
+}
+
+// Not matches if c does not. A test on a field of a header is false for
+// packets without the header whatever its operator, so the negation of
+// TCP().DstPort().Eq(443) is rendered as "not tcp or tcp.DstPort != 443".
+// Tests of array fields, which are also false if the index is out of
+// bounds, are negated as "(tcp.Payload[0b] = 0x16? false: true)".
+func (c Cond) Not() Cond {
+	if err := c.check(); err != nil {
+		return Cond{err: err}
+	}
+	return cond(not(c.expr))
+}
+
+// not negates an expression, pushing the negation down to the tests since
+// the filter language only allows not in front of a test.
+func not(e Expr) Expr {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		op := OpAnd
+		if e.Op == OpAnd {
+			op = OpOr
+		}
+		return &BinaryExpr{Op: op, X: not(e.X), Y: not(e.Y)}
+	case *CondExpr:
+		return &CondExpr{Cond: e.Cond, Then: not(e.Then), Else: not(e.Else)}
+	case *Test:
+		if e.Field.IsArray() {
+			return &CondExpr{Cond: e, Then: False().expr, Else: True().expr}
+		}
+		switch e.Field {
+		case FieldTrue:
+			return False().expr
+		case FieldFalse:
+			return True().expr
+		}
+		t := *e
+		t.Op = t.Op.negate()
+		if h := e.Field.header(); h != FieldZero {
+			return &BinaryExpr{Op: OpOr, X: &Test{Field: h, Op: OpEq}, Y: &t}
+		}
+		return &t
+	default:
+		return e
+	}
+}
+
+// If matches then if c matches, and otherwise else.
+func If(c, then, els Condition) Cond {
+	cs := [...]Cond{c.cond(), then.cond(), els.cond()}
+	for _, d := range cs {
+		if err := d.check(); err != nil {
+			return Cond{err: err}
+		}
+	}
+	return cond(&CondExpr{Cond: cs[0].expr, Then: cs[1].expr, Else: cs[2].expr})
+}
+
+// Filter returns the parsed form of the condition for layer.
+func (c Cond) Filter(layer Layer) (*Filter, error) {
+	s, err := c.Build(layer)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(s, layer)
+}
+
+// Build renders the condition as a filter string for layer. Fields the
+// layer does not support are reported as an *Error, like Open would.
+func (c Cond) Build(layer Layer) (string, error) {
+	if err := c.check(); err != nil {
+		return "", err
+	}
+	f := Filter{Layer: layer, Expr: c.expr}
+	s := f.String()
+	if err := Validate(s, layer); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// String renders the condition without checking it against a layer.
+// Events are written as numbers since their names depend on the layer.
+func (c Cond) String() string {
+	if c.check() != nil {
+		return ""
+	}
+	f := Filter{Layer: -1, Expr: c.expr}
+	return f.String()
+}
+
+func test(f Field, index int, op Op, v Value) Cond {
+	return cond(&Test{Field: f, Index: index, Op: op, Value: v})
+}
+
+func boolField(f Field) Cond {
+	return test(f, 0, OpNeq, Value{})
+}
+
+// True matches everything.
+func True() Cond { return boolField(FieldTrue) }
+
+// False matches nothing.
+func False() Cond { return boolField(FieldFalse) }
+
+// Inbound matches inbound packets.
+func Inbound() Cond { return boolField(FieldInbound) }
+
+// Outbound matches outbound packets.
+func Outbound() Cond { return boolField(FieldOutbound) }
+
+// Loopback matches loopback packets.
+func Loopback() Cond { return boolField(FieldLoopback) }
+
+// Impostor matches impostor packets.
+func Impostor() Cond { return boolField(FieldImpostor) }
+
+// Fragment matches IP fragments.
+func Fragment() Cond { return boolField(FieldFragment) }
+
+// NumField is a numeric field to be compared with a constant. Like in
+// WinDivert, a test on a field of a header does not match packets without
+// the header, e.g. TCP().DstPort().Neq(80) does not match UDP packets.
+type NumField struct {
+	field Field
+	index int
+}
+
+func (n NumField) test(op Op, v int64) Cond {
+	val := Value{Neg: v < 0}
+	u := uint64(v)
+	if val.Neg {
+		u = -u
+	}
+	val.Val[0], val.Val[1] = uint32(u), uint32(u>>32)
+	return test(n.field, n.index, op, val)
+}
+
+// Eq matches if the field equals v.
+func (n NumField) Eq(v int64) Cond { return n.test(OpEq, v) }
+
+// Neq matches if the field does not equal v.
+func (n NumField) Neq(v int64) Cond { return n.test(OpNeq, v) }
+
+// Lt matches if the field is less than v.
+func (n NumField) Lt(v int64) Cond { return n.test(OpLt, v) }
+
+// Leq matches if the field is less than or equal to v.
+func (n NumField) Leq(v int64) Cond { return n.test(OpLeq, v) }
+
+// Gt matches if the field is greater than v.
+func (n NumField) Gt(v int64) Cond { return n.test(OpGt, v) }
+
+// Geq matches if the field is greater than or equal to v.
+func (n NumField) Geq(v int64) Cond { return n.test(OpGeq, v) }
+
+// Range matches if the field is between lo and hi inclusive.
+func (n NumField) Range(lo, hi int64) Cond {
+	return n.Geq(lo).And(n.Leq(hi))
+}
+
+// In matches if the field equals any of vs.
+func (n NumField) In(vs ...int64) Cond {
+	if len(vs) == 0 {
+		return False()
+	}
+	c := n.Eq(vs[0])
+	for _, v := range vs[1:] {
+		c = c.Or(n.Eq(v))
+	}
+	return c
+}
+
+// AddrField is an IPv4 or IPv6 address field.
+type AddrField struct {
+	field Field
+}
+
+// addrValue converts a to the 128 bit value of the filter language, with
+// IPv4 addresses mapped into IPv6.
+func addrValue(a netip.Addr) Value {
+	return Value{Val: AddrTo128(a)}
+}
+
+func (a AddrField) test(op Op, addr netip.Addr) Cond {
+	if !addr.IsValid() {
+		return Cond{err: errors.New("invalid address for " + a.field.String())}
+	}
+	if fields[a.field].format == formatIPv4 && !addr.Unmap().Is4() {
+		return Cond{err: errors.New("IPv6 address " + addr.String() + " for " + a.field.String())}
+	}
+	return test(a.field, 0, op, addrValue(addr.WithZone("")))
+}
+
+// Eq matches if the field equals addr.
+func (a AddrField) Eq(addr netip.Addr) Cond { return a.test(OpEq, addr) }
+
+// Neq matches if the field does not equal addr.
+func (a AddrField) Neq(addr netip.Addr) Cond { return a.test(OpNeq, addr) }
+
+// In matches if the field is within prefix.
+func (a AddrField) In(prefix netip.Prefix) Cond {
+	if !prefix.IsValid() {
+		return Cond{err: errors.New("invalid prefix for " + a.field.String())}
+	}
+	prefix = prefix.Masked()
+	lo := prefix.Addr()
+	bits := prefix.Bits()
+	if lo.Is4() {
+		bits += 96
+	}
+	if bits == 128 {
+		return a.Eq(lo)
+	}
+	b := lo.As16()
+	for i := bits; i < 128; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	hi := netip.AddrFrom16(b)
+	if lo.Is4() {
+		hi = hi.Unmap()
+	}
+	return a.test(OpGeq, lo).And(a.test(OpLeq, hi))
+}
+
+// IPHeader builds tests on the IPv4 header. As a Cond it matches IPv4
+// packets.
+type IPHeader struct{ Cond }
+
+// IP matches IPv4 packets and gives access to the IPv4 header fields.
+func IP() IPHeader { return IPHeader{boolField(FieldIP)} }
+
+func (IPHeader) HdrLength() NumField { return NumField{field: FieldIPHdrLength} }
+func (IPHeader) TOS() NumField       { return NumField{field: FieldIPTOS} }
+func (IPHeader) Length() NumField    { return NumField{field: FieldIPLength} }
+func (IPHeader) ID() NumField        { return NumField{field: FieldIPId} }
+func (IPHeader) DF() Cond            { return boolField(FieldIPDF) }
+func (IPHeader) MF() Cond            { return boolField(FieldIPMF) }
+func (IPHeader) FragOff() NumField   { return NumField{field: FieldIPFragOff} }
+func (IPHeader) TTL() NumField       { return NumField{field: FieldIPTTL} }
+func (IPHeader) Protocol() NumField  { return NumField{field: FieldIPProtocol} }
+func (IPHeader) Checksum() NumField  { return NumField{field: FieldIPChecksum} }
+func (IPHeader) SrcAddr() AddrField  { return AddrField{field: FieldIPSrcAddr} }
+func (IPHeader) DstAddr() AddrField  { return AddrField{field: FieldIPDstAddr} }
+
+// IPv6Header builds tests on the IPv6 header. As a Cond it matches IPv6
+// packets.
+type IPv6Header struct{ Cond }
+
+// IPv6 matches IPv6 packets and gives access to the IPv6 header fields.
+func IPv6() IPv6Header { return IPv6Header{boolField(FieldIPv6)} }
+
+func (IPv6Header) TrafficClass() NumField { return NumField{field: FieldIPv6TrafficClass} }
+func (IPv6Header) FlowLabel() NumField    { return NumField{field: FieldIPv6FlowLabel} }
+func (IPv6Header) Length() NumField       { return NumField{field: FieldIPv6Length} }
+func (IPv6Header) NextHdr() NumField      { return NumField{field: FieldIPv6NextHdr} }
+func (IPv6Header) HopLimit() NumField     { return NumField{field: FieldIPv6HopLimit} }
+func (IPv6Header) SrcAddr() AddrField     { return AddrField{field: FieldIPv6SrcAddr} }
+func (IPv6Header) DstAddr() AddrField     { return AddrField{field: FieldIPv6DstAddr} }
+
+// ICMPHeader builds tests on the ICMP header. As a Cond it matches ICMP
+// packets.
+type ICMPHeader struct{ Cond }
+
+// ICMP matches ICMP packets and gives access to the ICMP header fields.
+func ICMP() ICMPHeader { return ICMPHeader{boolField(FieldICMP)} }
+
+func (ICMPHeader) Type() NumField     { return NumField{field: FieldICMPType} }
+func (ICMPHeader) Code() NumField     { return NumField{field: FieldICMPCode} }
+func (ICMPHeader) Checksum() NumField { return NumField{field: FieldICMPChecksum} }
+func (ICMPHeader) Body() NumField     { return NumField{field: FieldICMPBody} }
+
+// ICMPv6Header builds tests on the ICMPv6 header. As a Cond it matches
+// ICMPv6 packets.
+type ICMPv6Header struct{ Cond }
+
+// ICMPv6 matches ICMPv6 packets and gives access to the ICMPv6 header
+// fields.
+func ICMPv6() ICMPv6Header { return ICMPv6Header{boolField(FieldICMPv6)} }
+
+func (ICMPv6Header) Type() NumField     { return NumField{field: FieldICMPv6Type} }
+func (ICMPv6Header) Code() NumField     { return NumField{field: FieldICMPv6Code} }
+func (ICMPv6Header) Checksum() NumField { return NumField{field: FieldICMPv6Checksum} }
+func (ICMPv6Header) Body() NumField     { return NumField{field: FieldICMPv6Body} }
+
+// TCPHeader builds tests on the TCP header. As a Cond it matches TCP
+// packets.
+type TCPHeader struct{ Cond }
+
+// TCP matches TCP packets and gives access to the TCP header fields.
+func TCP() TCPHeader { return TCPHeader{boolField(FieldTCP)} }
+
+func (TCPHeader) SrcPort() NumField       { return NumField{field: FieldTCPSrcPort} }
+func (TCPHeader) DstPort() NumField       { return NumField{field: FieldTCPDstPort} }
+func (TCPHeader) SeqNum() NumField        { return NumField{field: FieldTCPSeqNum} }
+func (TCPHeader) AckNum() NumField        { return NumField{field: FieldTCPAckNum} }
+func (TCPHeader) HdrLength() NumField     { return NumField{field: FieldTCPHdrLength} }
+func (TCPHeader) Urg() Cond               { return boolField(FieldTCPUrg) }
+func (TCPHeader) Ack() Cond               { return boolField(FieldTCPAck) }
+func (TCPHeader) Psh() Cond               { return boolField(FieldTCPPsh) }
+func (TCPHeader) Rst() Cond               { return boolField(FieldTCPRst) }
+func (TCPHeader) Syn() Cond               { return boolField(FieldTCPSyn) }
+func (TCPHeader) Fin() Cond               { return boolField(FieldTCPFin) }
+func (TCPHeader) Window() NumField        { return NumField{field: FieldTCPWindow} }
+func (TCPHeader) Checksum() NumField      { return NumField{field: FieldTCPChecksum} }
+func (TCPHeader) UrgPtr() NumField        { return NumField{field: FieldTCPUrgPtr} }
+func (TCPHeader) PayloadLength() NumField { return NumField{field: FieldTCPPayloadLength} }
+
+// Payload, Payload16 and Payload32 are the 8, 16 and 32 bit big endian
+// words at byte offset off of the TCP payload, negative offsets count
+// from the end.
+func (TCPHeader) Payload(off int) NumField   { return NumField{field: FieldTCPPayload, index: off} }
+func (TCPHeader) Payload16(off int) NumField { return NumField{field: FieldTCPPayload16, index: off} }
+func (TCPHeader) Payload32(off int) NumField { return NumField{field: FieldTCPPayload32, index: off} }
+
+// UDPHeader builds tests on the UDP header. As a Cond it matches UDP
+// packets.
+type UDPHeader struct{ Cond }
+
+// UDP matches UDP packets and gives access to the UDP header fields.
+func UDP() UDPHeader { return UDPHeader{boolField(FieldUDP)} }
+
+func (UDPHeader) SrcPort() NumField       { return NumField{field: FieldUDPSrcPort} }
+func (UDPHeader) DstPort() NumField       { return NumField{field: FieldUDPDstPort} }
+func (UDPHeader) Length() NumField        { return NumField{field: FieldUDPLength} }
+func (UDPHeader) Checksum() NumField      { return NumField{field: FieldUDPChecksum} }
+func (UDPHeader) PayloadLength() NumField { return NumField{field: FieldUDPPayloadLength} }
+
+// Payload, Payload16 and Payload32 are the 8, 16 and 32 bit big endian
+// words at byte offset off of the UDP payload, negative offsets count
+// from the end.
+func (UDPHeader) Payload(off int) NumField   { return NumField{field: FieldUDPPayload, index: off} }
+func (UDPHeader) Payload16(off int) NumField { return NumField{field: FieldUDPPayload16, index: off} }
+func (UDPHeader) Payload32(off int) NumField { return NumField{field: FieldUDPPayload32, index: off} }
+
+// Packet, Packet16 and Packet32 are the 8, 16 and 32 bit big endian words
+// at byte offset off of the packet, negative offsets count from the end.
+func Packet(off int) NumField   { return NumField{field: FieldPacket, index: off} }
+func Packet16(off int) NumField { return NumField{field: FieldPacket16, index: off} }
+func Packet32(off int) NumField { return NumField{field: FieldPacket32, index: off} }
+
+// IfIdx is the interface index at the network layers.
+func IfIdx() NumField { return NumField{field: FieldIfIdx} }
+
+// SubIfIdx is the sub-interface index at the network layers.
+func SubIfIdx() NumField { return NumField{field: FieldSubIfIdx} }
+
+// ProcessID is the process ID at the flow, socket and reflect layers.
+func ProcessID() NumField { return NumField{field: FieldProcessID} }
+
+// LocalAddr is the local address of a packet, flow or socket.
+func LocalAddr() AddrField { return AddrField{field: FieldLocalAddr} }
+
+// RemoteAddr is the remote address of a packet, flow or socket.
+func RemoteAddr() AddrField { return AddrField{field: FieldRemoteAddr} }
+
+// LocalPort is the local port of a packet, flow or socket.
+func LocalPort() NumField { return NumField{field: FieldLocalPort} }
+
+// RemotePort is the remote port of a packet, flow or socket.
+func RemotePort() NumField { return NumField{field: FieldRemotePort} }
+
+// Protocol is the IP protocol of a packet, flow or socket.
+func Protocol() NumField { return NumField{field: FieldProtocol} }
+
+// EndpointID is the endpoint ID at the flow and socket layers.
+func EndpointID() NumField { return NumField{field: FieldEndpointID} }
+
+// ParentEndpointID is the parent endpoint ID at the flow and socket
+// layers.
+func ParentEndpointID() NumField { return NumField{field: FieldParentEndpointID} }
+
+// ReflectLayer is the layer of the handle at the reflect layer.
+func ReflectLayer() NumField { return NumField{field: FieldLayer} }
+
+// Priority is the priority of the handle at the reflect layer.
+func Priority() NumField { return NumField{field: FieldPriority} }
+
+// Event is the event of the address.
+func Event() NumField { return NumField{field: FieldEvent} }
+
+// Length is the packet length.
+func Length() NumField { return NumField{field: FieldLength} }
+
+// Timestamp is the timestamp of the address.
+func Timestamp() NumField { return NumField{field: FieldTimestamp} }
+
+// Random8, Random16 and Random32 are pseudo random numbers derived from
+// the packet hash, for sampling.
+func Random8() NumField  { return NumField{field: FieldRandom8} }
+func Random16() NumField { return NumField{field: FieldRandom16} }
+func Random32() NumField { return NumField{field: FieldRandom32} }
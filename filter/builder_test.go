@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"net/netip"
+	"testing"
+)
+
+var buildTests = []struct {
+	cond Cond
+	want string
+}{
+	{TCP().DstPort().Eq(443).And(Outbound()), "tcp.DstPort = 443 and outbound"},
+	{UDP().DstPort().In(53, 853), "udp.DstPort = 53 or udp.DstPort = 853"},
+	{IP().DstAddr().In(netip.MustParsePrefix("192.168.0.0/16")), "ip.DstAddr >= 192.168.0.0 and ip.DstAddr <= 192.168.255.255"},
+	{IPv6().SrcAddr().Eq(netip.MustParseAddr("fe80::1")), "ipv6.SrcAddr = fe80::1"},
+	{IPv6().DstAddr().In(netip.MustParsePrefix("2001:db8::/32")), "ipv6.DstAddr >= 2001:db8:: and ipv6.DstAddr <= 2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+	{If(TCP(), TCP().Syn(), UDP()), "(tcp? tcp.Syn: udp)"},
+	{ICMP().Type().Eq(8).And(IP().TTL().Range(1, 64)), "icmp.Type = 8 and ip.TTL >= 1 and ip.TTL <= 64"},
+	{Packet(-1).Eq(0), "packet[-1b] = 0x0"},
+	{Length().Gt(100).And(Fragment().Not()), "length > 100 and not fragment"},
+	{Inbound().Or(Loopback()).Not(), "not inbound and not loopback"},
+	{IfIdx().Neq(1).Not(), "ifIdx = 1"},
+	{True().Not(), "false"},
+
+	// Tests on header fields are false without the header, so they are
+	// negated with a guard, and array fields with a conditional.
+	{TCP().DstPort().Eq(443).Not(), "not tcp or tcp.DstPort != 443"},
+	{TCP().Ack().Not(), "not tcp or not tcp.Ack"},
+	{TCP().Payload(0).Eq(0x16).Not(), "(tcp.Payload[0b] = 0x16? false: true)"},
+	{If(TCP(), TCP().DstPort().Eq(80), True()).Not(), "(tcp? not tcp or tcp.DstPort != 80: false)"},
+}
+
+func TestBuild(t *testing.T) {
+	for _, tt := range buildTests {
+		s, err := tt.cond.Build(LayerNetwork)
+		if err != nil {
+			t.Errorf("Build(%q): %v", tt.want, err)
+			continue
+		}
+		if s != tt.want {
+			t.Errorf("Build() = %q, want %q", s, tt.want)
+		}
+
+		// The string parses back to the same filter.
+		f, err := Parse(s, LayerNetwork)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", s, err)
+			continue
+		}
+		if got := f.String(); got != s {
+			t.Errorf("Parse(%q).String() = %q", s, got)
+		}
+		object, err := CompileFilter(s, LayerNetwork)
+		if err != nil {
+			t.Errorf("CompileFilter(%q): %v", s, err)
+			continue
+		}
+		want, _ := CompileFilter(f.String(), LayerNetwork)
+		if string(object) != string(want) {
+			t.Errorf("CompileFilter(%q) = %q, want %q", s, object, want)
+		}
+	}
+}
+
+func TestBuildError(t *testing.T) {
+	for _, c := range []Cond{
+		{},
+		IP().DstAddr().Eq(netip.MustParseAddr("::1")),
+		IP().DstAddr().Eq(netip.Addr{}),
+		TCP().DstPort().Eq(80).And(Cond{}),
+		ProcessID().Eq(4),
+	} {
+		if s, err := c.Build(LayerNetwork); err == nil {
+			t.Errorf("Build() = %q, want error", s)
+		}
+	}
+}
+
+// TestNot checks that Not matches exactly the packets c does not.
+func TestNot(t *testing.T) {
+	pkts := testPackets(t)
+	for _, c := range []Cond{
+		TCP().DstPort().Eq(80),
+		TCP().DstPort().Neq(80),
+		UDP().SrcPort().Lt(1024),
+		IP().DstAddr().Eq(netip.MustParseAddr("10.0.0.2")),
+		IPv6().HopLimit().Gt(16),
+		ICMP().Type().Eq(8).Or(ICMPv6().Type().Eq(128)),
+		TCP().Syn().And(Outbound()),
+		TCP().Payload(0).Eq(0x16),
+		TCP().Payload(10).Eq(0),
+		UDP().Payload16(0).Neq(0),
+		Packet32(-4).Eq(0x16030100),
+		If(TCP(), TCP().DstPort().Eq(80), UDP().DstPort().Eq(53)),
+		If(TCP().DstPort().Eq(80), False(), UDP()),
+	} {
+		p, err := c.Filter(LayerNetwork)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		np, err := c.Not().Filter(LayerNetwork)
+		if err != nil {
+			t.Fatalf("%s: %v", c.Not(), err)
+		}
+		prog, _ := Compile(p.String(), LayerNetwork)
+		nprog, _ := Compile(np.String(), LayerNetwork)
+		for _, tp := range pkts {
+			ok, err := prog.Eval(tp.packet, &tp.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nok, err := nprog.Eval(tp.packet, &tp.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok == nok {
+				t.Errorf("%s and %s both %v for %s", p, np, ok, tp.name)
+			}
+		}
+	}
+}
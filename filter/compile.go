@@ -0,0 +1,324 @@
+package filter
+
+// resultAccept and resultReject are the WINDIVERT_FILTER_RESULT_* labels
+// ending the evaluation of a filter object.
+const (
+	resultAccept = 0x7FFE
+	resultReject = 0x7FFF
+)
+
+// insn is a WINDIVERT_FILTER, one test of a filter object. Labels other
+// than resultAccept and resultReject are indices of later tests.
+type insn struct {
+	field   Field
+	op      Op
+	neg     bool
+	arg     [4]uint32
+	success uint16
+	failure uint16
+}
+
+// CompileFilter compiles a filter string for the given layer into the
+// object representation produced by WinDivertHelperCompileFilter, e.g.
+// "@WinDiv_..." without the terminating NUL.
+//
+// The object can be passed to Open in place of the filter string. An
+// object given as filter is checked and re-encoded.
+func CompileFilter(filter string, layer Layer) ([]byte, error) {
+	prog, err := compile(filter, layer)
+	if err != nil {
+		return nil, err
+	}
+	return appendObject(nil, prog), nil
+}
+
+// compile is WinDivertCompileFilter.
+func compile(filter string, layer Layer) ([]insn, error) {
+	if len(filter) > 0 && filter[0] == '@' {
+		prog, ok := decodeObject(filter)
+		if !ok {
+			return nil, newError(errBadObject, 0, "")
+		}
+		return prog, nil
+	}
+
+	f, err := parse(filter, layer, false)
+	if err != nil {
+		return nil, err
+	}
+	var c compiler
+	label := c.flatten(f.Expr, resultAccept, resultReject)
+	if label < 0 {
+		return nil, newError(errTooLong, 0, "")
+	}
+	return c.emit(label), nil
+}
+
+// compiler flattens an expression into a sequence of tests and jumps the
+// same way WinDivertFlattenExpr does, so labels match the C helper.
+type compiler struct {
+	stack []flatTest
+}
+
+type flatTest struct {
+	test       Test
+	succ, fail int
+}
+
+func (c *compiler) flatten(e Expr, succ, fail int) int {
+	if succ < 0 || fail < 0 {
+		return -1
+	}
+	switch e := e.(type) {
+	case *BinaryExpr:
+		if e.Op == OpAnd {
+			succ = c.flatten(e.Y, succ, fail)
+			return c.flatten(e.X, succ, fail)
+		}
+		fail = c.flatten(e.Y, succ, fail)
+		return c.flatten(e.X, succ, fail)
+	case *CondExpr:
+		fail1 := c.flatten(e.Else, succ, fail)
+		succ1 := c.flatten(e.Then, succ, fail)
+		return c.flatten(e.Cond, succ1, fail1)
+	case *Test:
+		t := simplify(*e)
+		if t.Field == FieldTrue && t.Op == OpEq {
+			if t.Value.Val[0] != 0 {
+				return succ
+			}
+			return fail
+		}
+		if len(c.stack) >= maxLength {
+			return -1
+		}
+		c.stack = append(c.stack, flatTest{test: t, succ: succ, fail: fail})
+		return len(c.stack) - 1
+	default:
+		return -1
+	}
+}
+
+// emit is WinDivertEmitFilter. The test labelled label is the entry point
+// and becomes the first test of the object.
+func (c *compiler) emit(label int) []insn {
+	if label == resultAccept || label == resultReject {
+		return []insn{{field: FieldZero, op: OpEq, success: uint16(label), failure: uint16(label)}}
+	}
+	prog := make([]insn, label+1)
+	for i := range prog {
+		ft := &c.stack[label-i]
+		in := &prog[i]
+		in.field = ft.test.Field
+		in.op = ft.test.Op
+		in.neg = ft.test.Value.Neg
+		in.arg = ft.test.Value.Val
+		if ft.test.Field.IsArray() {
+			in.arg[1] = uint32(int32(ft.test.Index))
+		}
+		in.success = jump(label, ft.succ)
+		in.failure = jump(label, ft.fail)
+	}
+	return prog
+}
+
+func jump(offset, l int) uint16 {
+	if l == resultAccept || l == resultReject {
+		return uint16(l)
+	}
+	return uint16(offset - l)
+}
+
+// simplify is WinDivertSimplifyTest. A test whose outcome follows from the
+// range of its field is replaced by a check of the protocol the field
+// belongs to, or by a constant true or false.
+func simplify(t Test) Test {
+	var lb, ub [4]uint32
+	negLb, eq := false, false
+	typ := FieldTrue
+
+	switch t.Field {
+	case FieldZero, FieldFalse:
+		eq = true
+	case FieldTrue:
+		eq = true
+		lb[0], ub[0] = 1, 1
+	case FieldLayer:
+		ub[0] = uint32(LayerReflect)
+	case FieldPriority:
+		negLb = true
+		lb[0], ub[0] = priorityMax, priorityMax
+	case FieldEvent:
+		ub[0] = eventReflectClose
+	case FieldIPDF, FieldIPMF:
+		typ, ub[0] = FieldIP, 1
+	case FieldTCPUrg, FieldTCPAck, FieldTCPPsh, FieldTCPRst, FieldTCPSyn, FieldTCPFin:
+		typ, ub[0] = FieldTCP, 1
+	case FieldInbound, FieldOutbound, FieldFragment, FieldIP, FieldIPv6,
+		FieldICMP, FieldICMPv6, FieldTCP, FieldUDP:
+		ub[0] = 1
+	case FieldIPHdrLength:
+		typ, ub[0] = FieldIP, 0x0F
+	case FieldTCPHdrLength:
+		typ, ub[0] = FieldTCP, 0x0F
+	case FieldIPTTL, FieldIPProtocol:
+		typ, ub[0] = FieldIP, 0xFF
+	case FieldIPv6TrafficClass, FieldIPv6NextHdr, FieldIPv6HopLimit:
+		typ, ub[0] = FieldIPv6, 0xFF
+	case FieldICMPType, FieldICMPCode:
+		typ, ub[0] = FieldICMP, 0xFF
+	case FieldICMPv6Type, FieldICMPv6Code:
+		typ, ub[0] = FieldICMPv6, 0xFF
+	case FieldTCPPayload:
+		typ, ub[0] = FieldTCP, 0xFF
+	case FieldUDPPayload:
+		typ, ub[0] = FieldUDP, 0xFF
+	case FieldProtocol, FieldPacket, FieldRandom8:
+		ub[0] = 0xFF
+	case FieldIPFragOff:
+		typ, ub[0] = FieldIP, 0x1FFF
+	case FieldIPTOS, FieldIPLength, FieldIPId, FieldIPChecksum:
+		typ, ub[0] = FieldIP, 0xFFFF
+	case FieldIPv6Length:
+		typ, ub[0] = FieldIPv6, 0xFFFF
+	case FieldICMPChecksum:
+		typ, ub[0] = FieldICMP, 0xFFFF
+	case FieldICMPv6Checksum:
+		typ, ub[0] = FieldICMPv6, 0xFFFF
+	case FieldTCPSrcPort, FieldTCPDstPort, FieldTCPWindow, FieldTCPChecksum,
+		FieldTCPUrgPtr, FieldTCPPayloadLength, FieldTCPPayload16:
+		typ, ub[0] = FieldTCP, 0xFFFF
+	case FieldUDPSrcPort, FieldUDPDstPort, FieldUDPLength, FieldUDPChecksum,
+		FieldUDPPayloadLength, FieldUDPPayload16:
+		typ, ub[0] = FieldUDP, 0xFFFF
+	case FieldLocalPort, FieldRemotePort, FieldPacket16, FieldRandom16:
+		ub[0] = 0xFFFF
+	case FieldLength:
+		lb[0], ub[0] = 20, mtuMax
+	case FieldIPv6FlowLabel:
+		typ, ub[0] = FieldIPv6, 0x000FFFFF
+	case FieldIPSrcAddr, FieldIPDstAddr:
+		typ = FieldIP
+		lb[1] = 0xFFFF
+		ub[0], ub[1] = 0xFFFFFFFF, 0xFFFF
+	case FieldIPv6SrcAddr, FieldIPv6DstAddr, FieldLocalAddr, FieldRemoteAddr:
+		if t.Field == FieldIPv6SrcAddr || t.Field == FieldIPv6DstAddr {
+			typ = FieldIPv6
+		}
+		ub = [4]uint32{0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFF}
+	case FieldTimestamp:
+		negLb = true
+		lb[1] = 0x80000000
+		ub[0], ub[1] = 0xFFFFFFFF, 0x7FFFFFFF
+	case FieldTCPPayload32:
+		typ, ub[0] = FieldTCP, 0xFFFFFFFF
+	case FieldUDPPayload32:
+		typ, ub[0] = FieldUDP, 0xFFFFFFFF
+	case FieldIfIdx, FieldSubIfIdx, FieldRandom32, FieldProcessID:
+		ub[0] = 0xFFFFFFFF
+	case FieldEndpointID, FieldParentEndpointID:
+		ub[0], ub[1] = 0xFFFFFFFF, 0xFFFFFFFF
+	default:
+		return t
+	}
+
+	resultLb := compare128(t.Value.Neg, &t.Value.Val, negLb, &lb, true)
+	resultUb := compare128(t.Value.Neg, &t.Value.Val, false, &ub, true)
+	var result bool
+	switch t.Op {
+	case OpEq:
+		switch {
+		case resultLb < 0 || resultUb > 0:
+			result = false
+		case eq && resultLb == 0:
+			result = true
+		default:
+			return t
+		}
+	case OpNeq:
+		switch {
+		case resultLb < 0 || resultUb > 0:
+			result = true
+		case eq && resultLb == 0:
+			result = false
+		default:
+			return t
+		}
+	case OpLt:
+		switch {
+		case resultUb > 0:
+			result = true
+		case resultLb <= 0:
+			result = false
+		default:
+			return t
+		}
+	case OpLeq:
+		switch {
+		case resultUb >= 0:
+			result = true
+		case resultLb < 0:
+			result = false
+		default:
+			return t
+		}
+	case OpGt:
+		switch {
+		case resultUb >= 0:
+			result = false
+		case resultLb < 0:
+			result = true
+		default:
+			return t
+		}
+	case OpGeq:
+		switch {
+		case resultUb > 0:
+			result = false
+		case resultLb <= 0:
+			result = true
+		default:
+			return t
+		}
+	default:
+		return t
+	}
+
+	s := Test{TestPos: t.TestPos, Field: typ, Op: OpEq}
+	if result {
+		s.Value.Val[0] = 1
+	}
+	return s
+}
+
+// priorityMax is WINDIVERT_PRIORITY_MAX as seen by the filter compiler.
+const priorityMax = 30000
+
+// compare128 is WinDivertCompare128. It returns -1, 0 or 1 as the signed
+// value a is less than, equal to or greater than b, comparing only the
+// lowest word unless big is set.
+func compare128(negA bool, a *[4]uint32, negB bool, b *[4]uint32, big bool) int {
+	if negA && !negB {
+		return -1
+	}
+	if !negA && negB {
+		return 1
+	}
+	neg := 1
+	if negA {
+		neg = -1
+	}
+	i := 0
+	if big {
+		i = 3
+	}
+	for ; i >= 0; i-- {
+		if a[i] < b[i] {
+			return -neg
+		}
+		if a[i] > b[i] {
+			return neg
+		}
+	}
+	return 0
+}
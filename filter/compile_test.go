@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The objects and errors below were produced by WinDivertHelperCompileFilter
+// of divert/windivert_helper.c, built with a small shim of windows.h.
+
+var compileTests = []struct {
+	layer  Layer
+	filter string
+	object string
+}{
+	{LayerNetwork, "true", "@WinDiv_WX_WWWWAA"},
+	{LayerNetwork, "false", "@WinDiv_WX_WWWWXX"},
+	{LayerNetwork, "tcp", "@WinDiv_WX_eXWWAX"},
+	{LayerNetwork, "tcp.DstPort == 80", "@WinDiv_WX_1dWW2mAX"},
+	{LayerNetwork, "outbound and tcp.DstPort == 443", "@WinDiv_WY_YXWWLXX_1dWWDxAX"},
+	{LayerNetwork, "udp.DstPort == 53 or udp.SrcPort == 53", "@WinDiv_WY_1sWW1rALX_1rWW1rAX"},
+	{LayerNetwork, "ip.DstAddr == 10.0.0.1", "@WinDiv_WX_sWW50000XAX"},
+	{LayerNetwork, "ip.DstAddr >= 192.168.0.0 and ip.DstAddr <= 192.168.255.255", "@WinDiv_WY_sbW30AG00WLXX_sZW30AHVV=AX"},
+	{LayerNetwork, "ipv6.DstAddr == ::1", "@WinDiv_WX_zWWXWWWAX"},
+	{LayerNetwork, "ipv6.SrcAddr == fe80::1:2:3:4", "@WinDiv_WX_yWW600a200YW3V8000WAX"},
+	{LayerNetwork, "tcp.Syn and !tcp.Ack", "@WinDiv_WY_1lXWWLXX_1iWWWAX"},
+	{LayerNetwork, "(tcp ? tcp.DstPort == 80 : udp.DstPort == 53)", "@WinDiv_WZ_eXWWLXLY_1dWW2mAX_1sWW1rAX"},
+	{LayerNetwork, "tcp.PayloadLength > 0 and tcp.Payload[0] == 0x16", "@WinDiv_WY_1qaWWLXX_2gWWs1VV=AX"},
+	{LayerNetwork, "tcp.Payload32[-4] == 0xdeadbeef", "@WinDiv_WX_2iWW3FARFNl1VVlAX"},
+	{LayerNetwork, "packet[0] == 0x45", "@WinDiv_WX_2dWW2b1VV=AX"},
+	{LayerNetwork, "packet16[2] > 100", "@WinDiv_WX_2eaW3a200ZAX"},
+	{LayerNetwork, "ip.TTL < 64 || ipv6.HopLimit < 64", "@WinDiv_WY_oYW2WALX_xYW2WAX"},
+	{LayerNetwork, "icmp.Type == 8 and icmp.Code == 0", "@WinDiv_WY_+WWeLXX_=WWWAX"},
+	{LayerNetwork, "icmpv6.Type == 128", "@WinDiv_WX_1YWW4WAX"},
+	{LayerNetwork, "ifIdx == 5 and subIfIdx == 0", "@WinDiv_WY_ZWWbLXX_aWWWAX"},
+	{LayerNetwork, "loopback or impostor", "@WinDiv_WY_1wXWWALX_1xXWWAX"},
+	{LayerNetwork, "length > 1000", "@WinDiv_WX_2maWVeAX"},
+	{LayerNetwork, "random8 < 128", "@WinDiv_WX_2oYW4WAX"},
+	{LayerNetwork, "ip.DstAddr == 10.0.0.1 and tcp.DstPort == 80 and tcp.SrcPort != 22 or udp", "@WinDiv_Wa_sWW50000XLXLZ_1dWW2mLYLZ_1cXWsALZ_fXWWAX"},
+	{LayerNetwork, "ip.Protocol == TCP", "@WinDiv_WX_pWWcAX"},
+	{LayerNetwork, "zero == 0", "@WinDiv_WX_WWWWAA"},
+	{LayerFlow, "processId == 4 and remotePort == 443", "@WinDiv_WY_1yWWaLXX_2WWWDxAX"},
+	{LayerFlow, "event == ESTABLISHED and tcp", "@WinDiv_WY_2cWWXLXX_eXWWAX"},
+	{LayerSocket, "event == CONNECT and remoteAddr == 1.1.1.1", "@WinDiv_WY_2cWWaLXX_1+WWG208X1VV=WWAX"},
+	{LayerSocket, "localAddr == ::1 and protocol == 17", "@WinDiv_WY_1zWWXWWWLXX_2XWWnAX"},
+	{LayerReflect, "layer == NETWORK and priority > 0", "@WinDiv_WY_2aWWWLXX_2baWWAX"},
+	{LayerNetworkForward, "ip.DstAddr == 8.8.8.8", "@WinDiv_WX_sWW40G20eAX"},
+}
+
+func TestCompileFilter(t *testing.T) {
+	for _, tt := range compileTests {
+		object, err := CompileFilter(tt.filter, tt.layer)
+		if err != nil {
+			t.Errorf("CompileFilter(%q, %v): %v", tt.filter, tt.layer, err)
+			continue
+		}
+		if got := string(object); got != tt.object {
+			t.Errorf("CompileFilter(%q, %v) = %q, want %q", tt.filter, tt.layer, got, tt.object)
+		}
+	}
+}
+
+var compileErrorTests = []struct {
+	layer  Layer
+	filter string
+	msg    string
+	offset int
+}{
+	{LayerNetwork, "not (tcp or udp)", "Filter expression parse error", 4},
+	{LayerNetwork, "tcp.DstPort = ", "Filter expression parse error", 14},
+	{LayerNetwork, "foo", "Filter expression contains a bad token", 0},
+	{LayerFlow, "tcp.Payload[0] == 1", "Filter expression contains a bad token for layer", 0},
+}
+
+func TestCompileFilterError(t *testing.T) {
+	for _, tt := range compileErrorTests {
+		_, err := CompileFilter(tt.filter, tt.layer)
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("CompileFilter(%q, %v) error = %v, want *Error", tt.filter, tt.layer, err)
+			continue
+		}
+		if e.Msg != tt.msg || e.Offset != tt.offset {
+			t.Errorf("CompileFilter(%q, %v) error = %q at %d, want %q at %d", tt.filter, tt.layer, e.Msg, e.Offset, tt.msg, tt.offset)
+		}
+	}
+}
+
+// TestMaxObjectLength compiles a filter of the longest instructions.
+func TestMaxObjectLength(t *testing.T) {
+	var b strings.Builder
+	for i := range maxLength {
+		if i > 0 {
+			b.WriteString(" or ")
+		}
+		fmt.Fprintf(&b, "(ipv6.DstAddr == ffff:ffff:ffff:ffff:ffff:ffff:ffff:%x and ipv6.SrcAddr != ffff:ffff:ffff:ffff:ffff:ffff:ffff:%x)", 0xff00+i, 0xfe00+i)
+	}
+	for n := maxLength; n > 0; n-- {
+		s := b.String()
+		object, err := CompileFilter(s, LayerNetwork)
+		if err != nil {
+			// Drop the last test until the filter fits.
+			b.Reset()
+			b.WriteString(s[:strings.LastIndex(s, " or ")])
+			continue
+		}
+		if len(object)+1 > MaxObjectLength {
+			t.Errorf("object of %d bytes, MaxObjectLength = %d", len(object), MaxObjectLength)
+		}
+		return
+	}
+	t.Fatal("no filter compiled")
+}
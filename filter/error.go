@@ -0,0 +1,80 @@
+package filter
+
+import "strconv"
+
+// errorCode is one of the WINDIVERT_ERROR_* codes of windivert_helper.c.
+type errorCode int
+
+const (
+	errNone             errorCode = 0
+	errNoMemory         errorCode = 1
+	errTooDeep          errorCode = 2
+	errTooLong          errorCode = 3
+	errBadToken         errorCode = 4
+	errBadTokenForLayer errorCode = 5
+	errUnexpectedToken  errorCode = 6
+	errIndexOOB         errorCode = 7
+	errOutputTooShort   errorCode = 8
+	errBadObject        errorCode = 9
+	errAssertionFailed  errorCode = 10
+)
+
+// String returns the message WinDivertHelperCompileFilter reports for the
+// code.
+func (c errorCode) String() string {
+	switch c {
+	case errNone:
+		return "No error"
+	case errNoMemory:
+		return "Out of memory"
+	case errTooDeep:
+		return "Filter expression too deep"
+	case errTooLong:
+		return "Filter expression too long"
+	case errBadToken:
+		return "Filter expression contains a bad token"
+	case errBadTokenForLayer:
+		return "Filter expression contains a bad token for layer"
+	case errUnexpectedToken:
+		return "Filter expression parse error"
+	case errIndexOOB:
+		return "Filter expression array index is out-of-bounds"
+	case errOutputTooShort:
+		return "Filter object buffer is too short"
+	case errBadObject:
+		return "Filter object is invalid"
+	case errAssertionFailed:
+		return "Internal assertion failed"
+	default:
+		return "Unknown error"
+	}
+}
+
+// Error is a filter compile error, carrying what WinDivertHelperCompileFilter
+// reports through errorStr and errorPos.
+type Error struct {
+	// Offset is the byte offset reported as errorPos. Like the C helper,
+	// a few lexical errors point just past the offending character.
+	Offset int
+	// Token is the offending token, empty at the end of the filter.
+	Token string
+	// Msg is the message reported as errorStr.
+	Msg string
+
+	code errorCode
+}
+
+func newError(code errorCode, pos int, tok string) *Error {
+	if pos < 0 {
+		pos = 0
+	}
+	return &Error{Offset: pos, Token: tok, Msg: code.String(), code: code}
+}
+
+// Error returns the message followed by the offset and token.
+func (e *Error) Error() string {
+	if e.Token == "" {
+		return e.Msg + " at offset " + strconv.Itoa(e.Offset)
+	}
+	return e.Msg + " at offset " + strconv.Itoa(e.Offset) + " near " + strconv.Quote(e.Token)
+}
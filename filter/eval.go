@@ -0,0 +1,518 @@
+package filter
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/imgk/divert-go/header"
+)
+
+// ErrInvalidInput is returned by Eval when the packet cannot be parsed,
+// does not match the address, or the filter tests a field that the layer
+// of the address does not carry.
+var ErrInvalidInput = errors.New("invalid packet or address for filter")
+
+// Address is the part of a WINDIVERT_ADDRESS that filters can test.
+//
+// Only the fields of the address layer are used: IfIdx and SubIfIdx for
+// the network layers, the Flow or Socket data for the flow and socket
+// layers, and ProcessID, ReflectLayer and Priority for the reflect layer.
+type Address struct {
+	Layer     Layer
+	Event     uint8
+	Timestamp int64
+	Outbound  bool
+	Loopback  bool
+	Impostor  bool
+	IPv6      bool
+
+	IfIdx    uint32
+	SubIfIdx uint32
+
+	EndpointID       uint64
+	ParentEndpointID uint64
+	ProcessID        uint32
+	// LocalAddr and RemoteAddr are laid out like in WINDIVERT_DATA_FLOW:
+	// host byte order words, least significant first, with IPv4
+	// addresses mapped into IPv6.
+	LocalAddr  [4]uint32
+	RemoteAddr [4]uint32
+	LocalPort  uint16
+	RemotePort uint16
+	Protocol   uint8
+
+	ReflectLayer Layer
+	Priority     int16
+}
+
+// Program is a compiled filter that can be evaluated in user space.
+// A Program is safe for concurrent use.
+type Program struct {
+	layer Layer
+	prog  []insn
+}
+
+// Compile compiles a filter string, or checks a filter object, for
+// evaluation at the given layer.
+func Compile(filter string, layer Layer) (*Program, error) {
+	prog, err := compile(filter, layer)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{layer: layer, prog: prog}, nil
+}
+
+// Layer returns the layer the program was compiled for.
+func (p *Program) Layer() Layer {
+	return p.layer
+}
+
+// String formats the program the same way as FormatFilter.
+func (p *Program) String() string {
+	s, _ := FormatFilter(appendObject(nil, p.prog), p.layer)
+	return s
+}
+
+// EvalFilter reports whether the packet and address match filter, the
+// equivalent of WinDivertHelperEvalFilter. The filter is compiled for the
+// layer of addr on every call, use Compile to evaluate it repeatedly.
+func EvalFilter(filter string, packet []byte, addr *Address) (bool, error) {
+	p, err := Compile(filter, addr.Layer)
+	if err != nil {
+		return false, err
+	}
+	return p.Eval(packet, addr)
+}
+
+// Eval reports whether the packet and address match the program. The
+// packet must be nil at the flow and socket layers. Eval does not
+// allocate.
+func (p *Program) Eval(packet []byte, addr *Address) (bool, error) {
+	e := evaluator{addr: addr, packet: packet}
+	switch addr.Layer {
+	case LayerNetwork, LayerNetworkForward:
+		if !e.info.Parse(packet) {
+			return false, ErrInvalidInput
+		}
+		if (addr.IPv6 && e.info.IPv6 == nil) || (!addr.IPv6 && e.info.IPv4 == nil) {
+			return false, ErrInvalidInput
+		}
+	case LayerFlow, LayerSocket:
+		if packet != nil {
+			return false, ErrInvalidInput
+		}
+	case LayerReflect:
+	default:
+		return false, ErrInvalidInput
+	}
+
+	switch e.run(p.prog) {
+	case 1:
+		return true, nil
+	case 0:
+		return false, nil
+	default:
+		return false, ErrInvalidInput
+	}
+}
+
+// evaluator is WinDivertExecuteFilter for one packet.
+type evaluator struct {
+	addr     *Address
+	packet   []byte
+	info     header.Packet
+	random64 uint64
+}
+
+// run returns 1 if the packet is accepted, 0 if it is rejected and -1 on
+// error.
+func (e *evaluator) run(prog []insn) int {
+	ip := 0
+	for ttl := maxLength + 1; ttl > 0; ttl-- {
+		if ip >= len(prog) {
+			return -1
+		}
+		in := &prog[ip]
+		var val [4]uint32
+		result, ok, neg, big := e.value(in, &val)
+		if !ok {
+			return -1
+		}
+		if result {
+			cmp := compare128(neg, &val, in.neg, &in.arg, big)
+			switch in.op {
+			case OpEq:
+				result = cmp == 0
+			case OpNeq:
+				result = cmp != 0
+			case OpLt:
+				result = cmp < 0
+			case OpLeq:
+				result = cmp <= 0
+			case OpGt:
+				result = cmp > 0
+			case OpGeq:
+				result = cmp >= 0
+			default:
+				return -1
+			}
+		}
+
+		next := in.failure
+		if result {
+			next = in.success
+		}
+		switch next {
+		case resultAccept:
+			return 1
+		case resultReject:
+			return 0
+		}
+		ip = int(next)
+	}
+	return -1
+}
+
+// getData is WinDivertGetData, reading size bytes at idx of the
+// packet[min:max] window, counting from max if idx is negative.
+func (e *evaluator) getData(lo, hi, idx, size int) (uint32, bool) {
+	if idx < 0 {
+		idx += hi
+	} else {
+		idx += lo
+	}
+	if idx < lo || idx > hi-size {
+		return 0, false
+	}
+	b := e.packet[idx : idx+size]
+	switch size {
+	case 1:
+		return uint32(b[0]), true
+	case 2:
+		return uint32(binary.BigEndian.Uint16(b)), true
+	default:
+		return binary.BigEndian.Uint32(b), true
+	}
+}
+
+func bool32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ipv6Addr loads an IPv6 address in filter word order.
+func ipv6Addr(b []byte, val *[4]uint32) {
+	val[3] = binary.BigEndian.Uint32(b[0:])
+	val[2] = binary.BigEndian.Uint32(b[4:])
+	val[1] = binary.BigEndian.Uint32(b[8:])
+	val[0] = binary.BigEndian.Uint32(b[12:])
+}
+
+// ipv4Addr loads an IPv4 address as an IPv4-mapped IPv6 address.
+func ipv4Addr(b []byte, val *[4]uint32) {
+	val[3], val[2], val[1] = 0, 0, 0x0000FFFF
+	val[0] = binary.BigEndian.Uint32(b)
+}
+
+// value loads the field tested by in. result is false if the protocol
+// header of the field is missing, so the test fails; ok is false if the
+// field cannot be evaluated at the layer.
+func (e *evaluator) value(in *insn, val *[4]uint32) (result, ok, neg, big bool) {
+	a := e.addr
+	info := &e.info
+	layer := a.Layer
+	if !in.field.ValidFor(layer) {
+		return
+	}
+	network := layer == LayerNetwork || layer == LayerNetworkForward
+
+	result = true
+	switch in.field {
+	case FieldRandom8, FieldRandom16, FieldRandom32:
+		if e.random64 == 0 {
+			e.random64 = info.Hash(uint64(a.Timestamp)) | 0xFF00000000000000
+		}
+	case FieldIPHdrLength, FieldIPTOS, FieldIPLength, FieldIPId, FieldIPDF,
+		FieldIPMF, FieldIPFragOff, FieldIPTTL, FieldIPProtocol,
+		FieldIPChecksum, FieldIPSrcAddr, FieldIPDstAddr:
+		result = info.IPv4 != nil
+	case FieldIPv6TrafficClass, FieldIPv6FlowLabel, FieldIPv6Length,
+		FieldIPv6NextHdr, FieldIPv6HopLimit, FieldIPv6SrcAddr, FieldIPv6DstAddr:
+		result = info.IPv6 != nil
+	case FieldICMPType, FieldICMPCode, FieldICMPChecksum, FieldICMPBody:
+		result = info.ICMPv4 != nil
+	case FieldICMPv6Type, FieldICMPv6Code, FieldICMPv6Checksum, FieldICMPv6Body:
+		result = info.ICMPv6 != nil
+	case FieldTCPSrcPort, FieldTCPDstPort, FieldTCPSeqNum, FieldTCPAckNum,
+		FieldTCPHdrLength, FieldTCPUrg, FieldTCPAck, FieldTCPPsh, FieldTCPRst,
+		FieldTCPSyn, FieldTCPFin, FieldTCPWindow, FieldTCPChecksum,
+		FieldTCPUrgPtr, FieldTCPPayload, FieldTCPPayload16, FieldTCPPayload32,
+		FieldTCPPayloadLength:
+		result = info.TCP != nil
+	case FieldUDPSrcPort, FieldUDPDstPort, FieldUDPLength, FieldUDPChecksum,
+		FieldUDPPayload, FieldUDPPayload16, FieldUDPPayload32,
+		FieldUDPPayloadLength:
+		result = info.UDP != nil
+	}
+	if !result {
+		return false, true, false, false
+	}
+
+	be16 := binary.BigEndian.Uint16
+	be32 := binary.BigEndian.Uint32
+	ok = true
+	switch in.field {
+	case FieldZero:
+		val[0] = 0
+	case FieldEvent:
+		val[0] = uint32(a.Event)
+	case FieldLength:
+		val[0] = uint32(len(e.packet))
+	case FieldTimestamp:
+		big = true
+		neg = a.Timestamp < 0
+		ts := uint64(a.Timestamp)
+		if neg {
+			ts = -ts
+		}
+		val[0], val[1] = uint32(ts), uint32(ts>>32)
+	case FieldRandom8:
+		val[0] = uint32(e.random64>>48) & 0xFF
+	case FieldRandom16:
+		val[0] = uint32(e.random64>>32) & 0xFFFF
+	case FieldRandom32:
+		val[0] = uint32(e.random64)
+	case FieldPacket, FieldPacket16, FieldPacket32:
+		val[0], result = e.getData(0, len(e.packet), int(int32(in.arg[1])), fields[in.field].size)
+	case FieldTCPPayload, FieldTCPPayload16, FieldTCPPayload32,
+		FieldUDPPayload, FieldUDPPayload16, FieldUDPPayload32:
+		val[0], result = e.getData(info.HeaderLength, info.HeaderLength+len(info.Payload), int(int32(in.arg[1])), fields[in.field].size)
+	case FieldInbound:
+		val[0] = bool32(!a.Outbound)
+	case FieldOutbound:
+		val[0] = bool32(a.Outbound)
+	case FieldFragment:
+		val[0] = bool32(info.Fragment)
+	case FieldIfIdx:
+		val[0] = a.IfIdx
+	case FieldSubIfIdx:
+		val[0] = a.SubIfIdx
+	case FieldLoopback:
+		val[0] = bool32(a.Loopback)
+	case FieldImpostor:
+		val[0] = bool32(a.Impostor)
+	case FieldIP:
+		val[0] = bool32(info.IPv4 != nil)
+	case FieldIPv6:
+		val[0] = bool32(info.IPv6 != nil)
+	case FieldICMP:
+		if network {
+			val[0] = bool32(info.ICMPv4 != nil)
+		} else {
+			val[0] = bool32(!a.IPv6 && a.Protocol == header.ICMPv4ProtocolNumber)
+		}
+	case FieldICMPv6:
+		if network {
+			val[0] = bool32(info.ICMPv6 != nil)
+		} else {
+			val[0] = bool32(a.IPv6 && a.Protocol == header.ICMPv6ProtocolNumber)
+		}
+	case FieldTCP:
+		if network {
+			val[0] = bool32(info.TCP != nil)
+		} else {
+			val[0] = bool32(a.Protocol == header.TCPProtocolNumber)
+		}
+	case FieldUDP:
+		if network {
+			val[0] = bool32(info.UDP != nil)
+		} else {
+			val[0] = bool32(a.Protocol == header.UDPProtocolNumber)
+		}
+	case FieldIPHdrLength:
+		val[0] = uint32(info.IPv4[0] & 0x0F)
+	case FieldIPTOS:
+		val[0] = uint32(info.IPv4[1])
+	case FieldIPLength:
+		val[0] = uint32(be16(info.IPv4[2:]))
+	case FieldIPId:
+		val[0] = uint32(be16(info.IPv4[4:]))
+	case FieldIPDF:
+		val[0] = uint32(info.IPv4[6]>>6) & 1
+	case FieldIPMF:
+		val[0] = uint32(info.IPv4[6]>>5) & 1
+	case FieldIPFragOff:
+		val[0] = uint32(be16(info.IPv4[6:]) & 0x1FFF)
+	case FieldIPTTL:
+		val[0] = uint32(info.IPv4[8])
+	case FieldIPProtocol:
+		val[0] = uint32(info.IPv4[9])
+	case FieldIPChecksum:
+		val[0] = uint32(be16(info.IPv4[10:]))
+	case FieldIPSrcAddr:
+		big = true
+		ipv4Addr(info.IPv4[12:], val)
+	case FieldIPDstAddr:
+		big = true
+		ipv4Addr(info.IPv4[16:], val)
+	case FieldIPv6TrafficClass:
+		val[0] = uint32(info.IPv6[0]&0x0F)<<4 | uint32(info.IPv6[1]>>4)
+	case FieldIPv6FlowLabel:
+		// WINDIVERT_IPV6HDR_GET_FLOWLABEL combines the label bits in
+		// memory order and the driver byte swaps the result, evaluate it
+		// the same way to match the driver.
+		v := uint32(info.IPv6[1]&0x0F)<<16 | uint32(info.IPv6[2]) | uint32(info.IPv6[3])<<8
+		val[0] = v<<24 | v<<8&0x00FF0000 | v>>8&0x0000FF00 | v>>24
+	case FieldIPv6Length:
+		val[0] = uint32(be16(info.IPv6[4:]))
+	case FieldIPv6NextHdr:
+		val[0] = uint32(info.IPv6[6])
+	case FieldIPv6HopLimit:
+		val[0] = uint32(info.IPv6[7])
+	case FieldIPv6SrcAddr:
+		big = true
+		ipv6Addr(info.IPv6[8:], val)
+	case FieldIPv6DstAddr:
+		big = true
+		ipv6Addr(info.IPv6[24:], val)
+	case FieldICMPType:
+		val[0] = uint32(info.ICMPv4[0])
+	case FieldICMPCode:
+		val[0] = uint32(info.ICMPv4[1])
+	case FieldICMPChecksum:
+		val[0] = uint32(be16(info.ICMPv4[2:]))
+	case FieldICMPBody:
+		val[0] = be32(info.ICMPv4[4:])
+	case FieldICMPv6Type:
+		val[0] = uint32(info.ICMPv6[0])
+	case FieldICMPv6Code:
+		val[0] = uint32(info.ICMPv6[1])
+	case FieldICMPv6Checksum:
+		val[0] = uint32(be16(info.ICMPv6[2:]))
+	case FieldICMPv6Body:
+		val[0] = be32(info.ICMPv6[4:])
+	case FieldTCPSrcPort:
+		val[0] = uint32(be16(info.TCP[0:]))
+	case FieldTCPDstPort:
+		val[0] = uint32(be16(info.TCP[2:]))
+	case FieldTCPSeqNum:
+		val[0] = be32(info.TCP[4:])
+	case FieldTCPAckNum:
+		val[0] = be32(info.TCP[8:])
+	case FieldTCPHdrLength:
+		val[0] = uint32(info.TCP[12] >> 4)
+	case FieldTCPUrg:
+		val[0] = uint32(info.TCP[13]>>5) & 1
+	case FieldTCPAck:
+		val[0] = uint32(info.TCP[13]>>4) & 1
+	case FieldTCPPsh:
+		val[0] = uint32(info.TCP[13]>>3) & 1
+	case FieldTCPRst:
+		val[0] = uint32(info.TCP[13]>>2) & 1
+	case FieldTCPSyn:
+		val[0] = uint32(info.TCP[13]>>1) & 1
+	case FieldTCPFin:
+		val[0] = uint32(info.TCP[13]) & 1
+	case FieldTCPWindow:
+		val[0] = uint32(be16(info.TCP[14:]))
+	case FieldTCPChecksum:
+		val[0] = uint32(be16(info.TCP[16:]))
+	case FieldTCPUrgPtr:
+		val[0] = uint32(be16(info.TCP[18:]))
+	case FieldTCPPayloadLength, FieldUDPPayloadLength:
+		val[0] = uint32(len(info.Payload))
+	case FieldUDPSrcPort:
+		val[0] = uint32(be16(info.UDP[0:]))
+	case FieldUDPDstPort:
+		val[0] = uint32(be16(info.UDP[2:]))
+	case FieldUDPLength:
+		val[0] = uint32(be16(info.UDP[4:]))
+	case FieldUDPChecksum:
+		val[0] = uint32(be16(info.UDP[6:]))
+	case FieldLocalAddr, FieldRemoteAddr:
+		big = true
+		local := in.field == FieldLocalAddr
+		switch layer {
+		case LayerNetwork:
+			// The local address is the source of outbound packets.
+			src := local == a.Outbound
+			switch {
+			case info.IPv4 != nil && src:
+				ipv4Addr(info.IPv4[12:], val)
+			case info.IPv4 != nil:
+				ipv4Addr(info.IPv4[16:], val)
+			case info.IPv6 != nil && src:
+				ipv6Addr(info.IPv6[8:], val)
+			case info.IPv6 != nil:
+				ipv6Addr(info.IPv6[24:], val)
+			}
+		case LayerFlow, LayerSocket:
+			if local {
+				*val = a.LocalAddr
+			} else {
+				*val = a.RemoteAddr
+			}
+		default:
+			ok = false
+		}
+	case FieldLocalPort, FieldRemotePort:
+		local := in.field == FieldLocalPort
+		switch layer {
+		case LayerNetwork:
+			src := local == a.Outbound
+			switch {
+			case info.TCP != nil && src:
+				val[0] = uint32(be16(info.TCP[0:]))
+			case info.TCP != nil:
+				val[0] = uint32(be16(info.TCP[2:]))
+			case info.UDP != nil && src:
+				val[0] = uint32(be16(info.UDP[0:]))
+			case info.UDP != nil:
+				val[0] = uint32(be16(info.UDP[2:]))
+			case info.ICMPv4 != nil && src:
+				val[0] = uint32(info.ICMPv4[0])
+			case info.ICMPv6 != nil && src:
+				val[0] = uint32(info.ICMPv6[0])
+			}
+		case LayerFlow, LayerSocket:
+			if local {
+				val[0] = uint32(a.LocalPort)
+			} else {
+				val[0] = uint32(a.RemotePort)
+			}
+		default:
+			ok = false
+		}
+	case FieldProtocol:
+		switch layer {
+		case LayerNetwork:
+			val[0] = uint32(info.Protocol)
+		case LayerFlow, LayerSocket:
+			val[0] = uint32(a.Protocol)
+		default:
+			ok = false
+		}
+	case FieldProcessID:
+		val[0] = a.ProcessID
+	case FieldEndpointID:
+		big = true
+		val[0], val[1] = uint32(a.EndpointID), uint32(a.EndpointID>>32)
+	case FieldParentEndpointID:
+		big = true
+		val[0], val[1] = uint32(a.ParentEndpointID), uint32(a.ParentEndpointID>>32)
+	case FieldLayer:
+		val[0] = uint32(a.ReflectLayer)
+	case FieldPriority:
+		neg = a.Priority < 0
+		p := int32(a.Priority)
+		if neg {
+			p = -p
+		}
+		val[0] = uint32(p)
+	default:
+		ok = false
+	}
+	return
+}
@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/imgk/divert-go/header"
+)
+
+// testPacket is a packet for Eval with its address.
+type testPacket struct {
+	name   string
+	packet []byte
+	addr   Address
+}
+
+func buildPacket(t testing.TB, b header.Builder) []byte {
+	t.Helper()
+	pkt, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+// testPackets returns outbound TCP, UDP and ICMP packets over IPv4 and
+// IPv6 at the network layer.
+func testPackets(t testing.TB) []testPacket {
+	src4, dst4 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+	src6, dst6 := netip.MustParseAddr("fe80::1"), netip.MustParseAddr("2001:db8::2")
+	ipv4 := &header.IPv4Fields{ID: 1, TTL: 32, SrcAddr: src4, DstAddr: dst4}
+	ipv6 := &header.IPv6Fields{HopLimit: 32, SrcAddr: src6, DstAddr: dst6}
+	payload := []byte{0x16, 0x03, 0x01, 0x00}
+
+	pkts := []testPacket{
+		{name: "tcp4", packet: buildPacket(t, header.Builder{Network: ipv4, Transport: &header.TCPFields{SrcPort: 40000, DstPort: 80, Flags: header.TCPFlagSyn}, Payload: payload})},
+		{name: "udp4", packet: buildPacket(t, header.Builder{Network: ipv4, Transport: &header.UDPFields{SrcPort: 40000, DstPort: 53}, Payload: payload})},
+		{name: "icmp4", packet: buildPacket(t, header.Builder{Network: ipv4, Transport: &header.ICMPv4Fields{Type: 8, Body: 0x00010002}})},
+		{name: "tcp6", packet: buildPacket(t, header.Builder{Network: ipv6, Transport: &header.TCPFields{SrcPort: 40000, DstPort: 443, Flags: header.TCPFlagAck}, Payload: payload})},
+		{name: "udp6", packet: buildPacket(t, header.Builder{Network: ipv6, Transport: &header.UDPFields{SrcPort: 53, DstPort: 40000}})},
+		{name: "icmp6", packet: buildPacket(t, header.Builder{Network: ipv6, Transport: &header.ICMPv6Fields{Type: 128, Body: 0x00010002}})},
+	}
+	for i := range pkts {
+		pkts[i].addr = Address{Layer: LayerNetwork, Outbound: true, IfIdx: 5, IPv6: i >= 3}
+	}
+	return pkts
+}
+
+// The results below were produced by WinDivertHelperEvalFilter of
+// divert/windivert_helper.c, one per packet of testPackets: tcp4, udp4,
+// icmp4, tcp6, udp6 and icmp6.
+var evalTests = []struct {
+	filter string
+	want   string
+}{
+	{"true", "111111"},
+	{"tcp", "100100"},
+	{"udp", "010010"},
+	{"icmp or icmpv6", "001001"},
+	{"ip", "111000"},
+	{"ipv6", "000111"},
+	{"tcp.DstPort == 80", "100000"},
+	{"tcp.DstPort != 80", "000100"},
+	{"not tcp.DstPort == 80", "000100"},
+	{"tcp.DstPort == 80 or tcp.DstPort != 80", "100100"},
+	{"tcp.DstPort == 80 or not tcp.DstPort == 80", "100100"},
+	{"(tcp.DstPort == 80 ? false : udp)", "010010"},
+	{"(tcp ? tcp.DstPort == 80 : true)", "111011"},
+	{"udp.DstPort == 53 and outbound", "010000"},
+	{"ip.DstAddr == 10.0.0.2", "111000"},
+	{"ip.DstAddr != 10.0.0.2", "000000"},
+	{"ipv6.SrcAddr == fe80::1", "000111"},
+	{"ip.TTL > 16 or ipv6.HopLimit > 16", "111111"},
+	{"tcp.Syn", "100000"},
+	{"not tcp.Syn", "000100"},
+	{"tcp.Payload[0] == 0x16", "100100"},
+	{"tcp.PayloadLength == 4", "100100"},
+	{"udp.PayloadLength > 0", "010000"},
+	{"icmp.Type == 8", "001000"},
+	{"icmpv6.Type == 128", "000001"},
+	{"ifIdx == 5 and not inbound", "111111"},
+	{"packet[0] == 0x45", "111000"},
+	{"packet32[-4] == 0x16030100", "000000"},
+	{"length == 44", "100000"},
+	{"tcp.Payload[10] == 0", "000000"},
+	{"not tcp.Payload[10] == 0", "000000"},
+	{"tcp.Payload[10] != 0", "000000"},
+}
+
+func TestEvalFilter(t *testing.T) {
+	pkts := testPackets(t)
+	for _, tt := range evalTests {
+		p, err := Compile(tt.filter, LayerNetwork)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.filter, err)
+			continue
+		}
+		for i, tp := range pkts {
+			ok, err := p.Eval(tp.packet, &tp.addr)
+			if err != nil {
+				t.Errorf("Eval(%q, %s): %v", tt.filter, tp.name, err)
+				continue
+			}
+			if want := tt.want[i] == '1'; ok != want {
+				t.Errorf("Eval(%q, %s) = %v, want %v", tt.filter, tp.name, ok, want)
+			}
+		}
+	}
+}
+
+func TestEvalAllocs(t *testing.T) {
+	p, err := Compile("outbound and (tcp.DstPort == 80 or udp.DstPort == 53) and ip.DstAddr == 10.0.0.2 and tcp.Payload[0] == 0x16", LayerNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tp := range testPackets(t) {
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := p.Eval(tp.packet, &tp.addr); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("Eval(%s) allocates %v times, want 0", tp.name, allocs)
+		}
+	}
+}
+
+func BenchmarkEval(b *testing.B) {
+	p, err := Compile("outbound and (tcp.DstPort == 80 or udp.DstPort == 53) and ip.DstAddr == 10.0.0.2", LayerNetwork)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tp := testPackets(b)[0]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		p.Eval(tp.packet, &tp.addr)
+	}
+}
@@ -0,0 +1,261 @@
+package filter
+
+// Field is a filter field such as tcp.DstPort.
+//
+// The values up to FieldFragment are identical to the
+// WINDIVERT_FILTER_FIELD_* constants used in compiled filter objects.
+type Field int
+
+const (
+	FieldZero             Field = 0
+	FieldInbound          Field = 1
+	FieldOutbound         Field = 2
+	FieldIfIdx            Field = 3
+	FieldSubIfIdx         Field = 4
+	FieldIP               Field = 5
+	FieldIPv6             Field = 6
+	FieldICMP             Field = 7
+	FieldTCP              Field = 8
+	FieldUDP              Field = 9
+	FieldICMPv6           Field = 10
+	FieldIPHdrLength      Field = 11
+	FieldIPTOS            Field = 12
+	FieldIPLength         Field = 13
+	FieldIPId             Field = 14
+	FieldIPDF             Field = 15
+	FieldIPMF             Field = 16
+	FieldIPFragOff        Field = 17
+	FieldIPTTL            Field = 18
+	FieldIPProtocol       Field = 19
+	FieldIPChecksum       Field = 20
+	FieldIPSrcAddr        Field = 21
+	FieldIPDstAddr        Field = 22
+	FieldIPv6TrafficClass Field = 23
+	FieldIPv6FlowLabel    Field = 24
+	FieldIPv6Length       Field = 25
+	FieldIPv6NextHdr      Field = 26
+	FieldIPv6HopLimit     Field = 27
+	FieldIPv6SrcAddr      Field = 28
+	FieldIPv6DstAddr      Field = 29
+	FieldICMPType         Field = 30
+	FieldICMPCode         Field = 31
+	FieldICMPChecksum     Field = 32
+	FieldICMPBody         Field = 33
+	FieldICMPv6Type       Field = 34
+	FieldICMPv6Code       Field = 35
+	FieldICMPv6Checksum   Field = 36
+	FieldICMPv6Body       Field = 37
+	FieldTCPSrcPort       Field = 38
+	FieldTCPDstPort       Field = 39
+	FieldTCPSeqNum        Field = 40
+	FieldTCPAckNum        Field = 41
+	FieldTCPHdrLength     Field = 42
+	FieldTCPUrg           Field = 43
+	FieldTCPAck           Field = 44
+	FieldTCPPsh           Field = 45
+	FieldTCPRst           Field = 46
+	FieldTCPSyn           Field = 47
+	FieldTCPFin           Field = 48
+	FieldTCPWindow        Field = 49
+	FieldTCPChecksum      Field = 50
+	FieldTCPUrgPtr        Field = 51
+	FieldTCPPayloadLength Field = 52
+	FieldUDPSrcPort       Field = 53
+	FieldUDPDstPort       Field = 54
+	FieldUDPLength        Field = 55
+	FieldUDPChecksum      Field = 56
+	FieldUDPPayloadLength Field = 57
+	FieldLoopback         Field = 58
+	FieldImpostor         Field = 59
+	FieldProcessID        Field = 60
+	FieldLocalAddr        Field = 61
+	FieldRemoteAddr       Field = 62
+	FieldLocalPort        Field = 63
+	FieldRemotePort       Field = 64
+	FieldProtocol         Field = 65
+	FieldEndpointID       Field = 66
+	FieldParentEndpointID Field = 67
+	FieldLayer            Field = 68
+	FieldPriority         Field = 69
+	FieldEvent            Field = 70
+	FieldPacket           Field = 71
+	FieldPacket16         Field = 72
+	FieldPacket32         Field = 73
+	FieldTCPPayload       Field = 74
+	FieldTCPPayload16     Field = 75
+	FieldTCPPayload32     Field = 76
+	FieldUDPPayload       Field = 77
+	FieldUDPPayload16     Field = 78
+	FieldUDPPayload32     Field = 79
+	FieldLength           Field = 80
+	FieldTimestamp        Field = 81
+	FieldRandom8          Field = 82
+	FieldRandom16         Field = 83
+	FieldRandom32         Field = 84
+	FieldFragment         Field = 85
+
+	// FieldTrue and FieldFalse are the constant fields true and false.
+	// They are always folded away and never appear in a filter object.
+	FieldTrue  Field = 86
+	FieldFalse Field = 87
+)
+
+// fieldMax is WINDIVERT_FILTER_FIELD_MAX.
+const fieldMax = FieldFragment
+
+// format is how the value of a test is printed.
+type format uint8
+
+const (
+	formatDec format = iota
+	formatBool
+	formatHex
+	formatIPv4
+	formatIPv6
+	formatLayer
+	formatEvent
+)
+
+type fieldInfo struct {
+	name   string
+	layers layerMask
+	// size is the element size of array fields, e.g. 2 for packet16.
+	size   int
+	format format
+}
+
+var fields = [...]fieldInfo{
+	FieldZero:             {"zero", lNMFSR, 0, formatBool},
+	FieldInbound:          {"inbound", lN_FS_, 0, formatBool},
+	FieldOutbound:         {"outbound", lN_FS_, 0, formatBool},
+	FieldIfIdx:            {"ifIdx", lNM___, 0, formatDec},
+	FieldSubIfIdx:         {"subIfIdx", lNM___, 0, formatDec},
+	FieldIP:               {"ip", lNMFS_, 0, formatBool},
+	FieldIPv6:             {"ipv6", lNMFS_, 0, formatBool},
+	FieldICMP:             {"icmp", lNMFS_, 0, formatBool},
+	FieldTCP:              {"tcp", lNMFS_, 0, formatBool},
+	FieldUDP:              {"udp", lNMFS_, 0, formatBool},
+	FieldICMPv6:           {"icmpv6", lNMFS_, 0, formatBool},
+	FieldIPHdrLength:      {"ip.HdrLength", lNM___, 0, formatDec},
+	FieldIPTOS:            {"ip.TOS", lNM___, 0, formatDec},
+	FieldIPLength:         {"ip.Length", lNM___, 0, formatDec},
+	FieldIPId:             {"ip.Id", lNM___, 0, formatHex},
+	FieldIPDF:             {"ip.DF", lNM___, 0, formatBool},
+	FieldIPMF:             {"ip.MF", lNM___, 0, formatBool},
+	FieldIPFragOff:        {"ip.FragOff", lNM___, 0, formatDec},
+	FieldIPTTL:            {"ip.TTL", lNM___, 0, formatDec},
+	FieldIPProtocol:       {"ip.Protocol", lNM___, 0, formatDec},
+	FieldIPChecksum:       {"ip.Checksum", lNM___, 0, formatHex},
+	FieldIPSrcAddr:        {"ip.SrcAddr", lNM___, 0, formatIPv4},
+	FieldIPDstAddr:        {"ip.DstAddr", lNM___, 0, formatIPv4},
+	FieldIPv6TrafficClass: {"ipv6.TrafficClass", lNM___, 0, formatDec},
+	FieldIPv6FlowLabel:    {"ipv6.FlowLabel", lNM___, 0, formatDec},
+	FieldIPv6Length:       {"ipv6.Length", lNM___, 0, formatDec},
+	FieldIPv6NextHdr:      {"ipv6.NextHdr", lNM___, 0, formatDec},
+	FieldIPv6HopLimit:     {"ipv6.HopLimit", lNM___, 0, formatDec},
+	FieldIPv6SrcAddr:      {"ipv6.SrcAddr", lNM___, 0, formatIPv6},
+	FieldIPv6DstAddr:      {"ipv6.DstAddr", lNM___, 0, formatIPv6},
+	FieldICMPType:         {"icmp.Type", lNM___, 0, formatDec},
+	FieldICMPCode:         {"icmp.Code", lNM___, 0, formatDec},
+	FieldICMPChecksum:     {"icmp.Checksum", lNM___, 0, formatHex},
+	FieldICMPBody:         {"icmp.Body", lNM___, 0, formatDec},
+	FieldICMPv6Type:       {"icmpv6.Type", lNM___, 0, formatDec},
+	FieldICMPv6Code:       {"icmpv6.Code", lNM___, 0, formatDec},
+	FieldICMPv6Checksum:   {"icmpv6.Checksum", lNM___, 0, formatHex},
+	FieldICMPv6Body:       {"icmpv6.Body", lNM___, 0, formatDec},
+	FieldTCPSrcPort:       {"tcp.SrcPort", lNM___, 0, formatDec},
+	FieldTCPDstPort:       {"tcp.DstPort", lNM___, 0, formatDec},
+	FieldTCPSeqNum:        {"tcp.SeqNum", lNM___, 0, formatDec},
+	FieldTCPAckNum:        {"tcp.AckNum", lNM___, 0, formatDec},
+	FieldTCPHdrLength:     {"tcp.HdrLength", lNM___, 0, formatDec},
+	FieldTCPUrg:           {"tcp.Urg", lNM___, 0, formatBool},
+	FieldTCPAck:           {"tcp.Ack", lNM___, 0, formatBool},
+	FieldTCPPsh:           {"tcp.Psh", lNM___, 0, formatBool},
+	FieldTCPRst:           {"tcp.Rst", lNM___, 0, formatBool},
+	FieldTCPSyn:           {"tcp.Syn", lNM___, 0, formatBool},
+	FieldTCPFin:           {"tcp.Fin", lNM___, 0, formatBool},
+	FieldTCPWindow:        {"tcp.Window", lNM___, 0, formatDec},
+	FieldTCPChecksum:      {"tcp.Checksum", lNM___, 0, formatHex},
+	FieldTCPUrgPtr:        {"tcp.UrgPtr", lNM___, 0, formatDec},
+	FieldTCPPayloadLength: {"tcp.PayloadLength", lNM___, 0, formatDec},
+	FieldUDPSrcPort:       {"udp.SrcPort", lNM___, 0, formatDec},
+	FieldUDPDstPort:       {"udp.DstPort", lNM___, 0, formatDec},
+	FieldUDPLength:        {"udp.Length", lNM___, 0, formatDec},
+	FieldUDPChecksum:      {"udp.Checksum", lNM___, 0, formatHex},
+	FieldUDPPayloadLength: {"udp.PayloadLength", lNM___, 0, formatDec},
+	FieldLoopback:         {"loopback", lN_FS_, 0, formatBool},
+	FieldImpostor:         {"impostor", lNM___, 0, formatBool},
+	FieldProcessID:        {"processId", l__FSR, 0, formatDec},
+	FieldLocalAddr:        {"localAddr", lN_FS_, 0, formatIPv6},
+	FieldRemoteAddr:       {"remoteAddr", lN_FS_, 0, formatIPv6},
+	FieldLocalPort:        {"localPort", lN_FS_, 0, formatDec},
+	FieldRemotePort:       {"remotePort", lN_FS_, 0, formatDec},
+	FieldProtocol:         {"protocol", lN_FS_, 0, formatDec},
+	FieldEndpointID:       {"endpointId", l__FS_, 0, formatDec},
+	FieldParentEndpointID: {"parentEndpointId", l__FS_, 0, formatDec},
+	FieldLayer:            {"layer", l____R, 0, formatLayer},
+	FieldPriority:         {"priority", l____R, 0, formatDec},
+	FieldEvent:            {"event", lNMFSR, 0, formatEvent},
+	FieldPacket:           {"packet", lNM___, 1, formatHex},
+	FieldPacket16:         {"packet16", lNM___, 2, formatHex},
+	FieldPacket32:         {"packet32", lNM___, 4, formatHex},
+	FieldTCPPayload:       {"tcp.Payload", lNM___, 1, formatHex},
+	FieldTCPPayload16:     {"tcp.Payload16", lNM___, 2, formatHex},
+	FieldTCPPayload32:     {"tcp.Payload32", lNM___, 4, formatHex},
+	FieldUDPPayload:       {"udp.Payload", lNM___, 1, formatHex},
+	FieldUDPPayload16:     {"udp.Payload16", lNM___, 2, formatHex},
+	FieldUDPPayload32:     {"udp.Payload32", lNM___, 4, formatHex},
+	FieldLength:           {"length", lNM___, 0, formatDec},
+	FieldTimestamp:        {"timestamp", lNMFSR, 0, formatDec},
+	FieldRandom8:          {"random8", lNM___, 0, formatDec},
+	FieldRandom16:         {"random16", lNM___, 0, formatDec},
+	FieldRandom32:         {"random32", lNM___, 0, formatDec},
+	FieldFragment:         {"fragment", lNM___, 0, formatBool},
+	FieldTrue:             {"true", lNMFSR, 0, formatBool},
+	FieldFalse:            {"false", lNMFSR, 0, formatBool},
+}
+
+// String returns the name of the field as written in a filter.
+func (f Field) String() string {
+	if f < 0 || int(f) >= len(fields) {
+		return ""
+	}
+	return fields[f].name
+}
+
+// IsArray reports whether the field is indexed, e.g. packet[0].
+func (f Field) IsArray() bool {
+	return f >= 0 && int(f) < len(fields) && fields[f].size != 0
+}
+
+// ValidFor reports whether the field may be used at layer l.
+func (f Field) ValidFor(l Layer) bool {
+	if f < 0 || int(f) >= len(fields) {
+		return false
+	}
+	return fields[f].layers.has(l)
+}
+
+// header returns the field testing for the header f belongs to, e.g.
+// FieldTCP for FieldTCPDstPort, or FieldZero if every packet has f. Like
+// in WinDivert, a test on f is false whatever its operator for packets
+// without the header.
+func (f Field) header() Field {
+	switch {
+	case f >= FieldIPHdrLength && f <= FieldIPDstAddr:
+		return FieldIP
+	case f >= FieldIPv6TrafficClass && f <= FieldIPv6DstAddr:
+		return FieldIPv6
+	case f >= FieldICMPType && f <= FieldICMPBody:
+		return FieldICMP
+	case f >= FieldICMPv6Type && f <= FieldICMPv6Body:
+		return FieldICMPv6
+	case f >= FieldTCPSrcPort && f <= FieldTCPPayloadLength,
+		f >= FieldTCPPayload && f <= FieldTCPPayload32:
+		return FieldTCP
+	case f >= FieldUDPSrcPort && f <= FieldUDPPayloadLength,
+		f >= FieldUDPPayload && f <= FieldUDPPayload32:
+		return FieldUDP
+	}
+	return FieldZero
+}
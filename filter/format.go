@@ -0,0 +1,215 @@
+package filter
+
+// maxFormatNodes bounds the size of a decompiled expression. Tests shared
+// by many paths of a crafted object would otherwise be repeated an
+// exponential number of times.
+const maxFormatNodes = 1 << 16
+
+// FormatFilter turns a filter object, such as one returned by CompileFilter
+// or carried by a reflect layer event, back into a normalized filter
+// string the way WinDivertHelperFormatFilter does. A filter string is
+// compiled first, so formatting also normalizes filter strings.
+func FormatFilter(object []byte, layer Layer) (string, error) {
+	f, err := Decompile(object, layer)
+	if err != nil {
+		return "", err
+	}
+	return f.String(), nil
+}
+
+// Decompile is like FormatFilter but returns the expression instead of
+// its string.
+func Decompile(object []byte, layer Layer) (*Filter, error) {
+	return decompile(string(object), layer)
+}
+
+// node is a decompiled test, or a coalesced expression, with the labels
+// it continues at and the number of tests jumping to it.
+type node struct {
+	expr       Expr
+	succ, fail uint16
+	count      int
+}
+
+var (
+	trueExpr  = &Test{Field: FieldTrue, Op: OpNeq}
+	falseExpr = &Test{Field: FieldFalse, Op: OpNeq}
+)
+
+// decompile compiles filter and rebuilds an expression from the object
+// by coalescing its jumps into and, or and ?: expressions.
+func decompile(filter string, layer Layer) (*Filter, error) {
+	prog, err := compile(filter, layer)
+	if err != nil {
+		return nil, err
+	}
+
+	d := decompiler{nodes: make([]*node, len(prog)), budget: maxFormatNodes}
+	for i := len(prog) - 1; i >= 0; i-- {
+		n := decompileTest(&prog[i])
+		d.nodes[i] = n
+		d.ref(n.succ)
+		d.ref(n.fail)
+	}
+	d.nodes[0].count++
+
+	for i := len(prog) - 1; i >= 0; i-- {
+		d.coalesceAndOr(i)
+	}
+	expr := d.coalesce(0)
+	if expr == nil {
+		if d.budget < 0 {
+			return nil, newError(errTooLong, 0, "")
+		}
+		return nil, newError(errBadObject, 0, "")
+	}
+	return &Filter{Layer: layer, Expr: expr}, nil
+}
+
+// decompileTest is WinDivertDecompileTest.
+func decompileTest(in *insn) *node {
+	t := &Test{Field: in.field, Op: in.op}
+	if in.field.IsArray() {
+		t.Index = int(int32(in.arg[1]))
+		t.Value.Val[0] = in.arg[0]
+	} else {
+		t.Value = Value{Neg: in.neg, Val: in.arg}
+	}
+	return &node{expr: t, succ: in.success, fail: in.failure}
+}
+
+type decompiler struct {
+	nodes  []*node
+	budget int
+}
+
+func isResult(l uint16) bool {
+	return l == resultAccept || l == resultReject
+}
+
+// at returns the node labelled l, nil for results and removed nodes.
+func (d *decompiler) at(l uint16) *node {
+	if isResult(l) {
+		return nil
+	}
+	return d.nodes[l]
+}
+
+func (d *decompiler) ref(l uint16) {
+	if n := d.at(l); n != nil {
+		n.count++
+	}
+}
+
+// deref is WinDivertDerefExpr.
+func (d *decompiler) deref(l uint16) {
+	if n := d.at(l); n != nil {
+		n.count--
+		if n.count == 0 {
+			d.nodes[l] = nil
+		}
+	}
+}
+
+// andOr is WinDivertSimplifyAndOr, merging n with the test at next that
+// only n jumps to.
+func (d *decompiler) andOr(n *node, and bool, next, other uint16) *node {
+	nn := d.nodes[next]
+	op := OpOr
+	if and {
+		op = OpAnd
+	}
+	m := &node{expr: &BinaryExpr{Op: op, X: n.expr, Y: nn.expr}, succ: nn.succ, fail: nn.fail, count: n.count}
+	d.deref(next)
+	d.deref(other)
+	return m
+}
+
+// cond replaces n by (n.expr ? th : el) continuing like next.
+func (d *decompiler) cond(n *node, th, el Expr, next *node) *node {
+	m := &node{expr: &CondExpr{Cond: n.expr, Then: th, Else: el}, succ: next.succ, fail: next.fail, count: n.count}
+	d.deref(n.succ)
+	d.deref(n.fail)
+	return m
+}
+
+// coalesceAndOr is WinDivertCoalesceAndOr. It folds the tests the node at
+// i jumps to into it as long as they are not reachable otherwise.
+func (d *decompiler) coalesceAndOr(i int) {
+	n := d.nodes[i]
+	for {
+		if n == nil || n.count == 0 {
+			return
+		}
+
+		singleton := false
+		if next := d.at(n.succ); next != nil && next.count == 1 {
+			singleton = true
+			if next.fail == n.fail {
+				n = d.andOr(n, true, n.succ, n.fail)
+				continue
+			}
+			if next.succ == n.fail {
+				n = d.cond(n, next.expr, trueExpr, next)
+				continue
+			}
+		}
+		if next := d.at(n.fail); next == nil || next.count != 1 {
+			singleton = false
+		} else {
+			if next.succ == n.succ {
+				n = d.andOr(n, false, n.fail, n.succ)
+				continue
+			}
+			if next.fail == n.succ {
+				n = d.cond(n, falseExpr, next.expr, next)
+				continue
+			}
+		}
+
+		if !singleton {
+			break
+		}
+		// Both branches are only reachable from n, simplify into (?:).
+		th, el := d.nodes[n.succ], d.nodes[n.fail]
+		if th.succ != el.succ || th.fail != el.fail {
+			break
+		}
+		m := &node{expr: &CondExpr{Cond: n.expr, Then: th.expr, Else: el.expr}, succ: th.succ, fail: el.fail, count: n.count}
+		d.deref(n.succ)
+		d.deref(n.fail)
+		d.deref(m.succ)
+		d.deref(m.fail)
+		n = m
+	}
+	d.nodes[i] = n
+}
+
+// coalesce is WinDivertCoalesceExpr, joining the remaining nodes with ?:.
+func (d *decompiler) coalesce(l uint16) Expr {
+	switch l {
+	case resultAccept:
+		return trueExpr
+	case resultReject:
+		return falseExpr
+	}
+	if d.budget--; d.budget < 0 {
+		return nil
+	}
+	n := d.nodes[l]
+	if n == nil {
+		return nil
+	}
+	if n.succ == n.fail {
+		return d.coalesce(n.succ)
+	}
+	th := d.coalesce(n.succ)
+	el := d.coalesce(n.fail)
+	if th == nil || el == nil {
+		return nil
+	}
+	if th == trueExpr && el == falseExpr {
+		return n.expr
+	}
+	return &CondExpr{Cond: n.expr, Then: th, Else: el}
+}
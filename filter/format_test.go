@@ -0,0 +1,99 @@
+package filter
+
+import "testing"
+
+// The formatted filters below were produced by WinDivertHelperFormatFilter
+// of divert/windivert_helper.c from the objects of
+// WinDivertHelperCompileFilter.
+
+var formatTests = []struct {
+	layer     Layer
+	filter    string
+	formatted string
+}{
+	{LayerNetwork, "true", "true"},
+	{LayerNetwork, "false", "false"},
+	{LayerNetwork, "tcp", "tcp"},
+	{LayerNetwork, "tcp.DstPort == 80", "tcp.DstPort = 80"},
+	{LayerNetwork, "outbound and tcp.DstPort == 443", "outbound and tcp.DstPort = 443"},
+	{LayerNetwork, "udp.DstPort == 53 or udp.SrcPort == 53", "udp.DstPort = 53 or udp.SrcPort = 53"},
+	{LayerNetwork, "ip.DstAddr == 10.0.0.1", "ip.DstAddr = 10.0.0.1"},
+	{LayerNetwork, "ip.DstAddr >= 192.168.0.0 and ip.DstAddr <= 192.168.255.255", "ip.DstAddr >= 192.168.0.0 and ip.DstAddr <= 192.168.255.255"},
+	{LayerNetwork, "ipv6.DstAddr == ::1", "ipv6.DstAddr = ::1"},
+	{LayerNetwork, "ipv6.SrcAddr == fe80::1:2:3:4", "ipv6.SrcAddr = fe80::1:2:3:4"},
+	{LayerNetwork, "tcp.Syn and !tcp.Ack", "tcp.Syn and not tcp.Ack"},
+	{LayerNetwork, "(tcp ? tcp.DstPort == 80 : udp.DstPort == 53)", "(tcp? tcp.DstPort = 80: udp.DstPort = 53)"},
+	{LayerNetwork, "tcp.PayloadLength > 0 and tcp.Payload[0] == 0x16", "tcp.PayloadLength > 0 and tcp.Payload[0b] = 0x16"},
+	{LayerNetwork, "tcp.Payload32[-4] == 0xdeadbeef", "tcp.Payload32[-16b] = 0xdeadbeef"},
+	{LayerNetwork, "packet[0] == 0x45", "packet[0b] = 0x45"},
+	{LayerNetwork, "packet16[2] > 100", "packet16[4b] > 0x64"},
+	{LayerNetwork, "ip.TTL < 64 || ipv6.HopLimit < 64", "ip.TTL < 64 or ipv6.HopLimit < 64"},
+	{LayerNetwork, "icmp.Type == 8 and icmp.Code == 0", "icmp.Type = 8 and icmp.Code = 0"},
+	{LayerNetwork, "icmpv6.Type == 128", "icmpv6.Type = 128"},
+	{LayerNetwork, "ifIdx == 5 and subIfIdx == 0", "ifIdx = 5 and subIfIdx = 0"},
+	{LayerNetwork, "loopback or impostor", "loopback or impostor"},
+	{LayerNetwork, "length > 1000", "length > 1000"},
+	{LayerNetwork, "random8 < 128", "random8 < 128"},
+	{LayerNetwork, "ip.DstAddr == 10.0.0.1 and tcp.DstPort == 80 and tcp.SrcPort != 22 or udp", "(ip.DstAddr = 10.0.0.1 and tcp.DstPort = 80 and tcp.SrcPort != 22) or udp"},
+	{LayerNetwork, "ip.Protocol == TCP", "ip.Protocol = 6"},
+	{LayerNetwork, "zero == 0", "true"},
+	{LayerFlow, "processId == 4 and remotePort == 443", "processId = 4 and remotePort = 443"},
+	{LayerFlow, "event == ESTABLISHED and tcp", "event = ESTABLISHED and tcp"},
+	{LayerSocket, "event == CONNECT and remoteAddr == 1.1.1.1", "event = CONNECT and remoteAddr = 1.1.1.1"},
+	{LayerSocket, "localAddr == ::1 and protocol == 17", "localAddr = ::1 and protocol = 17"},
+	{LayerReflect, "layer == NETWORK and priority > 0", "layer = NETWORK and priority > 0"},
+	{LayerNetworkForward, "ip.DstAddr == 8.8.8.8", "ip.DstAddr = 8.8.8.8"},
+	{LayerNetwork, "(tcp.DstPort == 80 or tcp.DstPort == 443) and (ip.SrcAddr == 1.2.3.4 or ipv6)", "(tcp.DstPort = 80 or tcp.DstPort = 443) and (ip.SrcAddr = 1.2.3.4 or ipv6)"},
+	{LayerNetwork, "tcp and (tcp.DstPort == 80 ? outbound : inbound) and not loopback", "tcp and (tcp.DstPort = 80? outbound: inbound) and not loopback"},
+	{LayerNetwork, "tcp.DstPort != 80 and udp.SrcPort >= 1024", "tcp.DstPort != 80 and udp.SrcPort >= 1024"},
+	{LayerNetwork, "ipv6.DstAddr == 2001:db8::1 or ipv6.DstAddr == ::ffff:1.2.3.4", "ipv6.DstAddr = 2001:db8::1 or ipv6.DstAddr = 1.2.3.4"},
+	{LayerNetwork, "udp.Payload16[0] == 0x1234 and udp.PayloadLength >= 2", "udp.Payload16[0b] = 0x1234 and udp.PayloadLength >= 2"},
+	{LayerNetwork, "ip.SrcAddr == 10.0.0.0 or ip.SrcAddr == 10.0.0.1 or ip.SrcAddr == 10.0.0.2 or ip.SrcAddr == 10.0.0.3", "ip.SrcAddr = 10.0.0.0 or ip.SrcAddr = 10.0.0.1 or ip.SrcAddr = 10.0.0.2 or ip.SrcAddr = 10.0.0.3"},
+	{LayerFlow, "localPort == 80 or remotePort == 80", "localPort = 80 or remotePort = 80"},
+	{LayerReflect, "event == OPEN and layer == FLOW", "event = OPEN and layer = FLOW"},
+}
+
+func TestFormatFilter(t *testing.T) {
+	for _, tt := range formatTests {
+		object, err := CompileFilter(tt.filter, tt.layer)
+		if err != nil {
+			t.Errorf("CompileFilter(%q, %v): %v", tt.filter, tt.layer, err)
+			continue
+		}
+		formatted, err := FormatFilter(object, tt.layer)
+		if err != nil {
+			t.Errorf("FormatFilter(%q, %v): %v", object, tt.layer, err)
+			continue
+		}
+		if formatted != tt.formatted {
+			t.Errorf("FormatFilter(%q, %v) = %q, want %q", object, tt.layer, formatted, tt.formatted)
+		}
+
+		// The formatted filter compiles to the same object.
+		again, err := CompileFilter(formatted, tt.layer)
+		if err != nil {
+			t.Errorf("CompileFilter(%q, %v): %v", formatted, tt.layer, err)
+			continue
+		}
+		if string(again) != string(object) {
+			t.Errorf("CompileFilter(%q, %v) = %q, want %q", formatted, tt.layer, again, object)
+		}
+	}
+}
+
+// The objects below are rejected by WinDivertHelperFormatFilter too.
+func TestFormatFilterBadObject(t *testing.T) {
+	for _, object := range []string{
+		"",
+		"@WinDiv_",
+		"@WinDiv_WX_",
+		"@WinDiv_WX_1dWW2m",
+		"@WinDiv_WX_1dWW2mAX_",
+		"@WinDiv_WX_1dWW2mAY",
+		"@WinDiv_WY_1dWW2mAX",
+	} {
+		if s, err := FormatFilter([]byte(object), LayerNetwork); err == nil {
+			t.Errorf("FormatFilter(%q) = %q, want error", object, s)
+		}
+	}
+}
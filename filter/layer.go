@@ -0,0 +1,60 @@
+package filter
+
+// Layer is the WinDivert layer a filter is written for.
+//
+// The values are identical to the WINDIVERT_LAYER_* constants, so a
+// divert.Layer can be converted with a plain type conversion.
+type Layer int
+
+const (
+	LayerNetwork        Layer = 0
+	LayerNetworkForward Layer = 1
+	LayerFlow           Layer = 2
+	LayerSocket         Layer = 3
+	LayerReflect        Layer = 4
+)
+
+// String returns the filter language name of the layer, e.g. NETWORK.
+func (l Layer) String() string {
+	switch l {
+	case LayerNetwork:
+		return "NETWORK"
+	case LayerNetworkForward:
+		return "NETWORK_FORWARD"
+	case LayerFlow:
+		return "FLOW"
+	case LayerSocket:
+		return "SOCKET"
+	case LayerReflect:
+		return "REFLECT"
+	default:
+		return ""
+	}
+}
+
+// layerMask is a set of layers, bit n is set for Layer(n).
+type layerMask uint8
+
+const (
+	maskNetwork        layerMask = 1 << LayerNetwork
+	maskNetworkForward layerMask = 1 << LayerNetworkForward
+	maskFlow           layerMask = 1 << LayerFlow
+	maskSocket         layerMask = 1 << LayerSocket
+	maskReflect        layerMask = 1 << LayerReflect
+
+	// shorthands as used by windivert_shared.c
+	lNMFSR = maskNetwork | maskNetworkForward | maskFlow | maskSocket | maskReflect
+	lNMFS_ = maskNetwork | maskNetworkForward | maskFlow | maskSocket
+	lN_FS_ = maskNetwork | maskFlow | maskSocket
+	l__FS_ = maskFlow | maskSocket
+	l__FSR = maskFlow | maskSocket | maskReflect
+	lNM___ = maskNetwork | maskNetworkForward
+	l____R = maskReflect
+)
+
+func (m layerMask) has(l Layer) bool {
+	if l < LayerNetwork || l > LayerReflect {
+		return false
+	}
+	return m&(1<<l) != 0
+}
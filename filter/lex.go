@@ -0,0 +1,363 @@
+package filter
+
+// tokenKind is the kind of a lexical token.
+type tokenKind uint8
+
+const (
+	tokenEnd tokenKind = iota
+	tokenField
+	tokenNumber
+	tokenMacro
+	tokenOpen
+	tokenClose
+	tokenSquareOpen
+	tokenSquareClose
+	tokenMinus
+	tokenBytes
+	tokenEq
+	tokenNeq
+	tokenLt
+	tokenLeq
+	tokenGt
+	tokenGeq
+	tokenNot
+	tokenAnd
+	tokenOr
+	tokenColon
+	tokenQuestion
+)
+
+// token is a lexical token of a filter string.
+type token struct {
+	kind  tokenKind
+	pos   int
+	end   int
+	field Field
+	val   [4]uint32
+}
+
+// maxTokenLen is TOKEN_MAXLEN of windivert_helper.c.
+const maxTokenLen = 40
+
+// maxTokens is the size of the token buffer used by WinDivertCompileFilter.
+const maxTokens = 5*maxLength - 1
+
+// macro is a named constant such as TCP or ESTABLISHED.
+type macro uint8
+
+const (
+	macroNetwork macro = iota
+	macroNetworkForward
+	macroFlow
+	macroSocket
+	macroReflect
+	macroPacket
+	macroEstablished
+	macroDeleted
+	macroBind
+	macroConnect
+	macroListen
+	macroAccept
+	macroOpen
+	macroClose
+	macroTrue
+	macroFalse
+	macroTCP
+	macroUDP
+	macroICMP
+	macroICMPv6
+)
+
+// expand returns the value of the macro at layer l, the event macros are
+// only defined at the layers generating the event.
+func (m macro) expand(l Layer) (uint32, bool) {
+	switch m {
+	case macroNetwork:
+		return uint32(LayerNetwork), true
+	case macroNetworkForward:
+		return uint32(LayerNetworkForward), true
+	case macroFlow:
+		return uint32(LayerFlow), true
+	case macroSocket:
+		return uint32(LayerSocket), true
+	case macroReflect:
+		return uint32(LayerReflect), true
+	case macroPacket:
+		return eventNetworkPacket, l == LayerNetwork || l == LayerNetworkForward
+	case macroEstablished:
+		return eventFlowEstablished, l == LayerFlow
+	case macroDeleted:
+		return eventFlowDeleted, l == LayerFlow
+	case macroBind:
+		return eventSocketBind, l == LayerSocket
+	case macroConnect:
+		return eventSocketConnect, l == LayerSocket
+	case macroListen:
+		return eventSocketListen, l == LayerSocket
+	case macroAccept:
+		return eventSocketAccept, l == LayerSocket
+	case macroOpen:
+		return eventReflectOpen, l == LayerReflect
+	case macroClose:
+		switch l {
+		case LayerSocket:
+			return eventSocketClose, true
+		case LayerReflect:
+			return eventReflectClose, true
+		default:
+			return 0, false
+		}
+	case macroTrue:
+		return 1, true
+	case macroFalse:
+		return 0, true
+	case macroTCP:
+		return 6, true
+	case macroUDP:
+		return 17, true
+	case macroICMP:
+		return 1, true
+	case macroICMPv6:
+		return 58, true
+	default:
+		return 0, false
+	}
+}
+
+// WINDIVERT_EVENT_* values.
+const (
+	eventNetworkPacket   = 0
+	eventFlowEstablished = 1
+	eventFlowDeleted     = 2
+	eventSocketBind      = 3
+	eventSocketConnect   = 4
+	eventSocketListen    = 5
+	eventSocketAccept    = 6
+	eventSocketClose     = 7
+	eventReflectOpen     = 8
+	eventReflectClose    = 9
+)
+
+type keyword struct {
+	kind  tokenKind
+	field Field
+	macro macro
+}
+
+var keywords = func() map[string]keyword {
+	m := map[string]keyword{
+		"ACCEPT":          {kind: tokenMacro, macro: macroAccept},
+		"BIND":            {kind: tokenMacro, macro: macroBind},
+		"CLOSE":           {kind: tokenMacro, macro: macroClose},
+		"CONNECT":         {kind: tokenMacro, macro: macroConnect},
+		"DELETED":         {kind: tokenMacro, macro: macroDeleted},
+		"ESTABLISHED":     {kind: tokenMacro, macro: macroEstablished},
+		"FALSE":           {kind: tokenMacro, macro: macroFalse},
+		"FLOW":            {kind: tokenMacro, macro: macroFlow},
+		"ICMP":            {kind: tokenMacro, macro: macroICMP},
+		"ICMPV6":          {kind: tokenMacro, macro: macroICMPv6},
+		"LISTEN":          {kind: tokenMacro, macro: macroListen},
+		"NETWORK":         {kind: tokenMacro, macro: macroNetwork},
+		"NETWORK_FORWARD": {kind: tokenMacro, macro: macroNetworkForward},
+		"OPEN":            {kind: tokenMacro, macro: macroOpen},
+		"PACKET":          {kind: tokenMacro, macro: macroPacket},
+		"REFLECT":         {kind: tokenMacro, macro: macroReflect},
+		"SOCKET":          {kind: tokenMacro, macro: macroSocket},
+		"TCP":             {kind: tokenMacro, macro: macroTCP},
+		"TRUE":            {kind: tokenMacro, macro: macroTrue},
+		"UDP":             {kind: tokenMacro, macro: macroUDP},
+		"and":             {kind: tokenAnd},
+		"not":             {kind: tokenNot},
+		"or":              {kind: tokenOr},
+	}
+	for i := range fields {
+		m[fields[i].name] = keyword{kind: tokenField, field: Field(i)}
+	}
+	return m
+}()
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isXDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isAlNum(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdent(c byte) bool {
+	return isAlNum(c) || c == '.' || c == ':' || c == '_'
+}
+
+// at returns s[i], or NUL past the end of s.
+func at(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+// tokenize splits a filter string into tokens, as WinDivertTokenizeFilter
+// does. Fields not available at the layer are rejected unless lenient is set.
+func tokenize(s string, layer Layer, lenient bool) ([]token, error) {
+	toks := make([]token, 0, 16)
+	i := 0
+	for {
+		if len(toks) >= maxTokens-1 {
+			return nil, newError(errTooLong, i, "")
+		}
+		for isSpace(at(s, i)) {
+			i++
+		}
+		tok := token{pos: i}
+		c := at(s, i)
+		i++
+		switch c {
+		case 0:
+			tok.kind, tok.end = tokenEnd, tok.pos
+			return append(toks, tok), nil
+		case '(':
+			tok.kind = tokenOpen
+		case ')':
+			tok.kind = tokenClose
+		case '[':
+			tok.kind = tokenSquareOpen
+		case ']':
+			tok.kind = tokenSquareClose
+		case '-':
+			tok.kind = tokenMinus
+		case '!':
+			tok.kind = tokenNot
+			if at(s, i) == '=' {
+				i++
+				tok.kind = tokenNeq
+			}
+		case '=':
+			if at(s, i) == '=' {
+				i++
+			}
+			tok.kind = tokenEq
+		case '<':
+			tok.kind = tokenLt
+			if at(s, i) == '=' {
+				i++
+				tok.kind = tokenLeq
+			}
+		case '>':
+			tok.kind = tokenGt
+			if at(s, i) == '=' {
+				i++
+				tok.kind = tokenGeq
+			}
+		case ':':
+			// "::" is probably the start of an IPv6 address, e.g. ::1.
+			if at(s, i) != ':' {
+				tok.kind = tokenColon
+			}
+		case '?':
+			tok.kind = tokenQuestion
+		case '&':
+			if at(s, i) != '&' {
+				return nil, newError(errBadToken, i, "&")
+			}
+			i++
+			tok.kind = tokenAnd
+		case '|':
+			if at(s, i) != '|' {
+				return nil, newError(errBadToken, i, "|")
+			}
+			i++
+			tok.kind = tokenOr
+		default:
+			if !isIdent(c) {
+				return nil, newError(errBadToken, i, s[i-1:i])
+			}
+		}
+		if tok.kind != tokenEnd {
+			tok.end = i
+			toks = append(toks, tok)
+			continue
+		}
+
+		start := i - 1
+		j := 1
+		for ; j < maxTokenLen && isIdent(at(s, i)); i, j = i+1, j+1 {
+		}
+		if j >= maxTokenLen {
+			return nil, newError(errBadToken, i-j, s[start:i])
+		}
+		word := s[start:i]
+
+		// Handle trailing colons:
+		if n := len(word); word[n-1] == ':' && (n == 1 || word[n-2] != ':') {
+			word = word[:n-1]
+			i--
+		}
+		tok.end = i
+
+		// Check for symbol:
+		if kw, ok := keywords[word]; ok {
+			if kw.kind == tokenField && kw.field <= fieldMax && !lenient && !kw.field.ValidFor(layer) {
+				return nil, newError(errBadTokenForLayer, i-j, word)
+			}
+			tok.kind, tok.field = kw.kind, kw.field
+			if kw.kind == tokenMacro {
+				if v, ok := kw.macro.expand(layer); ok {
+					tok.kind, tok.val[0] = tokenNumber, v
+				}
+			}
+			toks = append(toks, tok)
+			continue
+		}
+
+		// A lone "b" is dropped, as WinDivertTokenizeFilter never
+		// commits the token it produces.
+		if word == "b" {
+			continue
+		}
+
+		// Check for base 10 number:
+		if n, end, ok := parseDec(word); ok {
+			if end == len(word) || (end == len(word)-1 && word[end] == 'b') {
+				tok.kind, tok.val, tok.end = tokenNumber, n, tok.pos+end
+				toks = append(toks, tok)
+				if end != len(word) {
+					toks = append(toks, token{kind: tokenBytes, pos: tok.end, end: i})
+				}
+				continue
+			}
+		}
+
+		// Check for base 16 number:
+		if len(word) >= 2 && word[0] == '0' && word[1] == 'x' {
+			if n, end, ok := parseHex(word[2:]); ok && end == len(word)-2 {
+				tok.kind, tok.val = tokenNumber, n
+				toks = append(toks, tok)
+				continue
+			}
+		}
+
+		// Check for IPv4 address:
+		if addr, ok := parseIPv4(word); ok {
+			tok.kind, tok.val = tokenNumber, [4]uint32{addr, 0x0000FFFF}
+			toks = append(toks, tok)
+			continue
+		}
+
+		// Check for IPv6 address:
+		if addr, ok := parseIPv6(word); ok {
+			tok.kind, tok.val = tokenNumber, addr
+			toks = append(toks, tok)
+			continue
+		}
+
+		return nil, newError(errBadToken, i-j, word)
+	}
+}
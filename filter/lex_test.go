@@ -0,0 +1,128 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+// tokenizeTests list the number tokens of filters, all other tokens are
+// checked by kind only.
+var tokenizeTests = []struct {
+	filter string
+	kinds  []tokenKind
+	vals   [][4]uint32
+}{
+	{"tcp", []tokenKind{tokenField}, nil},
+	{"TCP", []tokenKind{tokenNumber}, [][4]uint32{{6}}},
+	{"= == != ! < <= > >=", []tokenKind{tokenEq, tokenEq, tokenNeq, tokenNot, tokenLt, tokenLeq, tokenGt, tokenGeq}, nil},
+	{"not and or && ||", []tokenKind{tokenNot, tokenAnd, tokenOr, tokenAnd, tokenOr}, nil},
+	{"( ) [ ] - ? :", []tokenKind{tokenOpen, tokenClose, tokenSquareOpen, tokenSquareClose, tokenMinus, tokenQuestion, tokenColon}, nil},
+	{"tcp.DstPort=80", []tokenKind{tokenField, tokenEq, tokenNumber}, [][4]uint32{{80}}},
+	{" \t\r\n\f\vtcp", []tokenKind{tokenField}, nil},
+
+	// Numbers are 128 bits wide, least significant word first.
+	{"0", []tokenKind{tokenNumber}, [][4]uint32{{0}}},
+	{"4294967296", []tokenKind{tokenNumber}, [][4]uint32{{0, 1}}},
+	{"340282366920938463463374607431768211455", []tokenKind{tokenNumber}, [][4]uint32{{^uint32(0), ^uint32(0), ^uint32(0), ^uint32(0)}}},
+	{"0x1F", []tokenKind{tokenNumber}, [][4]uint32{{0x1f}}},
+	{"0xdeadbeef00000001", []tokenKind{tokenNumber}, [][4]uint32{{1, 0xdeadbeef}}},
+	// "0x" alone is zero, as in the C helper.
+	{"0x", []tokenKind{tokenNumber}, [][4]uint32{{0}}},
+	// A "b" suffix is a separate token marking a byte index, a lone "b"
+	// is dropped.
+	{"[4b]", []tokenKind{tokenSquareOpen, tokenNumber, tokenBytes, tokenSquareClose}, [][4]uint32{{4}}},
+	{"4 b", []tokenKind{tokenNumber}, [][4]uint32{{4}}},
+
+	// IPv4 addresses are IPv4-mapped.
+	{"10.0.0.1", []tokenKind{tokenNumber}, [][4]uint32{{0x0a000001, 0xffff}}},
+	{"::", []tokenKind{tokenNumber}, [][4]uint32{{}}},
+	{"::1", []tokenKind{tokenNumber}, [][4]uint32{{1}}},
+	{"fe80::1:2:3:4", []tokenKind{tokenNumber}, [][4]uint32{{0x30004, 0x10002, 0, 0xfe800000}}},
+	{"::ffff:1.2.3.4", []tokenKind{tokenNumber}, [][4]uint32{{0x01020304, 0xffff}}},
+	{"2001:db8::", []tokenKind{tokenNumber}, [][4]uint32{{0, 0, 0, 0x20010db8}}},
+	// A trailing colon is the colon of a ?: unless it ends a "::".
+	{"udp: 1.2.3.4:", []tokenKind{tokenField, tokenColon, tokenNumber, tokenColon}, [][4]uint32{{0x01020304, 0xffff}}},
+}
+
+func TestTokenize(t *testing.T) {
+	for _, tt := range tokenizeTests {
+		toks, err := tokenize(tt.filter, LayerNetwork, false)
+		if err != nil {
+			t.Errorf("tokenize(%q): %v", tt.filter, err)
+			continue
+		}
+		if last := toks[len(toks)-1]; last.kind != tokenEnd || last.pos != len(tt.filter) {
+			t.Errorf("tokenize(%q) ends with %v at %d", tt.filter, last.kind, last.pos)
+		}
+		toks = toks[:len(toks)-1]
+		if len(toks) != len(tt.kinds) {
+			t.Errorf("tokenize(%q) = %d tokens, want %d", tt.filter, len(toks), len(tt.kinds))
+			continue
+		}
+		vals := tt.vals
+		for i, tok := range toks {
+			if tok.kind != tt.kinds[i] {
+				t.Errorf("tokenize(%q) token %d = %v, want %v", tt.filter, i, tok.kind, tt.kinds[i])
+			}
+			if tok.kind == tokenNumber {
+				if tok.val != vals[0] {
+					t.Errorf("tokenize(%q) token %d = %#x, want %#x", tt.filter, i, tok.val, vals[0])
+				}
+				vals = vals[1:]
+			}
+		}
+	}
+}
+
+// The errors below were reported by WinDivertHelperCompileFilter.
+var tokenizeErrorTests = []struct {
+	filter string
+	token  string
+	offset int
+}{
+	// An unpaired & or | and characters outside of the language point
+	// just past the character.
+	{"tcp & udp", "&", 5},
+	{"tcp | udp", "|", 5},
+	{"tcp # udp", "#", 5},
+	{"tcp.DstPort == 0xg", "0xg", 15},
+	{"tcp.DstPort == 0X10", "0X10", 15},
+	{"ip.DstAddr == 340282366920938463463374607431768211456", "340282366920938463463374607431768211456", 14},
+	{"ip.DstAddr == 1.2.3", "1.2.3", 14},
+	{"ip.DstAddr == 1.2.3.256", "1.2.3.256", 14},
+	{"ipv6.DstAddr == 1::2::3", "1::2::3", 16},
+	{"ipv6.DstAddr == fe80:", "fe80", 15},
+	// A colon without spaces is part of the word before it.
+	{"(tcp?udp:icmp)", "udp:icmp", 5},
+	{strings.Repeat("a", maxTokenLen-1), strings.Repeat("a", maxTokenLen-1), 0},
+	// Longer words are reported cut to maxTokenLen characters.
+	{"tcp.DstPort == 0x123456789012345678901234567890123456789", "0x12345678901234567890123456789012345678", 15},
+}
+
+func TestTokenizeError(t *testing.T) {
+	for _, tt := range tokenizeErrorTests {
+		_, err := tokenize(tt.filter, LayerNetwork, false)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("tokenize(%q) error = %v, want *Error", tt.filter, err)
+			continue
+		}
+		if e.code != errBadToken || e.Token != tt.token || e.Offset != tt.offset {
+			t.Errorf("tokenize(%q) error = %v, want %v at %d near %q", tt.filter, e, errBadToken, tt.offset, tt.token)
+		}
+	}
+
+	// The token buffer holds maxTokens-1 tokens with the end.
+	_, err := tokenize(strings.Repeat("(", 1300), LayerNetwork, false)
+	if e, ok := err.(*Error); !ok || e.code != errTooLong || e.Offset != 1278 {
+		t.Errorf("tokenize of 1300 tokens: %v, want %v at 1278", err, errTooLong)
+	}
+
+	// Fields of other layers are rejected unless lenient.
+	if _, err := tokenize("tcp.DstPort", LayerFlow, false); err == nil || err.(*Error).code != errBadTokenForLayer {
+		t.Errorf("tokenize of a network field at the flow layer: %v, want %v", err, errBadTokenForLayer)
+	}
+	if _, err := tokenize("tcp.DstPort", LayerFlow, true); err != nil {
+		t.Errorf("lenient tokenize of a network field at the flow layer: %v", err)
+	}
+}
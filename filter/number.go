@@ -0,0 +1,292 @@
+package filter
+
+// Numbers in the filter language are 128 bit unsigned integers stored as
+// four 32 bit words, least significant word first.
+
+func mul128(n *[4]uint32, m uint32) bool {
+	var c uint64
+	for i := range n {
+		v := uint64(n[i])*uint64(m) + c
+		n[i] = uint32(v)
+		c = v >> 32
+	}
+	return c == 0
+}
+
+func add128(n *[4]uint32, a uint32) bool {
+	c := uint64(a)
+	for i := range n {
+		v := uint64(n[i]) + c
+		n[i] = uint32(v)
+		c = v >> 32
+	}
+	return c == 0
+}
+
+// parseDec parses the leading decimal digits of s. It returns the number of
+// bytes consumed and fails if there are no digits or the value overflows.
+func parseDec(s string) ([4]uint32, int, bool) {
+	var n [4]uint32
+	i := 0
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		if !mul128(&n, 10) || !add128(&n, uint32(s[i]-'0')) {
+			return n, i, false
+		}
+	}
+	return n, i, i != 0
+}
+
+// parseHex parses the leading hexadecimal digits of s. It returns the number
+// of bytes consumed and only fails if the value overflows.
+func parseHex(s string) ([4]uint32, int, bool) {
+	var n [4]uint32
+	i := 0
+	for ; i < len(s) && isXDigit(s[i]); i++ {
+		var d uint32
+		switch c := s[i]; {
+		case isDigit(c):
+			d = uint32(c - '0')
+		case c >= 'a':
+			d = uint32(c-'a') + 10
+		default:
+			d = uint32(c-'A') + 10
+		}
+		if !mul128(&n, 16) || !add128(&n, d) {
+			return n, i, false
+		}
+	}
+	return n, i, true
+}
+
+// parseIPv4 parses a dotted IPv4 address into host byte order, as
+// WinDivertHelperParseIPv4Address does.
+func parseIPv4(s string) (uint32, bool) {
+	addr := uint32(0)
+	for i := 0; i < 4; i++ {
+		n, end, ok := parseDec(s)
+		// only the low word is checked, like WinDivertAToI with size 1
+		if !ok || n[0] > 0xFF {
+			return 0, false
+		}
+		s = s[end:]
+		if i != 3 {
+			if len(s) == 0 || s[0] != '.' {
+				return 0, false
+			}
+			s = s[1:]
+		}
+		addr |= n[0] << (8 * (3 - i))
+	}
+	if len(s) != 0 {
+		return 0, false
+	}
+	return addr, true
+}
+
+// parseIPv6 parses an IPv6 address as WinDivertHelperParseIPv6Address does.
+// The result holds the address in host byte order, least significant word
+// first.
+func parseIPv6(s string) ([4]uint32, bool) {
+	var (
+		laddr, raddr [8]uint16
+		addr         [4]uint32
+		left         = true
+		ipv4         = false
+		ipv4Addr     uint32
+		i, j         int
+	)
+
+	p := 0
+	if at(s, p) == ':' {
+		p++
+		if at(s, p) != ':' {
+			return addr, false
+		}
+		left = false
+		p++
+		if at(s, p) == 0 {
+			goto success
+		}
+	}
+
+	for k := 0; k < 8; k++ {
+		if at(s, p) == ':' {
+			if !left {
+				return addr, false
+			}
+			left = false
+			p++
+			if at(s, p) == 0 {
+				break
+			}
+		}
+
+		if i < 6 {
+			if v4, ok := parseIPv4(s[p:]); ok {
+				// Tail is IPv4 address:
+				ipv4, ipv4Addr = true, v4
+				j += 2
+				goto success
+			}
+		}
+		l := 0
+		for ; l < 4 && isXDigit(at(s, p+l)); l++ {
+		}
+		if l == 0 {
+			return addr, false
+		}
+		part, _, _ := parseHex(s[p : p+l])
+		p += l
+		if c := at(s, p); c != ':' && c != 0 {
+			return addr, false
+		}
+		if left {
+			laddr[i] = uint16(part[0])
+			i++
+		} else {
+			raddr[j] = uint16(part[0])
+			j++
+		}
+		if at(s, p) == 0 {
+			if !left || k == 7 {
+				break
+			}
+			return addr, false
+		}
+		p++
+	}
+
+success:
+	for i := 0; i < 4; i++ {
+		k := 2*i + j
+		l := k + 1
+		if k >= 8 {
+			k -= 8
+		}
+		if l >= 8 {
+			l -= 8
+		}
+		addr[3-i] = uint32(laddr[2*i+1]) | uint32(laddr[2*i])<<16 |
+			uint32(raddr[l]) | uint32(raddr[k])<<16
+	}
+	if ipv4 {
+		// Validate IPv4 address
+		if addr[3] != 0 || addr[2] != 0 || addr[0] != 0 || (addr[1] != 0x0000FFFF && addr[1] != 0) {
+			return addr, false
+		}
+		addr[0] = ipv4Addr
+	}
+	return addr, true
+}
+
+// divTen128 divides n by ten and returns the remainder.
+func divTen128(n *[4]uint32) uint32 {
+	var r uint64
+	for i := 3; i >= 0; i-- {
+		v := r<<32 | uint64(n[i])
+		n[i] = uint32(v / 10)
+		r = v % 10
+	}
+	return uint32(r)
+}
+
+func appendDec32(b []byte, v uint32) []byte {
+	var buf [10]byte
+	i := len(buf)
+	for {
+		i--
+		buf[i] = byte('0' + v%10)
+		v /= 10
+		if v == 0 {
+			break
+		}
+	}
+	return append(b, buf[i:]...)
+}
+
+func appendDec128(b []byte, v [4]uint32) []byte {
+	var buf [40]byte
+	i := len(buf)
+	for {
+		i--
+		buf[i] = byte('0' + divTen128(&v))
+		if v == [4]uint32{} {
+			break
+		}
+	}
+	return append(b, buf[i:]...)
+}
+
+func appendHex128(b []byte, v [4]uint32) []byte {
+	const digits = "0123456789abcdef"
+	zeroes := false
+	for i := 3; i >= 0; i-- {
+		for s := 28; s >= 0; s -= 4 {
+			d := (v[i] >> s) & 0xF
+			if d == 0 && !zeroes {
+				continue
+			}
+			b = append(b, digits[d])
+			zeroes = true
+		}
+	}
+	if !zeroes {
+		b = append(b, '0')
+	}
+	return b
+}
+
+func appendIPv4(b []byte, addr uint32) []byte {
+	b = appendDec32(b, addr>>24)
+	b = append(b, '.')
+	b = appendDec32(b, (addr>>16)&0xFF)
+	b = append(b, '.')
+	b = appendDec32(b, (addr>>8)&0xFF)
+	b = append(b, '.')
+	return appendDec32(b, addr&0xFF)
+}
+
+// appendIPv6 formats an address as WinDivertHelperFormatIPv6Address does,
+// IPv4-mapped addresses are written in dotted form.
+func appendIPv6(b []byte, addr [4]uint32) []byte {
+	// IPv4 special case:
+	if addr[3] == 0 && addr[2] == 0 && addr[1] == 0x0000FFFF {
+		return appendIPv4(b, addr[0])
+	}
+
+	var parts [8]uint16
+	for i := range parts {
+		parts[i] = uint16(addr[i/2] >> (16 * (i % 2)))
+	}
+
+	// Find zeroes:
+	curr, count, start, max := 7, 0, -1, -1
+	for i := 7; i >= 0; i-- {
+		if parts[i] == 0 {
+			count++
+			if count > max {
+				start, max = curr, count
+			}
+		} else {
+			curr, count = i-1, 0
+		}
+	}
+
+	// Format address:
+	for i := 7; i >= 0; i-- {
+		if i == start {
+			if i == 7 {
+				b = append(b, "::"...)
+			} else {
+				b = append(b, ':')
+			}
+			i -= max - 1
+			continue
+		}
+		b = appendHex128(b, [4]uint32{uint32(parts[i])})
+		if i != 0 {
+			b = append(b, ':')
+		}
+	}
+	return b
+}
@@ -0,0 +1,235 @@
+package filter
+
+// objectMagic starts every serialized filter object.
+const objectMagic = "@WinDiv_"
+
+// MaxObjectLength is the length of the longest filter object including the
+// terminating NUL, as in the data of reflect events: the magic, the version
+// and the count of instructions, then at most 256 instructions of up to 39
+// characters each.
+const MaxObjectLength = len(objectMagic) + 1 + 2 + maxLength*maxInsnLength + 1
+
+// maxInsnLength is the length of the longest serialized instruction: the
+// separator, 2 digits of field, 1 of operator and negation, 4 arguments
+// of 7 digits and 2 labels of 3 characters.
+const maxInsnLength = 1 + 2 + 1 + 1 + 4*7 + 2*3
+
+// digits is the alphabet of serialized numbers. Each digit holds 5 bits,
+// the final digit of a number is taken from the upper half.
+const digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz+="
+
+// appendObject is WinDivertSerializeFilter without the terminating NUL.
+func appendObject(b []byte, prog []insn) []byte {
+	b = append(b, objectMagic...)
+	b = appendNumber(b, 0) // version
+	b = appendNumber(b, uint32(len(prog)))
+	for i := range prog {
+		b = appendInsn(b, &prog[i])
+	}
+	return b
+}
+
+func appendInsn(b []byte, in *insn) []byte {
+	b = append(b, '_')
+	b = appendNumber(b, uint32(in.field))
+	b = appendNumber(b, uint32(in.op))
+	neg := uint32(0)
+	if in.neg {
+		neg = 1
+	}
+	b = appendNumber(b, neg)
+	b = appendNumber(b, in.arg[0])
+	switch in.field {
+	case FieldIPv6SrcAddr, FieldIPv6DstAddr, FieldLocalAddr, FieldRemoteAddr:
+		b = appendNumber(b, in.arg[1])
+		b = appendNumber(b, in.arg[2])
+		b = appendNumber(b, in.arg[3])
+	case FieldEndpointID, FieldParentEndpointID, FieldTimestamp:
+		b = appendNumber(b, in.arg[1])
+	default:
+		if in.field.IsArray() {
+			b = appendNumber(b, uint32(int32(in.arg[1])+0xFFFF))
+		}
+	}
+	b = appendLabel(b, in.success)
+	return appendLabel(b, in.failure)
+}
+
+func appendLabel(b []byte, l uint16) []byte {
+	switch l {
+	case resultAccept:
+		return append(b, 'A')
+	case resultReject:
+		return append(b, 'X')
+	default:
+		return appendNumber(append(b, 'L'), uint32(l))
+	}
+}
+
+// appendNumber is WinDivertSerializeNumber: big endian groups of 5 bits,
+// 2 bits in the leading group, without leading zeros.
+func appendNumber(b []byte, v uint32) []byte {
+	dig := 6
+	for dig > 0 && v>>(5*dig) == 0 {
+		dig--
+	}
+	for ; dig > 0; dig-- {
+		b = append(b, digits[(v>>(5*dig))&0x1F])
+	}
+	return append(b, digits[32+v&0x1F])
+}
+
+// objectReader is a WINDIVERT_STREAM reading a filter object. Like a C
+// string, the object ends at the first NUL.
+type objectReader struct {
+	s string
+	i int
+}
+
+func (r *objectReader) next() byte {
+	c := at(r.s, r.i)
+	r.i++
+	return c
+}
+
+func decodeDigit(c byte) (digit uint32, final, ok bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return uint32(c - '0'), false, true
+	case c >= 'A' && c <= 'V':
+		return uint32(c-'A') + 10, false, true
+	case c >= 'W' && c <= 'Z':
+		return uint32(c - 'W'), true, true
+	case c >= 'a' && c <= 'z':
+		return uint32(c-'a') + 4, true, true
+	case c == '+':
+		return 30, true, true
+	case c == '=':
+		return 31, true, true
+	default:
+		return 0, false, false
+	}
+}
+
+// number is WinDivertDeserializeNumber, reading at most n digits.
+func (r *objectReader) number(n int) (uint32, bool) {
+	v := uint32(0)
+	for i := 0; i < n; i++ {
+		if v&0xF8000000 != 0 {
+			return 0, false
+		}
+		digit, final, ok := decodeDigit(r.next())
+		if !ok {
+			return 0, false
+		}
+		v = v<<5 + digit
+		if final {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (r *objectReader) label() (uint16, bool) {
+	switch r.next() {
+	case 'A':
+		return resultAccept, true
+	case 'X':
+		return resultReject, true
+	case 'L':
+		v, ok := r.number(2)
+		if !ok || v > maxLength {
+			return 0, false
+		}
+		return uint16(v), true
+	default:
+		return 0, false
+	}
+}
+
+func (r *objectReader) insn(in *insn) bool {
+	if r.next() != '_' {
+		return false
+	}
+	v, ok := r.number(2)
+	if !ok || v > uint32(fieldMax) {
+		return false
+	}
+	in.field = Field(v)
+	if v, ok = r.number(2); !ok || v > uint32(OpGeq) {
+		return false
+	}
+	in.op = Op(v)
+	if v, ok = r.number(1); !ok || v > 1 {
+		return false
+	}
+	in.neg = v == 1
+	if in.arg[0], ok = r.number(7); !ok {
+		return false
+	}
+
+	switch in.field {
+	case FieldIPv6SrcAddr, FieldIPv6DstAddr, FieldLocalAddr, FieldRemoteAddr:
+		for i := 1; i < 4; i++ {
+			if in.arg[i], ok = r.number(7); !ok {
+				return false
+			}
+		}
+	case FieldEndpointID, FieldParentEndpointID, FieldTimestamp:
+		if in.arg[1], ok = r.number(7); !ok {
+			return false
+		}
+	case FieldIPSrcAddr, FieldIPDstAddr:
+		in.arg[1] = 0x0000FFFF
+	default:
+		if in.field.IsArray() {
+			if v, ok = r.number(7); !ok {
+				return false
+			}
+			in.arg[1] = uint32(int32(v) - 0xFFFF)
+		}
+	}
+
+	if in.success, ok = r.label(); !ok {
+		return false
+	}
+	in.failure, ok = r.label()
+	return ok
+}
+
+// decodeObject is WinDivertDeserializeFilter. Labels must jump forward
+// and stay within the object.
+func decodeObject(s string) ([]insn, bool) {
+	r := objectReader{s: s}
+	for i := 0; i < len(objectMagic); i++ {
+		if r.next() != objectMagic[i] {
+			return nil, false
+		}
+	}
+	if v, ok := r.number(4); !ok || v != 0 {
+		return nil, false
+	}
+	n, ok := r.number(2)
+	if !ok || n == 0 || n > maxLength {
+		return nil, false
+	}
+
+	prog := make([]insn, n)
+	for i := range prog {
+		in := &prog[i]
+		if !r.insn(in) || !validLabel(in.success, i, len(prog)) || !validLabel(in.failure, i, len(prog)) {
+			return nil, false
+		}
+	}
+	if r.next() != 0 {
+		return nil, false
+	}
+	return prog, true
+}
+
+func validLabel(l uint16, i, n int) bool {
+	if l == resultAccept || l == resultReject {
+		return true
+	}
+	return int(l) > i && int(l) < n
+}
@@ -0,0 +1,235 @@
+// Package filter implements the WinDivert filter language in pure Go.
+//
+// It parses filter strings such as "outbound and tcp.DstPort == 443" into a
+// typed syntax tree, following the grammar and the quirks of the
+// WinDivertHelperCompileFilter implementation in windivert_helper.c, so
+// filters can be checked on any platform.
+package filter
+
+// maxLength is WINDIVERT_FILTER_MAXLEN.
+const maxLength = 256
+
+// maxDepth is the nesting limit of WinDivertCompileFilter.
+const maxDepth = 1024
+
+// mtuMax is WINDIVERT_MTU_MAX.
+const mtuMax = 40 + 0xFFFF
+
+// Parse parses a filter string for the given layer.
+func Parse(filter string, layer Layer) (*Filter, error) {
+	return parse(filter, layer, false)
+}
+
+// Validate reports whether filter is a valid filter for layer, returning an
+// *Error describing the first problem otherwise. Filter objects, which
+// start with '@', are checked to be well formed.
+func Validate(filter string, layer Layer) error {
+	_, err := compile(filter, layer)
+	return err
+}
+
+func parse(filter string, layer Layer, lenient bool) (*Filter, error) {
+	toks, err := tokenize(filter, layer, lenient)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{src: filter, toks: toks}
+	expr := p.parseFilter(maxDepth, false)
+	if expr == nil {
+		return nil, p.err
+	}
+	if p.tok().kind != tokenEnd {
+		p.fail(errUnexpectedToken)
+		return nil, p.err
+	}
+	return &Filter{Layer: layer, Expr: expr}, nil
+}
+
+// parser is a port of the recursive descent parser of windivert_helper.c.
+// A nil Expr means failure with the reason stored in err.
+type parser struct {
+	src  string
+	toks []token
+	i    int
+	err  *Error
+}
+
+func (p *parser) tok() *token {
+	return &p.toks[p.i]
+}
+
+func (p *parser) fail(code errorCode) Expr {
+	tok := p.tok()
+	p.err = newError(code, tok.pos, p.src[tok.pos:tok.end])
+	return nil
+}
+
+func makeBinOp(op Op, x, y Expr) Expr {
+	if x == nil || y == nil {
+		return nil
+	}
+	return &BinaryExpr{Op: op, X: x, Y: y}
+}
+
+// parseFilter parses an or-expression, or an and-expression if and is set.
+func (p *parser) parseFilter(depth int, and bool) Expr {
+	if depth < 0 {
+		return p.fail(errTooDeep)
+	}
+	depth--
+
+	var expr Expr
+	if and {
+		expr = p.parseAndOrArg(depth)
+	} else {
+		expr = p.parseFilter(depth, true)
+	}
+	for {
+		if expr == nil {
+			return nil
+		}
+		switch p.tok().kind {
+		case tokenAnd:
+			p.i++
+			expr = makeBinOp(OpAnd, expr, p.parseAndOrArg(depth))
+		case tokenOr:
+			p.i++
+			expr = makeBinOp(OpOr, expr, p.parseFilter(depth, true))
+		default:
+			return expr
+		}
+	}
+}
+
+// parseAndOrArg parses a test or a parenthesized expression, the only
+// place a (c ? a : b) may appear.
+func (p *parser) parseAndOrArg(depth int) Expr {
+	if depth < 0 {
+		return p.fail(errTooDeep)
+	}
+	depth--
+
+	if p.tok().kind != tokenOpen {
+		return p.parseTest()
+	}
+	lparen := p.tok().pos
+	p.i++
+	arg := p.parseFilter(depth, false)
+	switch p.tok().kind {
+	case tokenClose:
+		p.i++
+		return arg
+	case tokenQuestion:
+		if arg == nil {
+			return nil
+		}
+		p.i++
+	default:
+		// WinDivertParseAndOrArg reports the current token even if the
+		// inner expression failed for another reason.
+		return p.fail(errUnexpectedToken)
+	}
+	th := p.parseFilter(depth, false)
+	if th == nil {
+		return nil
+	}
+	if p.tok().kind != tokenColon {
+		return p.fail(errUnexpectedToken)
+	}
+	p.i++
+	el := p.parseFilter(depth, false)
+	if el == nil {
+		return nil
+	}
+	if p.tok().kind != tokenClose {
+		return p.fail(errUnexpectedToken)
+	}
+	p.i++
+	return &CondExpr{Lparen: lparen, Cond: arg, Then: th, Else: el}
+}
+
+// parseTest parses [not]* field [op [-]number].
+func (p *parser) parseTest() Expr {
+	t := &Test{TestPos: p.tok().pos}
+	not := false
+	for p.tok().kind == tokenNot {
+		not = !not
+		p.i++
+	}
+	if p.tok().kind != tokenField {
+		return p.fail(errUnexpectedToken)
+	}
+	t.Field = p.tok().field
+	p.i++
+
+	if size := fields[t.Field].size; size != 0 {
+		if p.tok().kind != tokenSquareOpen {
+			return p.fail(errUnexpectedToken)
+		}
+		p.i++
+		neg := false
+		if p.tok().kind == tokenMinus {
+			neg = true
+			p.i++
+		}
+		if p.tok().kind != tokenNumber {
+			return p.fail(errUnexpectedToken)
+		}
+		if v := p.tok().val; v[3] != 0 || v[2] != 0 || v[1] != 0 || v[0] > mtuMax {
+			return p.fail(errIndexOOB)
+		}
+		idx := int(p.tok().val[0])
+		p.i++
+		if p.tok().kind == tokenBytes {
+			p.i++
+		} else {
+			idx *= size
+		}
+		if (!neg && idx > 0xFFFF-size) || (neg && idx > 0xFFFF) || (neg && idx < size) {
+			return p.fail(errIndexOOB)
+		}
+		if p.tok().kind != tokenSquareClose {
+			return p.fail(errUnexpectedToken)
+		}
+		p.i++
+		if neg {
+			idx = -idx
+		}
+		t.Index = idx
+	}
+
+	switch p.tok().kind {
+	case tokenEq:
+		t.Op = OpEq
+	case tokenNeq:
+		t.Op = OpNeq
+	case tokenLt:
+		t.Op = OpLt
+	case tokenLeq:
+		t.Op = OpLeq
+	case tokenGt:
+		t.Op = OpGt
+	case tokenGeq:
+		t.Op = OpGeq
+	default:
+		t.Op = OpNeq
+		if not {
+			t.Op = OpEq
+		}
+		return t
+	}
+	if not {
+		t.Op = t.Op.negate()
+	}
+	p.i++
+	if p.tok().kind == tokenMinus {
+		t.Value.Neg = true
+		p.i++
+	}
+	if p.tok().kind != tokenNumber {
+		return p.fail(errUnexpectedToken)
+	}
+	t.Value.Val = p.tok().val
+	p.i++
+	return t
+}
@@ -0,0 +1,148 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+// tree prints e with every binary and conditional expression in
+// parentheses, so that the grouping of the parser shows.
+func tree(e Expr) string {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		return "(" + tree(e.X) + " " + e.Op.String() + " " + tree(e.Y) + ")"
+	case *CondExpr:
+		return "(" + tree(e.Cond) + " ? " + tree(e.Then) + " : " + tree(e.Else) + ")"
+	case *Test:
+		return (&Filter{Layer: LayerNetwork, Expr: e}).String()
+	default:
+		return "?"
+	}
+}
+
+var parseTests = []struct {
+	filter string
+	tree   string
+}{
+	{"tcp", "tcp"},
+	{"not tcp", "not tcp"},
+	{"not not tcp", "tcp"},
+	{"!tcp.DstPort == 80", "tcp.DstPort != 80"},
+	{"not tcp.DstPort < 80", "tcp.DstPort >= 80"},
+	{"tcp.DstPort == -1", "tcp.DstPort = -1"},
+
+	// and binds tighter than or, and chains of or group to the right.
+	{"tcp and udp or icmp", "((tcp and udp) or icmp)"},
+	{"tcp or udp and icmp", "(tcp or (udp and icmp))"},
+	{"tcp or udp or icmp", "(tcp or (udp or icmp))"},
+	{"tcp and udp and icmp", "((tcp and udp) and icmp)"},
+	{"tcp or udp and icmp or ip", "(tcp or ((udp and icmp) or ip))"},
+	{"(tcp or udp) and icmp", "((tcp or udp) and icmp)"},
+
+	{"(tcp ? udp : icmp)", "(tcp ? udp : icmp)"},
+	{"(tcp and ip ? udp or ipv6 : icmp)", "((tcp and ip) ? (udp or ipv6) : icmp)"},
+	{"(tcp ? (udp ? ip : ipv6) : icmp)", "(tcp ? (udp ? ip : ipv6) : icmp)"},
+	{"(tcp ? udp : icmp) and ip", "((tcp ? udp : icmp) and ip)"},
+
+	// Indexes count elements unless given in bytes.
+	{"tcp.Payload16[2] == 1", "tcp.Payload16[4b] = 0x1"},
+	{"tcp.Payload16[3b] == 1", "tcp.Payload16[3b] = 0x1"},
+	{"tcp.Payload32[-2] == 1", "tcp.Payload32[-8b] = 0x1"},
+	{"tcp.Payload[-65535] == 1", "tcp.Payload[-65535b] = 0x1"},
+	{"tcp.Payload16[65533b] == 1", "tcp.Payload16[65533b] = 0x1"},
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range parseTests {
+		f, err := Parse(tt.filter, LayerNetwork)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.filter, err)
+			continue
+		}
+		if got := tree(f.Expr); got != tt.tree {
+			t.Errorf("Parse(%q) = %s, want %s", tt.filter, got, tt.tree)
+		}
+	}
+}
+
+// TestParsePos checks the offsets of the expressions.
+func TestParsePos(t *testing.T) {
+	f, err := Parse("  not tcp or (udp ? icmp : ip)", LayerNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	or := f.Expr.(*BinaryExpr)
+	if p := or.Pos(); p != 2 {
+		t.Errorf("or at %d, want 2", p)
+	}
+	if p := or.Y.Pos(); p != 13 {
+		t.Errorf("?: at %d, want 13", p)
+	}
+	if p := or.Y.(*CondExpr).Then.Pos(); p != 20 {
+		t.Errorf("icmp at %d, want 20", p)
+	}
+}
+
+// The errors below were reported by WinDivertHelperCompileFilter.
+var parseErrorTests = []struct {
+	filter string
+	code   errorCode
+	offset int
+}{
+	// Unterminated expressions point at the end.
+	{"tcp.DstPort ==", errUnexpectedToken, 14},
+	{"tcp and", errUnexpectedToken, 7},
+	{"not", errUnexpectedToken, 3},
+	{"(tcp", errUnexpectedToken, 4},
+	{"(tcp ? udp", errUnexpectedToken, 10},
+	{"(tcp ? udp : icmp", errUnexpectedToken, 17},
+	{"tcp.Payload[", errUnexpectedToken, 12},
+	{"tcp.Payload[0", errUnexpectedToken, 13},
+
+	{"tcp )", errUnexpectedToken, 4},
+	{"()", errUnexpectedToken, 1},
+	{"not (tcp)", errUnexpectedToken, 4},
+	{"tcp ? udp : icmp", errUnexpectedToken, 4},
+	{"(tcp ? udp)", errUnexpectedToken, 10},
+	{"(tcp ? udp :: icmp)", errUnexpectedToken, 11},
+	{"ip.DstAddr == 1.2.3.4:", errUnexpectedToken, 21},
+	{"tcp.DstPort == tcp", errUnexpectedToken, 15},
+	{"tcp.DstPort == udp.DstPort", errUnexpectedToken, 15},
+	{"tcp.Payload == 1", errUnexpectedToken, 12},
+	{"tcp[0]", errUnexpectedToken, 3},
+	{"b", errUnexpectedToken, 1},
+	// Macros of other layers are not numbers.
+	{"event == ESTABLISHED", errUnexpectedToken, 9},
+	// The bytes token is only valid in an index. The C helper leaves its
+	// offset uninitialized, the parser reports the "b".
+	{"tcp.DstPort == 1b", errUnexpectedToken, 16},
+
+	{"tcp.Payload[65535] == 1", errIndexOOB, 17},
+	{"tcp.Payload[-0] == 1", errIndexOOB, 14},
+	{"tcp.Payload[-65536] == 1", errIndexOOB, 18},
+	{"tcp.Payload[-65536b] == 1", errIndexOOB, 19},
+	{"tcp.Payload16[-1b] == 1", errIndexOOB, 17},
+	{"tcp.Payload16[65534b] == 1", errIndexOOB, 20},
+	{"tcp.Payload32[16383] == 1", errIndexOOB, 19},
+
+	// The depth runs out inside the parentheses, which is reported as an
+	// unexpected token there.
+	{strings.Repeat("(", 400) + "tcp" + strings.Repeat(")", 400), errUnexpectedToken, 341},
+}
+
+func TestParseError(t *testing.T) {
+	for _, tt := range parseErrorTests {
+		_, err := Parse(tt.filter, LayerNetwork)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("Parse(%.20q) error = %v, want *Error", tt.filter, err)
+			continue
+		}
+		if e.code != tt.code || e.Offset != tt.offset {
+			t.Errorf("Parse(%.20q) error = %v, want %v at %d", tt.filter, e, tt.code, tt.offset)
+		}
+		if e.Offset > len(tt.filter) || !strings.HasPrefix(tt.filter[e.Offset:], e.Token) {
+			t.Errorf("Parse(%.20q) error token %q is not at offset %d", tt.filter, e.Token, e.Offset)
+		}
+	}
+}
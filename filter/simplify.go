@@ -0,0 +1,277 @@
+package filter
+
+import "strconv"
+
+// DiagnosticKind classifies a Diagnostic.
+type DiagnosticKind int
+
+const (
+	// DiagUnavailable is a field the layer does not provide. Open refuses
+	// such a filter, Simplify treats the test as false.
+	DiagUnavailable DiagnosticKind = iota
+	// DiagConstant is a test or filter that is always true or false.
+	DiagConstant
+	// DiagRedundant is a test that is repeated, implied or reduces to a
+	// protocol check.
+	DiagRedundant
+)
+
+// Diagnostic is a remark of Simplify about a part of a filter.
+type Diagnostic struct {
+	Kind DiagnosticKind
+	// Offset is the byte offset of the test in the filter string, 0 for
+	// filter objects and remarks about the whole filter.
+	Offset int
+	Msg    string
+}
+
+// String returns the message followed by the offset.
+func (d Diagnostic) String() string {
+	return d.Msg + " at offset " + strconv.Itoa(d.Offset)
+}
+
+// Simplify analyzes a filter string or object for layer and returns an
+// equivalent simplified filter together with diagnostics. Constant tests
+// are folded the way the compiler folds them, duplicate and contradicting
+// tests of and/or chains are removed, and fields the layer does not provide
+// are reported and treated as false.
+//
+// The error is non-nil only if the filter does not parse, ignoring the
+// layer of its fields.
+func Simplify(filter string, layer Layer) (*Filter, []Diagnostic, error) {
+	var (
+		f   *Filter
+		err error
+	)
+	if len(filter) > 0 && filter[0] == '@' {
+		f, err = decompile(filter, layer)
+	} else {
+		f, err = parse(filter, layer, true)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := simplifier{layer: layer}
+	expr := s.expr(f.Expr)
+	if v, ok := constValue(expr); ok {
+		msg := "filter never matches"
+		if v {
+			msg = "filter matches everything"
+		}
+		s.report(DiagConstant, 0, msg)
+	}
+	return &Filter{Layer: layer, Expr: expr}, s.diags, nil
+}
+
+type simplifier struct {
+	layer Layer
+	diags []Diagnostic
+}
+
+func (s *simplifier) report(kind DiagnosticKind, pos int, msg string) {
+	s.diags = append(s.diags, Diagnostic{Kind: kind, Offset: pos, Msg: msg})
+}
+
+// key returns a canonical form of e. Equal keys mean equal expressions.
+func (s *simplifier) key(e Expr) string {
+	f := Filter{Layer: s.layer, Expr: e}
+	return f.String()
+}
+
+func constExpr(v bool, pos int) *Test {
+	t := &Test{TestPos: pos, Field: FieldFalse, Op: OpNeq}
+	if v {
+		t.Field = FieldTrue
+	}
+	return t
+}
+
+// constValue reports whether e is the true or false test written by
+// constExpr.
+func constValue(e Expr) (v, ok bool) {
+	t, ok := e.(*Test)
+	if !ok || t.Op != OpNeq || t.Value != (Value{}) {
+		return false, false
+	}
+	switch t.Field {
+	case FieldTrue:
+		return true, true
+	case FieldFalse:
+		return false, true
+	}
+	return false, false
+}
+
+func (s *simplifier) expr(e Expr) Expr {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		var xs []Expr
+		s.operands(e.Op, e, &xs)
+		return s.join(e.Op, e.Pos(), xs)
+	case *CondExpr:
+		return s.cond(e)
+	case *Test:
+		return s.test(e)
+	default:
+		return e
+	}
+}
+
+// operands simplifies the operands of the and or or chain e.
+func (s *simplifier) operands(op Op, e Expr, xs *[]Expr) {
+	if b, ok := e.(*BinaryExpr); ok && b.Op == op {
+		s.operands(op, b.X, xs)
+		s.operands(op, b.Y, xs)
+		return
+	}
+	*xs = append(*xs, s.expr(e))
+}
+
+func (s *simplifier) test(t *Test) Expr {
+	if _, ok := constValue(t); ok {
+		return t
+	}
+	src := Filter{Layer: s.layer, Expr: t}
+	if !t.Field.ValidFor(s.layer) {
+		s.report(DiagUnavailable, t.TestPos, t.Field.String()+" is not available at layer "+s.layer.String())
+		return constExpr(false, t.TestPos)
+	}
+
+	u := simplify(*t)
+	if u.Field == FieldTrue && u.Op == OpEq {
+		v := u.Value.Val[0] != 0
+		s.report(DiagConstant, t.TestPos, src.String()+" is always "+strconv.FormatBool(v))
+		return constExpr(v, t.TestPos)
+	}
+	if u != *t {
+		r := &u
+		s.report(DiagRedundant, t.TestPos, src.String()+" reduces to "+s.key(r))
+		return r
+	}
+	return t
+}
+
+// join rebuilds the and or or chain of the simplified operands xs,
+// dropping neutral constants and repeated operands and folding the chain
+// to a constant when an operand absorbs it or contradicts another.
+func (s *simplifier) join(op Op, pos int, xs []Expr) Expr {
+	and := op == OpAnd
+	seen := make(map[string]bool, len(xs))
+	var out Expr
+	for i := 0; i < len(xs); i++ {
+		x := xs[i]
+		if b, ok := x.(*BinaryExpr); ok && b.Op == op {
+			// a simplified ?: can turn into a chain of the same kind
+			rest := append([]Expr{b.X, b.Y}, xs[i+1:]...)
+			xs = append(xs[:i:i], rest...)
+			i--
+			continue
+		}
+		if v, ok := constValue(x); ok {
+			if v != and {
+				return constExpr(v, pos)
+			}
+			continue
+		}
+		k := s.key(x)
+		if seen[k] {
+			s.report(DiagRedundant, x.Pos(), k+" is repeated")
+			continue
+		}
+		// A test on a field of a header is false under either operator for
+		// packets without the header, so "a and not a" never matches with
+		// the operator negated, while "a or not a" only always matches with
+		// the exact negation.
+		neg := not(x)
+		if and {
+			neg = opposite(x)
+		}
+		if seen[s.key(neg)] {
+			word := "never"
+			if !and {
+				word = "always"
+			}
+			s.report(DiagConstant, x.Pos(), k+" contradicts an earlier test, the "+op.String()+" "+word+" matches")
+			return constExpr(!and, pos)
+		}
+		seen[k] = true
+		if out == nil {
+			out = x
+		} else {
+			out = &BinaryExpr{Op: op, X: out, Y: x}
+		}
+	}
+	if out == nil {
+		return constExpr(and, pos)
+	}
+	return out
+}
+
+func (s *simplifier) cond(e *CondExpr) Expr {
+	c := s.expr(e.Cond)
+	th := s.expr(e.Then)
+	el := s.expr(e.Else)
+	pos := e.Lparen
+
+	if v, ok := constValue(c); ok {
+		if v {
+			return th
+		}
+		return el
+	}
+	if s.key(th) == s.key(el) {
+		s.report(DiagRedundant, pos, "both branches of ?: are "+s.key(th))
+		return th
+	}
+	vt, okt := constValue(th)
+	ve, oke := constValue(el)
+	switch {
+	case okt && vt:
+		return s.join(OpOr, pos, []Expr{c, el})
+	case oke && !ve:
+		return s.join(OpAnd, pos, []Expr{c, th})
+	case hasArray(c):
+		// The exact negation of an array test is a ?: again.
+	case okt:
+		return s.join(OpAnd, pos, []Expr{not(c), el})
+	case oke:
+		return s.join(OpOr, pos, []Expr{not(c), th})
+	}
+	return &CondExpr{Lparen: pos, Cond: c, Then: th, Else: el}
+}
+
+// opposite negates e by negating the operators of its tests. Unlike not,
+// it does not add guards for tests on header fields, so it only matches a
+// subset of what e does not.
+func opposite(e Expr) Expr {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		op := OpAnd
+		if e.Op == OpAnd {
+			op = OpOr
+		}
+		return &BinaryExpr{Op: op, X: opposite(e.X), Y: opposite(e.Y)}
+	case *CondExpr:
+		return &CondExpr{Cond: e.Cond, Then: opposite(e.Then), Else: opposite(e.Else)}
+	case *Test:
+		t := *e
+		t.Op = t.Op.negate()
+		return &t
+	default:
+		return e
+	}
+}
+
+// hasArray reports whether e tests an array field.
+func hasArray(e Expr) bool {
+	switch e := e.(type) {
+	case *BinaryExpr:
+		return hasArray(e.X) || hasArray(e.Y)
+	case *CondExpr:
+		return hasArray(e.Cond) || hasArray(e.Then) || hasArray(e.Else)
+	case *Test:
+		return e.Field.IsArray()
+	}
+	return false
+}
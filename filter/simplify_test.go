@@ -0,0 +1,71 @@
+package filter
+
+import "testing"
+
+var simplifyTests = []struct {
+	filter     string
+	simplified string
+	constant   bool
+}{
+	{"tcp.DstPort == 80 or tcp.DstPort != 80", "tcp.DstPort = 80 or tcp.DstPort != 80", false},
+	{"tcp.DstPort == 80 and tcp.DstPort != 80", "false", true},
+	{"ip.TTL < 64 or ip.TTL >= 64", "ip.TTL < 64 or ip.TTL >= 64", false},
+	{"ip.TTL < 64 and ip.TTL >= 64", "false", true},
+	{"(tcp.DstPort == 80 ? false : udp)", "(not tcp or tcp.DstPort != 80) and udp", false},
+	{"(tcp.DstPort == 80 ? udp : true)", "not tcp or tcp.DstPort != 80 or udp", false},
+	{"(tcp ? false : udp)", "not tcp and udp", false},
+	{"(tcp.Payload[0] == 0x16 ? false : udp)", "(tcp.Payload[0b] = 0x16? false: udp)", false},
+	{"tcp or not tcp", "true", true},
+	{"outbound and not outbound", "false", true},
+	{"outbound or inbound", "outbound or inbound", false},
+	{"tcp and tcp", "tcp", false},
+	{"true and tcp.DstPort >= 0", "tcp", false},
+	{"(outbound ? true : false)", "outbound", false},
+	{"udp.DstPort == 53 or tcp.DstPort == 443 or udp.DstPort == 53", "udp.DstPort = 53 or tcp.DstPort = 443", false},
+}
+
+// TestSimplify checks that the simplified filter matches the same packets
+// as the original one.
+func TestSimplify(t *testing.T) {
+	pkts := testPackets(t)
+	for _, tt := range simplifyTests {
+		f, diags, err := Simplify(tt.filter, LayerNetwork)
+		if err != nil {
+			t.Fatalf("Simplify(%q): %v", tt.filter, err)
+		}
+		if s := f.String(); s != tt.simplified {
+			t.Errorf("Simplify(%q) = %q, want %q", tt.filter, s, tt.simplified)
+		}
+		constant := false
+		for _, d := range diags {
+			if d.Kind == DiagConstant && d.Offset == 0 {
+				constant = true
+			}
+		}
+		if constant != tt.constant {
+			t.Errorf("Simplify(%q) constant = %v, want %v: %v", tt.filter, constant, tt.constant, diags)
+		}
+
+		prog, err := Compile(tt.filter, LayerNetwork)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sprog, err := Compile(f.String(), LayerNetwork)
+		if err != nil {
+			t.Fatalf("Compile(%q): %v", f, err)
+		}
+		for _, tp := range pkts {
+			want, err := prog.Eval(tp.packet, &tp.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := sprog.Eval(tp.packet, &tp.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("%q = %v, %q = %v for %s", f, got, tt.filter, want, tp.name)
+			}
+		}
+	}
+}
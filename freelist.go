@@ -0,0 +1,73 @@
+package divert
+
+import "sync"
+
+// resource is an item of a freeList, e.g. a request holding an event.
+type resource[T any] interface {
+	*T
+	// open acquires the resources of a new item.
+	open() error
+	// release frees them.
+	release()
+}
+
+// freeList holds the per-call requests of a Handle for reuse. The driver
+// may write to a request until its I/O has finished, so a request in use
+// is released only once it is put back, also after the list is closed.
+// The zero value is an empty list.
+type freeList[T any, PT resource[T]] struct {
+	mu     sync.Mutex
+	free   []PT
+	closed bool
+}
+
+// get returns a free item or a new one. It fails with ErrInvalidHandle
+// once the list is closed.
+func (l *freeList[T, PT]) get() (PT, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, ErrInvalidHandle
+	}
+	if n := len(l.free); n > 0 {
+		x := l.free[n-1]
+		l.free = l.free[:n-1]
+		l.mu.Unlock()
+		return x, nil
+	}
+	l.mu.Unlock()
+
+	x := PT(new(T))
+	if err := x.open(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// put returns an item that is no longer used, or releases it if the list
+// is closed.
+func (l *freeList[T, PT]) put(x PT) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		x.release()
+		return
+	}
+	l.free = append(l.free, x)
+}
+
+// close releases the free items. It reports false if the list was already
+// closed.
+func (l *freeList[T, PT]) close() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	l.closed = true
+	for _, x := range l.free {
+		x.release()
+	}
+	l.free = nil
+	return true
+}
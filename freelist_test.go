@@ -0,0 +1,150 @@
+package divert
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var errOpen = errors.New("open failed")
+
+// fakeRequest counts the requests opened and released, as Handle does
+// with the events of its requests.
+type fakeRequest struct {
+	counts   *fakeCounts
+	released bool
+	// value is written while the request is in use, so that the race
+	// detector sees two calls sharing a request.
+	value int
+}
+
+type fakeCounts struct {
+	opened, released atomic.Int64
+	fail             atomic.Bool
+}
+
+// testCounts is the fakeCounts of the running test, fakeRequest.open
+// cannot take arguments.
+var testCounts *fakeCounts
+
+func (r *fakeRequest) open() error {
+	if testCounts.fail.Load() {
+		return errOpen
+	}
+	r.counts = testCounts
+	r.counts.opened.Add(1)
+	return nil
+}
+
+func (r *fakeRequest) release() {
+	if r.released {
+		panic("request released twice")
+	}
+	r.released = true
+	r.counts.released.Add(1)
+}
+
+func newFakeCounts(t *testing.T) *fakeCounts {
+	testCounts = &fakeCounts{}
+	t.Cleanup(func() { testCounts = nil })
+	return testCounts
+}
+
+// TestFreeListReuse checks that a call reuses the request of a finished
+// one.
+func TestFreeListReuse(t *testing.T) {
+	counts := newFakeCounts(t)
+	var l freeList[fakeRequest, *fakeRequest]
+
+	a, err := l.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := l.get()
+	if a == b {
+		t.Fatal("two calls got the same request")
+	}
+	l.put(a)
+	if c, _ := l.get(); c != a {
+		t.Error("the free request was not reused")
+	}
+	if n := counts.opened.Load(); n != 2 {
+		t.Errorf("%d requests opened, want 2", n)
+	}
+
+	counts.fail.Store(true)
+	if _, err := l.get(); err != errOpen {
+		t.Errorf("get: %v, want %v", err, errOpen)
+	}
+}
+
+// TestFreeListConcurrent runs calls from many goroutines at once, under
+// -race it finds requests used by two calls.
+func TestFreeListConcurrent(t *testing.T) {
+	counts := newFakeCounts(t)
+	var l freeList[fakeRequest, *fakeRequest]
+
+	const goroutines, calls = 16, 1000
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range calls {
+				r, err := l.get()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r.value = i
+				l.put(r)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := counts.opened.Load(); n > goroutines {
+		t.Errorf("%d requests opened for %d goroutines", n, goroutines)
+	}
+	if !l.close() {
+		t.Fatal("close of an open list failed")
+	}
+	if o, r := counts.opened.Load(), counts.released.Load(); o != r {
+		t.Errorf("%d requests opened, %d released", o, r)
+	}
+}
+
+// TestFreeListClose checks that close releases free requests at once and
+// requests in use when they are put back, that it only succeeds once and
+// that get fails afterwards.
+func TestFreeListClose(t *testing.T) {
+	counts := newFakeCounts(t)
+	var l freeList[fakeRequest, *fakeRequest]
+
+	free, _ := l.get()
+	busy, _ := l.get()
+	l.put(free)
+
+	if !l.close() {
+		t.Fatal("close of an open list failed")
+	}
+	if !free.released || busy.released {
+		t.Errorf("after close: free released %v, busy released %v", free.released, busy.released)
+	}
+	// The call blocked on busy is aborted and puts it back.
+	l.put(busy)
+	if !busy.released {
+		t.Error("request put back after close was not released")
+	}
+	if l.close() {
+		t.Error("second close succeeded")
+	}
+	// A call made after close opens no request.
+	if r, err := l.get(); r != nil || err != ErrInvalidHandle {
+		t.Errorf("get after close = %v, %v, want %v", r, err, ErrInvalidHandle)
+	}
+	if o, r := counts.opened.Load(), counts.released.Load(); o != 2 || r != 2 {
+		t.Errorf("%d requests opened, %d released, want 2 2", o, r)
+	}
+}
@@ -0,0 +1,183 @@
+package divert
+
+import (
+	"sync"
+
+	"github.com/imgk/divert-go/filter"
+)
+
+// The typed handles wrap a PacketHandle of one layer and only offer the
+// operations the layer supports. Events of the flow, socket and reflect
+// layers are received decoded, see DecodeEvent. Like Handle, a typed
+// handle can be used by any number of goroutines at once. They are opened
+// with SystemBackend.
+
+// handle holds the operations common to all layers.
+type handle struct {
+	h PacketHandle
+}
+
+// Handle returns the underlying handle, a *Handle on Windows.
+func (h handle) Handle() PacketHandle {
+	return h.h
+}
+
+// Shutdown is PacketHandle.Shutdown.
+func (h handle) Shutdown(how Shutdown) error {
+	return h.h.Shutdown(how)
+}
+
+// Close is PacketHandle.Close.
+func (h handle) Close() error {
+	return h.h.Close()
+}
+
+// GetParam is PacketHandle.GetParam.
+func (h handle) GetParam(p Param) (uint64, error) {
+	return h.h.GetParam(p)
+}
+
+// SetParam is PacketHandle.SetParam.
+func (h handle) SetParam(p Param, v uint64) error {
+	return h.h.SetParam(p, v)
+}
+
+// packetHandle holds the operations of the network layers.
+type packetHandle struct {
+	handle
+}
+
+// Recv is PacketHandle.Recv.
+func (h packetHandle) Recv(buffer []byte, address *Address) (uint, error) {
+	return h.h.Recv(buffer, address)
+}
+
+// RecvEx is PacketHandle.RecvEx.
+func (h packetHandle) RecvEx(buffer []byte, address []Address) (uint, uint, error) {
+	return h.h.RecvEx(buffer, address)
+}
+
+// Send is PacketHandle.Send.
+func (h packetHandle) Send(buffer []byte, address *Address) (uint, error) {
+	return h.h.Send(buffer, address)
+}
+
+// SendEx is PacketHandle.SendEx.
+func (h packetHandle) SendEx(buffer []byte, address []Address) (uint, error) {
+	return h.h.SendEx(buffer, address)
+}
+
+// NetworkHandle is a handle of LayerNetwork, for packets to and from the
+// local machine.
+type NetworkHandle struct {
+	packetHandle
+}
+
+// OpenNetwork opens a handle of LayerNetwork.
+func OpenNetwork(filter string, priority int16, flags uint64) (*NetworkHandle, error) {
+	h, err := SystemBackend().Open(filter, LayerNetwork, priority, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkHandle{packetHandle{handle{h}}}, nil
+}
+
+// ForwardHandle is a handle of LayerNetworkForward, for packets passing
+// through the local machine.
+type ForwardHandle struct {
+	packetHandle
+}
+
+// OpenForward opens a handle of LayerNetworkForward.
+func OpenForward(filter string, priority int16, flags uint64) (*ForwardHandle, error) {
+	h, err := SystemBackend().Open(filter, LayerNetworkForward, priority, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwardHandle{packetHandle{handle{h}}}, nil
+}
+
+// recvEvent receives an event without data and decodes it.
+func (h handle) recvEvent() (EventData, error) {
+	var addr Address
+	if _, err := h.h.Recv(nil, &addr); err != nil {
+		return nil, err
+	}
+	return DecodeEvent(&addr)
+}
+
+// FlowHandle is a handle of LayerFlow. Flow events can only be sniffed,
+// so FlagSniff and FlagRecvOnly are always set.
+type FlowHandle struct {
+	handle
+}
+
+// OpenFlow opens a handle of LayerFlow.
+func OpenFlow(filter string, priority int16, flags uint64) (*FlowHandle, error) {
+	h, err := SystemBackend().Open(filter, LayerFlow, priority, flags|FlagSniff|FlagRecvOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &FlowHandle{handle{h}}, nil
+}
+
+// Recv receives the next event, a FlowEstablished or FlowDeleted.
+func (h *FlowHandle) Recv() (EventData, error) {
+	return h.recvEvent()
+}
+
+// SocketHandle is a handle of LayerSocket. Socket events cannot be
+// injected, so FlagRecvOnly is always set. Without FlagSniff the
+// received socket operations are blocked.
+type SocketHandle struct {
+	handle
+}
+
+// OpenSocket opens a handle of LayerSocket.
+func OpenSocket(filter string, priority int16, flags uint64) (*SocketHandle, error) {
+	h, err := SystemBackend().Open(filter, LayerSocket, priority, flags|FlagRecvOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &SocketHandle{handle{h}}, nil
+}
+
+// Recv receives the next event, a SocketBind, SocketConnect,
+// SocketListen, SocketAccept or SocketClose.
+func (h *SocketHandle) Recv() (EventData, error) {
+	return h.recvEvent()
+}
+
+// reflectBuffers holds buffers for the filter objects of reflect events,
+// which are copied when decoded.
+var reflectBuffers = sync.Pool{
+	New: func() any { return new([filter.MaxObjectLength]byte) },
+}
+
+// ReflectHandle is a handle of LayerReflect. Reflect events can only be
+// sniffed, so FlagSniff and FlagRecvOnly are always set.
+type ReflectHandle struct {
+	handle
+}
+
+// OpenReflect opens a handle of LayerReflect.
+func OpenReflect(filter string, priority int16, flags uint64) (*ReflectHandle, error) {
+	h, err := SystemBackend().Open(filter, LayerReflect, priority, flags|FlagSniff|FlagRecvOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &ReflectHandle{handle{h}}, nil
+}
+
+// Recv receives the next event with the filter of the handle it
+// describes, see DecodeReflectEvent.
+func (h *ReflectHandle) Recv() (*ReflectEvent, error) {
+	var addr Address
+	buf := reflectBuffers.Get().(*[filter.MaxObjectLength]byte)
+	defer reflectBuffers.Put(buf)
+	n, err := h.h.Recv(buf[:], &addr)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReflectEvent(&addr, buf[:n])
+}
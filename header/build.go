@@ -0,0 +1,282 @@
+package header
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+// defaultTTL is used for the TTL and hop limit of built packets if unset.
+const defaultTTL = 64
+
+// IPv4Fields contains the fields of an IPv4 header for a Builder. The
+// version, header length, total length and checksum are computed.
+type IPv4Fields struct {
+	TOS uint8
+	ID  uint16
+	// Flags is a combination of IPv4FlagMoreFragments and
+	// IPv4FlagDontFragment.
+	Flags uint8
+	// FragmentOffset is in bytes and must be a multiple of 8.
+	FragmentOffset uint16
+	// TTL defaults to 64.
+	TTL uint8
+	// Protocol is set from the transport layer if there is one.
+	Protocol uint8
+	SrcAddr  netip.Addr
+	DstAddr  netip.Addr
+	// Options are padded with zeros to a multiple of 4 bytes.
+	Options []byte
+}
+
+// IPv6Fields contains the fields of an IPv6 header for a Builder. The
+// version and payload length are computed.
+type IPv6Fields struct {
+	TrafficClass uint8
+	FlowLabel    uint32
+	// NextHeader is set from the transport layer if there is one.
+	NextHeader uint8
+	// HopLimit defaults to 64.
+	HopLimit uint8
+	SrcAddr  netip.Addr
+	DstAddr  netip.Addr
+}
+
+// TCPFields contains the fields of a TCP header for a Builder. The data
+// offset and checksum are computed.
+type TCPFields struct {
+	SrcPort       uint16
+	DstPort       uint16
+	SeqNum        uint32
+	AckNum        uint32
+	Flags         uint8
+	WindowSize    uint16
+	UrgentPointer uint16
+	// Options are padded with zeros, i.e. end of option list, to a
+	// multiple of 4 bytes.
+	Options []byte
+}
+
+// UDPFields contains the ports of a UDP header for a Builder. The length
+// and checksum are computed.
+type UDPFields struct {
+	SrcPort uint16
+	DstPort uint16
+}
+
+// ICMPv4Fields contains the fields of an ICMP header for a Builder. The
+// checksum is computed.
+type ICMPv4Fields struct {
+	Type uint8
+	Code uint8
+	Body uint32
+}
+
+// ICMPv6Fields contains the fields of an ICMPv6 header for a Builder. The
+// checksum is computed.
+type ICMPv6Fields struct {
+	Type uint8
+	Code uint8
+	Body uint32
+}
+
+// NetworkFields is *IPv4Fields or *IPv6Fields.
+type NetworkFields interface {
+	networkFields()
+}
+
+// TransportFields is *TCPFields, *UDPFields, *ICMPv4Fields or *ICMPv6Fields.
+type TransportFields interface {
+	transportFields()
+}
+
+func (*IPv4Fields) networkFields()     {}
+func (*IPv6Fields) networkFields()     {}
+func (*TCPFields) transportFields()    {}
+func (*UDPFields) transportFields()    {}
+func (*ICMPv4Fields) transportFields() {}
+func (*ICMPv6Fields) transportFields() {}
+
+// Builder serializes a packet from its layers, filling in lengths,
+// protocol numbers and checksums.
+//
+//	b := header.Builder{
+//		Network:   &header.IPv4Fields{SrcAddr: src, DstAddr: dst},
+//		Transport: &header.TCPFields{SrcPort: 80, DstPort: port, Flags: header.TCPFlagRst},
+//	}
+//	pkt, err := b.Build()
+type Builder struct {
+	Network NetworkFields
+	// Transport may be nil for a raw IP packet.
+	Transport TransportFields
+	Payload   []byte
+}
+
+var (
+	errNoNetwork       = errors.New("packet without IP header")
+	errAddrFamily      = errors.New("address does not match IP version")
+	errICMPFamily      = errors.New("ICMP header does not match IP version")
+	errOptionsTooLong  = errors.New("header options too long")
+	errPacketTooLong   = errors.New("packet too long")
+	errFragmentOffset  = errors.New("fragment offset not a multiple of 8")
+	errFlowLabelTooBig = errors.New("flow label exceeds 20 bits")
+)
+
+func padded(n int) int {
+	return (n + 3) &^ 3
+}
+
+// Build returns the serialized packet.
+func (b *Builder) Build() ([]byte, error) {
+	return b.Append(nil)
+}
+
+// Append appends the serialized packet to dst.
+func (b *Builder) Append(dst []byte) ([]byte, error) {
+	var (
+		protocol uint8
+		transLen int
+	)
+	switch t := b.Transport.(type) {
+	case nil:
+	case *TCPFields:
+		protocol, transLen = TCPProtocolNumber, TCPMinimumSize+padded(len(t.Options))
+		if transLen > 60 {
+			return dst, errOptionsTooLong
+		}
+	case *UDPFields:
+		protocol, transLen = UDPProtocolNumber, UDPMinimumSize
+	case *ICMPv4Fields:
+		protocol, transLen = ICMPv4ProtocolNumber, ICMPv4MinimumSize
+	case *ICMPv6Fields:
+		protocol, transLen = ICMPv6ProtocolNumber, ICMPv6MinimumSize
+	}
+
+	// ipLen is the length of the IP header and fixed the part of the
+	// packet that the IP length field does not count.
+	var ipLen, fixed int
+	switch n := b.Network.(type) {
+	case *IPv4Fields:
+		if !n.SrcAddr.Is4() || !n.DstAddr.Is4() {
+			return dst, errAddrFamily
+		}
+		if protocol == ICMPv6ProtocolNumber {
+			return dst, errICMPFamily
+		}
+		if n.FragmentOffset%8 != 0 {
+			return dst, errFragmentOffset
+		}
+		ipLen = IPv4MinimumSize + padded(len(n.Options))
+		if ipLen > 60 {
+			return dst, errOptionsTooLong
+		}
+		if b.Transport == nil {
+			protocol = n.Protocol
+		}
+	case *IPv6Fields:
+		if !n.SrcAddr.Is6() || n.SrcAddr.Is4In6() || !n.DstAddr.Is6() || n.DstAddr.Is4In6() {
+			return dst, errAddrFamily
+		}
+		if protocol == ICMPv4ProtocolNumber {
+			return dst, errICMPFamily
+		}
+		if n.FlowLabel > 0xFFFFF {
+			return dst, errFlowLabelTooBig
+		}
+		ipLen, fixed = IPv6MinimumSize, IPv6MinimumSize
+		if b.Transport == nil {
+			protocol = n.NextHeader
+		}
+	default:
+		return dst, errNoNetwork
+	}
+	total := ipLen + transLen + len(b.Payload)
+	if total-fixed > 0xFFFF {
+		return dst, errPacketTooLong
+	}
+
+	start := len(dst)
+	dst = append(dst, make([]byte, ipLen+transLen)...)
+	dst = append(dst, b.Payload...)
+	pkt := dst[start:]
+
+	var pseudo uint16
+	switch n := b.Network.(type) {
+	case *IPv4Fields:
+		ip := IPv4(pkt[:ipLen])
+		ip[0] = IPv4Version<<4 | uint8(ipLen/4)
+		ip[1] = n.TOS
+		binary.BigEndian.PutUint16(ip[2:], uint16(total))
+		binary.BigEndian.PutUint16(ip[4:], n.ID)
+		binary.BigEndian.PutUint16(ip[6:], uint16(n.Flags&0x07)<<13|n.FragmentOffset/8)
+		ip[8] = n.TTL
+		if ip[8] == 0 {
+			ip[8] = defaultTTL
+		}
+		ip[9] = protocol
+		sa, da := n.SrcAddr.As4(), n.DstAddr.As4()
+		copy(ip[12:16], sa[:])
+		copy(ip[16:20], da[:])
+		copy(ip[IPv4MinimumSize:], n.Options)
+		ip.SetChecksum(^Checksum(ip, 0))
+		pseudo = PseudoHeaderChecksum(uint(protocol), ip[12:16], ip[16:20], uint16(transLen+len(b.Payload)))
+	case *IPv6Fields:
+		ip := IPv6(pkt[:ipLen])
+		binary.BigEndian.PutUint32(ip[0:], IPv6Version<<28|uint32(n.TrafficClass)<<20|n.FlowLabel)
+		binary.BigEndian.PutUint16(ip[4:], uint16(total-ipLen))
+		ip[6] = protocol
+		ip[7] = n.HopLimit
+		if ip[7] == 0 {
+			ip[7] = defaultTTL
+		}
+		sa, da := n.SrcAddr.As16(), n.DstAddr.As16()
+		copy(ip[8:24], sa[:])
+		copy(ip[24:40], da[:])
+		pseudo = PseudoHeaderChecksum(uint(protocol), ip[8:24], ip[24:40], uint16(transLen+len(b.Payload)))
+	}
+
+	// Checksum the transport header and payload, starting from the
+	// pseudo-header for all but ICMP.
+	hdr := pkt[ipLen : ipLen+transLen]
+	xsum := Checksumer{sum: pseudo}
+	switch t := b.Transport.(type) {
+	case *TCPFields:
+		tcp := TCP(hdr)
+		binary.BigEndian.PutUint16(tcp[0:], t.SrcPort)
+		binary.BigEndian.PutUint16(tcp[2:], t.DstPort)
+		binary.BigEndian.PutUint32(tcp[4:], t.SeqNum)
+		binary.BigEndian.PutUint32(tcp[8:], t.AckNum)
+		tcp[12] = uint8(transLen/4) << 4
+		tcp[13] = t.Flags
+		binary.BigEndian.PutUint16(tcp[14:], t.WindowSize)
+		binary.BigEndian.PutUint16(tcp[18:], t.UrgentPointer)
+		copy(tcp[TCPMinimumSize:], t.Options)
+		xsum.Add(tcp)
+		xsum.Add(b.Payload)
+		tcp.SetChecksum(^xsum.Checksum())
+	case *UDPFields:
+		udp := UDP(hdr)
+		binary.BigEndian.PutUint16(udp[0:], t.SrcPort)
+		binary.BigEndian.PutUint16(udp[2:], t.DstPort)
+		binary.BigEndian.PutUint16(udp[4:], uint16(transLen+len(b.Payload)))
+		xsum.Add(udp)
+		xsum.Add(b.Payload)
+		udp.SetChecksum(udpChecksum(^xsum.Checksum()))
+	case *ICMPv4Fields:
+		icmp := ICMPv4(hdr)
+		icmp[0], icmp[1] = t.Type, t.Code
+		binary.BigEndian.PutUint32(icmp[4:], t.Body)
+		xsum = Checksumer{}
+		xsum.Add(icmp)
+		xsum.Add(b.Payload)
+		icmp.SetChecksum(^xsum.Checksum())
+	case *ICMPv6Fields:
+		icmp := ICMPv6(hdr)
+		icmp[0], icmp[1] = t.Type, t.Code
+		binary.BigEndian.PutUint32(icmp[4:], t.Body)
+		xsum.Add(icmp)
+		xsum.Add(b.Payload)
+		icmp.SetChecksum(^xsum.Checksum())
+	}
+	return dst, nil
+}
@@ -0,0 +1,203 @@
+package header
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+var (
+	src4 = netip.MustParseAddr("10.0.0.1")
+	dst4 = netip.MustParseAddr("10.0.0.2")
+	src6 = netip.MustParseAddr("fe80::1")
+	dst6 = netip.MustParseAddr("2001:db8::2")
+)
+
+func ipv4Fields() *IPv4Fields {
+	return &IPv4Fields{TOS: 0x10, ID: 7, Flags: IPv4FlagDontFragment, TTL: 32, SrcAddr: src4, DstAddr: dst4}
+}
+
+func ipv6Fields() *IPv6Fields {
+	return &IPv6Fields{TrafficClass: 0x10, FlowLabel: 0xABCDE, HopLimit: 32, SrcAddr: src6, DstAddr: dst6}
+}
+
+// checkChecksums fails if CalcChecksums changes the packet.
+func checkChecksums(t *testing.T, name string, pkt []byte) {
+	t.Helper()
+	buf := bytes.Clone(pkt)
+	if _, ok := CalcChecksums(buf, 0); !ok || !bytes.Equal(buf, pkt) {
+		t.Errorf("%s: checksums\n%x, want\n%x", name, pkt, buf)
+	}
+}
+
+func TestBuilderRoundTrip(t *testing.T) {
+	tcp := &TCPFields{SrcPort: 40000, DstPort: 443, SeqNum: 1, AckNum: 2, Flags: TCPFlagSyn | TCPFlagAck, WindowSize: 8192, UrgentPointer: 3}
+	udp := &UDPFields{SrcPort: 40000, DstPort: 53}
+	icmp4 := &ICMPv4Fields{Type: 8, Body: 0x00010002}
+	icmp6 := &ICMPv6Fields{Type: 128, Body: 0x00010002}
+	payload := []byte("hello")
+
+	for _, tt := range []struct {
+		name      string
+		network   NetworkFields
+		transport TransportFields
+		protocol  uint8
+	}{
+		{"tcp4", ipv4Fields(), tcp, TCPProtocolNumber},
+		{"udp4", ipv4Fields(), udp, UDPProtocolNumber},
+		{"icmp4", ipv4Fields(), icmp4, ICMPv4ProtocolNumber},
+		{"raw4", &IPv4Fields{Protocol: 253, SrcAddr: src4, DstAddr: dst4}, nil, 253},
+		{"tcp6", ipv6Fields(), tcp, TCPProtocolNumber},
+		{"udp6", ipv6Fields(), udp, UDPProtocolNumber},
+		{"icmp6", ipv6Fields(), icmp6, ICMPv6ProtocolNumber},
+		{"raw6", &IPv6Fields{NextHeader: 253, SrcAddr: src6, DstAddr: dst6}, nil, 253},
+	} {
+		b := Builder{Network: tt.network, Transport: tt.transport, Payload: payload}
+		prefix := []byte("prefix")
+		buf, err := b.Append(prefix)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.HasPrefix(buf, []byte("prefix")) {
+			t.Errorf("%s: Append overwrote dst", tt.name)
+		}
+		pkt := buf[len(prefix):]
+		p, ok := ParsePacket(pkt)
+		if !ok || p.Protocol != tt.protocol || !bytes.Equal(p.Payload, payload) || p.Next != nil {
+			t.Errorf("%s: ParsePacket = %v, protocol %d, payload %q", tt.name, ok, p.Protocol, p.Payload)
+			continue
+		}
+		checkChecksums(t, tt.name, pkt)
+
+		switch n := tt.network.(type) {
+		case *IPv4Fields:
+			ip := p.IPv4
+			ttl := n.TTL
+			if ttl == 0 {
+				ttl = defaultTTL
+			}
+			if ip.TOS() != n.TOS || ip.ID() != n.ID || ip.Flags() != n.Flags || ip.TTL() != ttl ||
+				ip.TotalLength() != uint16(len(pkt)) || ip.SourceAddress() != n.SrcAddr || ip.DestinationAddress() != n.DstAddr {
+				t.Errorf("%s: IPv4 header %x", tt.name, ip)
+			}
+		case *IPv6Fields:
+			ip := p.IPv6
+			hop := n.HopLimit
+			if hop == 0 {
+				hop = defaultTTL
+			}
+			if ip.TrafficClass() != n.TrafficClass || ip.FlowLabel() != n.FlowLabel || ip.HopLimit() != hop ||
+				ip.PayloadLength() != uint16(len(pkt)-IPv6MinimumSize) || ip.SourceAddress() != n.SrcAddr || ip.DestinationAddress() != n.DstAddr {
+				t.Errorf("%s: IPv6 header %x", tt.name, ip)
+			}
+		}
+		switch tr := tt.transport.(type) {
+		case *TCPFields:
+			h := p.TCP
+			if h.SourcePort() != tr.SrcPort || h.DestinationPort() != tr.DstPort || h.SequenceNumber() != tr.SeqNum ||
+				h.AckNumber() != tr.AckNum || h.Flags() != tr.Flags || h.WindowSize() != tr.WindowSize ||
+				h.UrgentPointer() != tr.UrgentPointer || h.DataOffset() != TCPMinimumSize {
+				t.Errorf("%s: TCP header %x", tt.name, h)
+			}
+		case *UDPFields:
+			h := p.UDP
+			if h.SourcePort() != tr.SrcPort || h.DestinationPort() != tr.DstPort || h.Length() != uint16(UDPMinimumSize+len(payload)) {
+				t.Errorf("%s: UDP header %x", tt.name, h)
+			}
+		case *ICMPv4Fields:
+			if h := p.ICMPv4; h.Type() != tr.Type || h.Code() != tr.Code || h.Body() != tr.Body {
+				t.Errorf("%s: ICMP header %x", tt.name, h)
+			}
+		case *ICMPv6Fields:
+			if h := p.ICMPv6; h.Type() != tr.Type || h.Code() != tr.Code || h.Body() != tr.Body {
+				t.Errorf("%s: ICMPv6 header %x", tt.name, h)
+			}
+		}
+	}
+}
+
+func TestBuilderOptions(t *testing.T) {
+	for _, tt := range []struct {
+		tcp, ip []byte
+		// tcpLen and ipLen are the header lengths in bytes.
+		tcpLen, ipLen int
+	}{
+		{nil, nil, 20, 20},
+		{[]byte{2, 4, 5, 0xb4}, []byte{1}, 24, 24},
+		// Options are padded with zeros.
+		{[]byte{1, 1, 1}, []byte{7, 3, 4, 0, 0}, 24, 28},
+		{make([]byte, 40), make([]byte, 40), 60, 60},
+		{make([]byte, 37), make([]byte, 39), 60, 60},
+	} {
+		b := Builder{
+			Network:   &IPv4Fields{SrcAddr: src4, DstAddr: dst4, Options: tt.ip},
+			Transport: &TCPFields{Options: tt.tcp},
+		}
+		pkt, err := b.Build()
+		if err != nil {
+			t.Errorf("options %d %d: %v", len(tt.tcp), len(tt.ip), err)
+			continue
+		}
+		p, ok := ParsePacket(pkt)
+		if !ok || len(p.IPv4) != tt.ipLen || len(p.TCP) != tt.tcpLen || len(pkt) != tt.ipLen+tt.tcpLen {
+			t.Errorf("options %d %d: headers of %d and %d bytes, want %d and %d", len(tt.tcp), len(tt.ip), len(p.IPv4), len(p.TCP), tt.ipLen, tt.tcpLen)
+			continue
+		}
+		wantTCP := make([]byte, tt.tcpLen-TCPMinimumSize)
+		copy(wantTCP, tt.tcp)
+		wantIP := make([]byte, tt.ipLen-IPv4MinimumSize)
+		copy(wantIP, tt.ip)
+		if !bytes.Equal(p.TCP.Options(), wantTCP) || !bytes.Equal(p.IPv4.Options(), wantIP) {
+			t.Errorf("options %x %x, want %x %x", p.TCP.Options(), p.IPv4.Options(), wantTCP, wantIP)
+		}
+		checkChecksums(t, "options", pkt)
+	}
+}
+
+func TestBuilderError(t *testing.T) {
+	mapped := netip.MustParseAddr("::ffff:10.0.0.1")
+	for _, tt := range []struct {
+		name string
+		b    Builder
+		err  error
+	}{
+		{"no network", Builder{Transport: &UDPFields{}}, errNoNetwork},
+		{"IPv6 address in IPv4", Builder{Network: &IPv4Fields{SrcAddr: src4, DstAddr: dst6}}, errAddrFamily},
+		{"4in6 address in IPv4", Builder{Network: &IPv4Fields{SrcAddr: mapped, DstAddr: dst4}}, errAddrFamily},
+		{"invalid address", Builder{Network: &IPv4Fields{SrcAddr: src4}}, errAddrFamily},
+		{"IPv4 address in IPv6", Builder{Network: &IPv6Fields{SrcAddr: src4, DstAddr: dst6}}, errAddrFamily},
+		{"4in6 address in IPv6", Builder{Network: &IPv6Fields{SrcAddr: src6, DstAddr: mapped}}, errAddrFamily},
+		{"ICMPv6 in IPv4", Builder{Network: ipv4Fields(), Transport: &ICMPv6Fields{}}, errICMPFamily},
+		{"ICMP in IPv6", Builder{Network: ipv6Fields(), Transport: &ICMPv4Fields{}}, errICMPFamily},
+		{"fragment offset", Builder{Network: &IPv4Fields{SrcAddr: src4, DstAddr: dst4, FragmentOffset: 4}}, errFragmentOffset},
+		{"flow label", Builder{Network: &IPv6Fields{SrcAddr: src6, DstAddr: dst6, FlowLabel: 1 << 20}}, errFlowLabelTooBig},
+		{"TCP options", Builder{Network: ipv4Fields(), Transport: &TCPFields{Options: make([]byte, 41)}}, errOptionsTooLong},
+		{"IPv4 options", Builder{Network: &IPv4Fields{SrcAddr: src4, DstAddr: dst4, Options: make([]byte, 41)}}, errOptionsTooLong},
+		// The IPv4 total length counts the header, the IPv6 payload
+		// length not.
+		{"IPv4 length", Builder{Network: ipv4Fields(), Payload: make([]byte, 0xFFFF-IPv4MinimumSize+1)}, errPacketTooLong},
+		{"IPv6 length", Builder{Network: ipv6Fields(), Transport: &UDPFields{}, Payload: make([]byte, 0xFFFF-UDPMinimumSize+1)}, errPacketTooLong},
+	} {
+		dst := []byte("dst")
+		buf, err := tt.b.Append(dst)
+		if err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+		if string(buf) != "dst" {
+			t.Errorf("%s: dst changed to %q", tt.name, buf)
+		}
+	}
+
+	// The longest packets still build.
+	for _, b := range []Builder{
+		{Network: ipv4Fields(), Payload: make([]byte, 0xFFFF-IPv4MinimumSize)},
+		{Network: ipv6Fields(), Transport: &UDPFields{}, Payload: make([]byte, 0xFFFF-UDPMinimumSize)},
+		{Network: &IPv4Fields{SrcAddr: src4, DstAddr: dst4, FragmentOffset: 1480, Flags: IPv4FlagMoreFragments}},
+		{Network: &IPv6Fields{SrcAddr: src6, DstAddr: dst6, FlowLabel: 0xFFFFF}},
+	} {
+		if _, err := b.Build(); err != nil {
+			t.Errorf("Build: %v", err)
+		}
+	}
+}
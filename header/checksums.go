@@ -0,0 +1,99 @@
+package header
+
+// Flags of CalcChecksums, with the values of the
+// WINDIVERT_HELPER_NO_*_CHECKSUM flags.
+const (
+	NoIPChecksum     = 1
+	NoICMPChecksum   = 2
+	NoICMPv6Checksum = 4
+	NoTCPChecksum    = 8
+	NoUDPChecksum    = 16
+)
+
+// Checksums is a set of checksums written by CalcChecksums, matching the
+// IPChecksum, TCPChecksum and UDPChecksum bits of a WinDivert address.
+type Checksums uint8
+
+const (
+	IPChecksum Checksums = 1 << iota
+	TCPChecksum
+	UDPChecksum
+)
+
+// CalcChecksums recomputes the IPv4, ICMP, ICMPv6, TCP and UDP checksums of
+// the first packet of buf in place, skipping those excluded by flags, the
+// way WinDivertHelperCalcChecksums does. It returns the checksums it wrote
+// and false if buf does not start with an IP packet, or if a transport
+// checksum is due but the packet is truncated or a fragment.
+func CalcChecksums(buf []byte, flags uint64) (Checksums, bool) {
+	var p Packet
+	if !p.Parse(buf) {
+		return 0, false
+	}
+
+	var done Checksums
+	if p.IPv4 != nil && flags&NoIPChecksum == 0 {
+		p.IPv4.SetChecksum(0)
+		p.IPv4.SetChecksum(^Checksum(p.IPv4, 0))
+		done |= IPChecksum
+	}
+
+	partial := p.Truncated || p.MoreFragments || p.FragmentOffset != 0
+	switch {
+	case p.ICMPv4 != nil:
+		if flags&NoICMPChecksum != 0 {
+			return done, true
+		}
+		if partial {
+			return done, false
+		}
+		p.ICMPv4.SetChecksum(0)
+		p.ICMPv4.SetChecksum(^Checksum(p.Payload, Checksum(p.ICMPv4, 0)))
+
+	case p.ICMPv6 != nil:
+		if flags&NoICMPv6Checksum != 0 {
+			return done, true
+		}
+		if partial {
+			return done, false
+		}
+		xsum := p.pseudoHeaderChecksum(ICMPv6ProtocolNumber, len(p.ICMPv6))
+		p.ICMPv6.SetChecksum(0)
+		p.ICMPv6.SetChecksum(^Checksum(p.Payload, Checksum(p.ICMPv6, xsum)))
+
+	case p.TCP != nil:
+		if flags&NoTCPChecksum != 0 {
+			return done, true
+		}
+		if partial {
+			return done, false
+		}
+		xsum := p.pseudoHeaderChecksum(TCPProtocolNumber, len(p.TCP))
+		p.TCP.SetChecksum(0)
+		p.TCP.SetChecksum(^Checksum(p.Payload, Checksum(p.TCP, xsum)))
+		done |= TCPChecksum
+
+	case p.UDP != nil:
+		if flags&NoUDPChecksum != 0 {
+			return done, true
+		}
+		if partial {
+			return done, false
+		}
+		xsum := p.pseudoHeaderChecksum(UDPProtocolNumber, len(p.UDP))
+		p.UDP.SetChecksum(0)
+		p.UDP.SetChecksum(udpChecksum(^Checksum(p.Payload, Checksum(p.UDP, xsum))))
+		done |= UDPChecksum
+	}
+	return done, true
+}
+
+// pseudoHeaderChecksum returns the checksum of the pseudo-header of a
+// transport header of length hdrLen followed by the payload.
+func (p *Packet) pseudoHeaderChecksum(protocol uint, hdrLen int) uint16 {
+	length := uint16(hdrLen + len(p.Payload))
+	if p.IPv4 != nil {
+		return PseudoHeaderChecksum(protocol, p.IPv4[12:16], p.IPv4[16:20], length)
+	}
+	return PseudoHeaderChecksum(protocol, p.IPv6[8:24], p.IPv6[24:40], length)
+}
@@ -0,0 +1,86 @@
+package header
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The packets below carry a wrong IPv4 checksum and zero transport
+// checksums. Their checksummed forms were produced by
+// WinDivertHelperCalcChecksums of divert/windivert_shared.c, built with a
+// small shim of windows.h, with the IPChecksum, TCPChecksum and
+// UDPChecksum bits it set in the address as sums.
+
+var checksumPackets = map[string]string{
+	"tcp4":       "4500002d000100004006dead0a0000010a0000029c400050000000000000000050022000000000001603010005",
+	"tcp4opts":   "46000032000100004006dead0a0000010a000002010101009c40005000000000000000006002200000000000000000006162",
+	"udp4":       "45000021000100004011dead0a0000010a0000029c400035000d000068656c6c6f",
+	"icmp4":      "45000020000100004001dead0a0000010a000002080000000001000270696e67",
+	"tcp6":       "6000000000170640fe80000000000000000000000000000120010db80000000000000000000000029c40005000000000000000005002200000000000616263",
+	"udp6":       "60000000000b1140fe80000000000000000000000000000120010db80000000000000000000000029c400035000b0000616263",
+	"icmp6":      "60000000000c3a40fe80000000000000000000000000000120010db8000000000000000000000002800000000001000270696e67",
+	"ext6":       "60000000001e0040fe80000000000000000000000000000120010db800000000000000000000000206000104000000009c400050000000000000000050022000000000007879",
+	"udp4zero":   "4500001e000100004011dead0a0000010a0000029c400035000a00004f62",
+	"frag4first": "4500002c000120004006dead0a0000010a0000029c4000500000000000000000500220000000000061626364",
+	"frag4":      "45000020000100b94006dead0a0000010a0000029c4000506162636465666768",
+	"trunc4":     "45000064000100004011dead0a0000010a0000029c400035000c000061626364",
+	"short":      "4500001c00010000401166ce0a0000010a0000",
+}
+
+var checksumTests = []struct {
+	name        string
+	flags       uint64
+	ok          bool
+	sums        Checksums
+	checksummed string
+}{
+	{"tcp4", 0, true, IPChecksum | TCPChecksum, "4500002d00010000400666c80a0000010a0000029c400050000000000000000050022000c34700001603010005"},
+	{"tcp4opts", 0, true, IPChecksum | TCPChecksum, "4600003200010000400663c20a0000010a000002010101009c4000500000000000000000600220006de70000000000006162"},
+	{"udp4", 0, true, IPChecksum | UDPChecksum, "4500002100010000401166c90a0000010a0000029c400035000d0b8a68656c6c6f"},
+	{"icmp4", 0, true, IPChecksum, "4500002000010000400166da0a0000010a0000020800192c0001000270696e67"},
+	{"tcp6", 0, true, TCPChecksum, "6000000000170640fe80000000000000000000000000000120010db80000000000000000000000029c40005000000000000000005002200002b00000616263"},
+	{"udp6", 0, true, UDPChecksum, "60000000000b1140fe80000000000000000000000000000120010db80000000000000000000000029c400035000b72c3616263"},
+	{"icmp6", 0, true, 0, "60000000000c3a40fe80000000000000000000000000000120010db8000000000000000000000002800074a80001000270696e67"},
+	{"ext6", 0, true, TCPChecksum, "60000000001e0040fe80000000000000000000000000000120010db800000000000000000000000206000104000000009c4000500000000000000000500220004e9a00007879"},
+	// A UDP checksum of zero is sent as 0xFFFF.
+	{"udp4zero", 0, true, IPChecksum | UDPChecksum, "4500001e00010000401166cc0a0000010a0000029c400035000affff4f62"},
+	// Transport checksums of fragments and truncated packets fail unless excluded.
+	{"frag4first", 0, false, IPChecksum, "4500002c00012000400646c90a0000010a0000029c4000500000000000000000500220000000000061626364"},
+	{"frag4", 0, true, IPChecksum, "45000020000100b94006661c0a0000010a0000029c4000506162636465666768"},
+	{"trunc4", 0, false, IPChecksum, "4500006400010000401166860a0000010a0000029c400035000c000061626364"},
+	{"short", 0, false, 0, "4500001c00010000401166ce0a0000010a0000"},
+
+	{"tcp4", NoIPChecksum, true, TCPChecksum, "4500002d000100004006dead0a0000010a0000029c400050000000000000000050022000c34700001603010005"},
+	{"tcp4", NoTCPChecksum, true, IPChecksum, "4500002d00010000400666c80a0000010a0000029c400050000000000000000050022000000000001603010005"},
+	{"tcp4", NoIPChecksum | NoICMPChecksum | NoICMPv6Checksum | NoTCPChecksum | NoUDPChecksum, true, 0, "4500002d000100004006dead0a0000010a0000029c400050000000000000000050022000000000001603010005"},
+	{"udp4", NoTCPChecksum, true, IPChecksum | UDPChecksum, "4500002100010000401166c90a0000010a0000029c400035000d0b8a68656c6c6f"},
+	{"udp4", NoUDPChecksum, true, IPChecksum, "4500002100010000401166c90a0000010a0000029c400035000d000068656c6c6f"},
+	{"icmp4", NoICMPChecksum, true, IPChecksum, "4500002000010000400166da0a0000010a000002080000000001000270696e67"},
+	{"icmp4", NoICMPv6Checksum, true, IPChecksum, "4500002000010000400166da0a0000010a0000020800192c0001000270696e67"},
+	{"icmp6", NoICMPv6Checksum, true, 0, "60000000000c3a40fe80000000000000000000000000000120010db8000000000000000000000002800000000001000270696e67"},
+	{"tcp6", NoTCPChecksum, true, 0, "6000000000170640fe80000000000000000000000000000120010db80000000000000000000000029c40005000000000000000005002200000000000616263"},
+	{"udp6", NoUDPChecksum, true, 0, "60000000000b1140fe80000000000000000000000000000120010db80000000000000000000000029c400035000b0000616263"},
+	{"frag4first", NoTCPChecksum, true, IPChecksum, "4500002c00012000400646c90a0000010a0000029c4000500000000000000000500220000000000061626364"},
+	{"trunc4", NoUDPChecksum, true, IPChecksum, "4500006400010000401166860a0000010a0000029c400035000c000061626364"},
+}
+
+func TestCalcChecksums(t *testing.T) {
+	for _, tt := range checksumTests {
+		buf, err := hex.DecodeString(checksumPackets[tt.name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := hex.DecodeString(tt.checksummed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums, ok := CalcChecksums(buf, tt.flags)
+		if ok != tt.ok || sums != tt.sums {
+			t.Errorf("CalcChecksums(%s, %#x) = %03b %v, want %03b %v", tt.name, tt.flags, sums, ok, tt.sums, tt.ok)
+		}
+		if !bytes.Equal(buf, want) {
+			t.Errorf("CalcChecksums(%s, %#x) wrote\n%x, want\n%x", tt.name, tt.flags, buf, want)
+		}
+	}
+}
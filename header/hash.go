@@ -0,0 +1,177 @@
+package header
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+)
+
+// The xxHash64 primes.
+const (
+	prime64_1 = 11400714785074694791
+	prime64_2 = 14029467366897019727
+	prime64_3 = 1609587929392839161
+	prime64_4 = 9650029242287828579
+	prime64_5 = 2870177450012600261
+)
+
+// hashPadding is the SHA2 IV used to pad the hash input.
+var hashPadding = [9]uint64{
+	0x428A2F9871374491, 0xB5C0FBCFE9B5DBA5, 0x3956C25B59F111F1,
+	0x923F82A4AB1C5ED5, 0xD807AA9812835B01, 0x243185BE550C7DC3,
+	0x72BE5D7480DEB1FE, 0x9BDC06A7C19BF174, 0xE49B69C1EFBE4786,
+}
+
+func xxh64Round(acc, input uint64) uint64 {
+	acc += input * prime64_2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime64_1
+}
+
+func xxh64MergeRound(acc, val uint64) uint64 {
+	acc ^= xxh64Round(0, val)
+	return acc*prime64_1 + prime64_4
+}
+
+// HashPacket returns the hash of the first packet of buf like
+// WinDivertHelperHashPacket, 0 if the packet cannot be parsed. The hash
+// covers the IP and transport headers, so it differs between the two
+// directions of a connection; see HashFlow.
+func HashPacket(buf []byte, seed uint64) uint64 {
+	p, ok := ParsePacket(buf)
+	if !ok {
+		return 0
+	}
+	return p.Hash(seed)
+}
+
+// Hash is WinDivertHashPacket of windivert_hash.c, the xxHash64 variant
+// seeded with the packet headers that is also used for the random fields
+// of filters.
+func (p *Packet) Hash(seed uint64) uint64 {
+	le64 := binary.LittleEndian.Uint64
+	le32 := binary.LittleEndian.Uint32
+
+	var v [4]uint64
+	var v2, v3, v4 uint64
+	i := 0
+	v1 := seed ^ hashPadding[0]
+	switch {
+	case p.IPv4 != nil:
+		v2 = le64(p.IPv4[0:]) ^ hashPadding[1]
+		v3 = le64(p.IPv4[8:]) ^ hashPadding[2]
+		v4 = uint64(le32(p.IPv4[16:])) ^ hashPadding[3]
+	case p.IPv6 != nil:
+		v2 = le64(p.IPv6[0:]) ^ hashPadding[1]
+		v3 = le64(p.IPv6[8:]) ^ hashPadding[2]
+		v4 = le64(p.IPv6[16:]) ^ hashPadding[3]
+		v[0] = le64(p.IPv6[24:]) ^ hashPadding[4]
+		v[1] = le64(p.IPv6[32:]) ^ hashPadding[5]
+		i = 2
+	default:
+		return 0
+	}
+
+	var next []byte
+	switch {
+	case p.TCP != nil:
+		v[i] = le64(p.TCP[0:]) ^ hashPadding[i+4]
+		i++
+		v[i] = le64(p.TCP[8:]) ^ hashPadding[i+4]
+		i++
+		if i <= 3 {
+			v[i] = uint64(le32(p.TCP[16:])) ^ hashPadding[i+4]
+			i++
+		} else {
+			v2 ^= uint64(le32(p.TCP[16:])) << 32
+		}
+	case p.UDP != nil:
+		next = p.UDP
+	case p.ICMPv4 != nil:
+		next = p.ICMPv4
+	case p.ICMPv6 != nil:
+		next = p.ICMPv6
+	}
+	if next != nil {
+		v[i] = le64(next) ^ hashPadding[i+4]
+		i++
+	}
+	for ; i <= 3; i++ {
+		v[i] = seed ^ hashPadding[i+4]
+	}
+
+	v1 = xxh64Round(v[0], v1)
+	v2 = xxh64Round(v[1], v2)
+	v3 = xxh64Round(v[2], v3)
+	v4 = xxh64Round(v[3], v4)
+	h := bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+		bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+	h = xxh64MergeRound(h, v1)
+	h = xxh64MergeRound(h, v2)
+	h = xxh64MergeRound(h, v3)
+	h = xxh64MergeRound(h, v4)
+	h += 32 // "length"
+	return xxh64Avalanche(h)
+}
+
+func xxh64Avalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= prime64_2
+	h ^= h >> 29
+	h *= prime64_3
+	h ^= h >> 32
+	return h
+}
+
+// HashFlow returns a hash of the protocol, addresses and ports of the first
+// packet of buf, 0 if the packet cannot be parsed. Swapping source and
+// destination does not change the hash, so both directions of a connection
+// hash alike. Ports are taken as 0 for packets without a TCP or UDP header,
+// including fragments other than the first.
+func HashFlow(buf []byte, seed uint64) uint64 {
+	p, ok := ParsePacket(buf)
+	if !ok {
+		return 0
+	}
+	return p.HashFlow(seed)
+}
+
+// HashFlow is the symmetric flow hash of the packet, see HashFlow.
+func (p *Packet) HashFlow(seed uint64) uint64 {
+	var src, dst [16]byte
+	switch {
+	case p.IPv4 != nil:
+		src = p.IPv4.SourceAddress().As16()
+		dst = p.IPv4.DestinationAddress().As16()
+	case p.IPv6 != nil:
+		src = [16]byte(p.IPv6[8:24])
+		dst = [16]byte(p.IPv6[24:40])
+	default:
+		return 0
+	}
+	var srcPort, dstPort uint16
+	switch {
+	case p.TCP != nil:
+		srcPort, dstPort = p.TCP.SourcePort(), p.TCP.DestinationPort()
+	case p.UDP != nil:
+		srcPort, dstPort = p.UDP.SourcePort(), p.UDP.DestinationPort()
+	}
+
+	// order the endpoints so that both directions give the same input
+	if c := bytes.Compare(src[:], dst[:]); c > 0 || (c == 0 && srcPort > dstPort) {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	be64 := binary.BigEndian.Uint64
+	words := [...]uint64{
+		be64(src[0:]), be64(src[8:]), be64(dst[0:]), be64(dst[8:]),
+		uint64(srcPort)<<32 | uint64(dstPort)<<16 | uint64(p.Protocol),
+	}
+	h := seed + prime64_5 + 8*uint64(len(words))
+	for _, w := range words {
+		h ^= xxh64Round(0, w)
+		h = bits.RotateLeft64(h, 27)*prime64_1 + prime64_4
+	}
+	return xxh64Avalanche(h)
+}
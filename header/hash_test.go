@@ -0,0 +1,65 @@
+package header
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// The hashes below were produced by WinDivertHelperHashPacket of
+// divert/windivert_helper.c, built with a small shim of windows.h, for the
+// seeds 0, 1, 0x123456789abcdef0 and ^0.
+
+var hashSeeds = [4]uint64{0, 1, 0x123456789abcdef0, ^uint64(0)}
+
+var hashTests = []struct {
+	name   string
+	packet string
+	hash   [4]uint64
+}{
+	{
+		"tcp4",
+		"4500002c00010000200686c90a0000010a0000029c400050000000000000000050020000e848000016030100",
+		[4]uint64{0xd8e53c5890a16327, 0x25bde0a8f454ca0d, 0x7f86dae0015019b0, 0xaa45f790edfef5cc},
+	},
+	{
+		"udp4",
+		"4500002000010000201186ca0a0000010a0000029c400035000c385b16030100",
+		[4]uint64{0xb2c9159a4a376b3a, 0x89e47f6e81a6861c, 0x49d923972d77c2ee, 0x12b6e67898f95bb},
+	},
+	{
+		"icmp4",
+		"4500001c00010000200186de0a0000010a0000020800f7fc00010002",
+		[4]uint64{0x5b532a862d96e616, 0xb5e64fee2feb7dd2, 0x96231d4903781fba, 0x2c5a41407b94e181},
+	},
+	{
+		"tcp6",
+		"6000000000180620fe80000000000000000000000000000120010db80000000000000000000000029c4001bb000000000000000050100000ce95000016030100",
+		[4]uint64{0x913012ff0910b144, 0xfe83f40ef1f20dc5, 0xa6867f9c6847a3fc, 0xdd78c3b37bc6a5ee},
+	},
+	{
+		"udp6",
+		"6000000000081120fe80000000000000000000000000000120010db800000000000000000000000200359c400008372c",
+		[4]uint64{0x346a21c444a7f2a0, 0xd4d2a7c4367c189b, 0xdf7ebebee7bc30e0, 0x13d7882abab6e228},
+	},
+	{
+		"icmp6",
+		"6000000000083a20fe80000000000000000000000000000120010db80000000000000000000000028000537d00010002",
+		[4]uint64{0x52a0761f0c93da33, 0x5ebca91584a45053, 0x7a4cc13c2560892f, 0xb2d7ac5857cd2369},
+	},
+	{"short", "4500002c0001", [4]uint64{}},
+	{"badver", "5500002000010000201186ca0a0000010a0000029c400035000c385b16030100", [4]uint64{}},
+}
+
+func TestHashPacket(t *testing.T) {
+	for _, tt := range hashTests {
+		b, err := hex.DecodeString(tt.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, seed := range hashSeeds {
+			if h := HashPacket(b, seed); h != tt.hash[i] {
+				t.Errorf("HashPacket(%s, %#x) = %#x, want %#x", tt.name, seed, h, tt.hash[i])
+			}
+		}
+	}
+}
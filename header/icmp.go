@@ -0,0 +1,75 @@
+package header
+
+import "encoding/binary"
+
+const (
+	// ICMPv4MinimumSize is the size of the ICMP header.
+	ICMPv4MinimumSize = 8
+
+	// ICMPv4ProtocolNumber is ICMP's transport protocol number.
+	ICMPv4ProtocolNumber = 1
+
+	// ICMPv6MinimumSize is the size of the ICMPv6 header.
+	ICMPv6MinimumSize = 8
+
+	// ICMPv6ProtocolNumber is ICMPv6's transport protocol number.
+	ICMPv6ProtocolNumber = 58
+)
+
+// ICMPv4 represents an ICMP header stored in a byte array.
+type ICMPv4 []byte
+
+// Type returns the "type" field.
+func (b ICMPv4) Type() uint8 {
+	return b[0]
+}
+
+// Code returns the "code" field.
+func (b ICMPv4) Code() uint8 {
+	return b[1]
+}
+
+// Checksum returns the "checksum" field.
+func (b ICMPv4) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// SetChecksum sets the "checksum" field.
+func (b ICMPv4) SetChecksum(xsum uint16) {
+	PutChecksum(b[2:], xsum)
+}
+
+// Body returns the rest of the header, such as the identifier and sequence
+// number of an echo message.
+func (b ICMPv4) Body() uint32 {
+	return binary.BigEndian.Uint32(b[4:])
+}
+
+// ICMPv6 represents an ICMPv6 header stored in a byte array.
+type ICMPv6 []byte
+
+// Type returns the "type" field.
+func (b ICMPv6) Type() uint8 {
+	return b[0]
+}
+
+// Code returns the "code" field.
+func (b ICMPv6) Code() uint8 {
+	return b[1]
+}
+
+// Checksum returns the "checksum" field.
+func (b ICMPv6) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// SetChecksum sets the "checksum" field.
+func (b ICMPv6) SetChecksum(xsum uint16) {
+	PutChecksum(b[2:], xsum)
+}
+
+// Body returns the rest of the header, such as the identifier and sequence
+// number of an echo message.
+func (b ICMPv6) Body() uint32 {
+	return binary.BigEndian.Uint32(b[4:])
+}
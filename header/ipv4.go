@@ -0,0 +1,93 @@
+package header
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	// IPv4MinimumSize is the minimum size of a valid IPv4 packet.
+	IPv4MinimumSize = 20
+
+	// IPv4Version is the version of the IPv4 protocol.
+	IPv4Version = 4
+
+	// IPv4FlagMoreFragments is the "more fragments" bit of Flags.
+	IPv4FlagMoreFragments = 1 << 0
+	// IPv4FlagDontFragment is the "don't fragment" bit of Flags.
+	IPv4FlagDontFragment = 1 << 1
+)
+
+// IPv4 represents an IPv4 header stored in a byte array.
+type IPv4 []byte
+
+// HeaderLength returns the value of the "header length" field in bytes.
+func (b IPv4) HeaderLength() uint8 {
+	return (b[0] & 0x0F) * 4
+}
+
+// TOS returns the "type of service" field.
+func (b IPv4) TOS() uint8 {
+	return b[1]
+}
+
+// TotalLength returns the "total length" field.
+func (b IPv4) TotalLength() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// ID returns the "identification" field.
+func (b IPv4) ID() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// Flags returns the "flags" field, see IPv4FlagMoreFragments and
+// IPv4FlagDontFragment.
+func (b IPv4) Flags() uint8 {
+	return (b[6] >> 5) & 0x07
+}
+
+// More returns whether the "more fragments" flag is set.
+func (b IPv4) More() bool {
+	return b.Flags()&IPv4FlagMoreFragments != 0
+}
+
+// FragmentOffset returns the "fragment offset" field in bytes.
+func (b IPv4) FragmentOffset() uint16 {
+	return (binary.BigEndian.Uint16(b[6:]) & 0x1FFF) * 8
+}
+
+// TTL returns the "TTL" field.
+func (b IPv4) TTL() uint8 {
+	return b[8]
+}
+
+// Protocol returns the "protocol" field.
+func (b IPv4) Protocol() uint8 {
+	return b[9]
+}
+
+// Checksum returns the "checksum" field.
+func (b IPv4) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[10:])
+}
+
+// SetChecksum sets the "checksum" field.
+func (b IPv4) SetChecksum(xsum uint16) {
+	PutChecksum(b[10:], xsum)
+}
+
+// SourceAddress returns the "source address" field.
+func (b IPv4) SourceAddress() netip.Addr {
+	return netip.AddrFrom4([4]byte(b[12:16]))
+}
+
+// DestinationAddress returns the "destination address" field.
+func (b IPv4) DestinationAddress() netip.Addr {
+	return netip.AddrFrom4([4]byte(b[16:20]))
+}
+
+// Options returns the options of the header.
+func (b IPv4) Options() []byte {
+	return b[IPv4MinimumSize:min(int(b.HeaderLength()), len(b))]
+}
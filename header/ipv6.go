@@ -0,0 +1,56 @@
+package header
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	// IPv6MinimumSize is the size of the fixed IPv6 header.
+	IPv6MinimumSize = 40
+
+	// IPv6Version is the version of the IPv6 protocol.
+	IPv6Version = 6
+
+	// IPv6FragmentHeaderSize is the size of the IPv6 fragment extension
+	// header.
+	IPv6FragmentHeaderSize = 8
+)
+
+// IPv6 represents an IPv6 header stored in a byte array.
+type IPv6 []byte
+
+// TrafficClass returns the "traffic class" field.
+func (b IPv6) TrafficClass() uint8 {
+	return b[0]<<4 | b[1]>>4
+}
+
+// FlowLabel returns the "flow label" field.
+func (b IPv6) FlowLabel() uint32 {
+	return binary.BigEndian.Uint32(b[0:]) & 0x000FFFFF
+}
+
+// PayloadLength returns the "payload length" field.
+func (b IPv6) PayloadLength() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// NextHeader returns the "next header" field.
+func (b IPv6) NextHeader() uint8 {
+	return b[6]
+}
+
+// HopLimit returns the "hop limit" field.
+func (b IPv6) HopLimit() uint8 {
+	return b[7]
+}
+
+// SourceAddress returns the "source address" field.
+func (b IPv6) SourceAddress() netip.Addr {
+	return netip.AddrFrom16([16]byte(b[8:24]))
+}
+
+// DestinationAddress returns the "destination address" field.
+func (b IPv6) DestinationAddress() netip.Addr {
+	return netip.AddrFrom16([16]byte(b[24:40]))
+}
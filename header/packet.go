@@ -0,0 +1,169 @@
+package header
+
+import "encoding/binary"
+
+// IPv6 extension headers skipped by Parse.
+const (
+	ipv6HopOpts  = 0
+	ipv6Routing  = 43
+	ipv6Fragment = 44
+	ipv6AH       = 51
+	ipv6DstOpts  = 60
+	ipv6MH       = 135
+)
+
+// Packet is a packet split into its headers. The headers, Payload and Next
+// are sub-slices of the parsed buffer and nil when absent.
+type Packet struct {
+	IPv4   IPv4
+	IPv6   IPv6
+	ICMPv4 ICMPv4
+	ICMPv6 ICMPv6
+	TCP    TCP
+	UDP    UDP
+
+	// Payload is the data following the last recognized header.
+	Payload []byte
+	// Next is the remainder of a batch buffer after this packet.
+	Next []byte
+
+	// Protocol is the transport protocol, after IPv6 extension headers.
+	Protocol uint8
+	// Fragment is set for IP fragments, the transport header is only
+	// parsed for the first fragment.
+	Fragment bool
+	// MoreFragments is the "more fragments" flag.
+	MoreFragments bool
+	// FragmentOffset is the fragment offset in bytes.
+	FragmentOffset uint16
+	// Truncated is set if the buffer is shorter than the IP header claims.
+	Truncated bool
+	// HeaderLength is the length of all headers, i.e. the offset of
+	// Payload.
+	HeaderLength int
+}
+
+// ParsePacket parses the first packet of buf the way
+// WinDivertHelperParsePacket does. It fails if buf does not start with a
+// sane IPv4 or IPv6 header or the packet is truncated.
+//
+// Nothing is copied. A batch buffer as returned by RecvEx is walked with
+//
+//	for p, ok := header.ParsePacket(buf); ok; p, ok = header.ParsePacket(p.Next) {
+//	}
+func ParsePacket(buf []byte) (p Packet, ok bool) {
+	if !p.Parse(buf) || p.Truncated {
+		return Packet{}, false
+	}
+	return p, true
+}
+
+// Parse sets p to the first packet of buf like ParsePacket, but accepts
+// truncated packets and only marks them as Truncated.
+func (p *Packet) Parse(buf []byte) bool {
+	*p = Packet{}
+	if len(buf) < IPv4MinimumSize {
+		return false
+	}
+
+	var (
+		data      []byte
+		totalLen  int
+		packetLen int
+	)
+	switch buf[0] >> 4 {
+	case IPv4Version:
+		hdrLen := int(buf[0]&0x0F) * 4
+		if hdrLen < IPv4MinimumSize {
+			return false
+		}
+		totalLen = int(binary.BigEndian.Uint16(buf[2:]))
+		if totalLen < hdrLen || len(buf) < hdrLen {
+			return false
+		}
+		p.IPv4 = IPv4(buf[:hdrLen])
+		p.Protocol = p.IPv4.Protocol()
+		p.FragmentOffset = p.IPv4.FragmentOffset()
+		p.MoreFragments = p.IPv4.More()
+		p.Fragment = p.MoreFragments || p.FragmentOffset != 0
+		packetLen = min(totalLen, len(buf))
+		data = buf[hdrLen:packetLen]
+
+	case IPv6Version:
+		if len(buf) < IPv6MinimumSize {
+			return false
+		}
+		p.IPv6 = IPv6(buf[:IPv6MinimumSize])
+		p.Protocol = p.IPv6.NextHeader()
+		totalLen = int(p.IPv6.PayloadLength()) + IPv6MinimumSize
+		packetLen = min(totalLen, len(buf))
+		data = buf[IPv6MinimumSize:packetLen]
+
+		for p.FragmentOffset == 0 && len(data) >= 2 {
+			hdrLen := int(data[1])
+			ext := true
+			switch p.Protocol {
+			case ipv6Fragment:
+				hdrLen = IPv6FragmentHeaderSize
+				if p.Fragment || len(data) < hdrLen {
+					ext = false
+					break
+				}
+				p.FragmentOffset = binary.BigEndian.Uint16(data[2:]) & 0xFFF8
+				p.MoreFragments = data[3]&0x01 != 0
+				p.Fragment = true
+			case ipv6AH:
+				hdrLen = (hdrLen + 2) * 4
+			case ipv6HopOpts, ipv6DstOpts, ipv6Routing, ipv6MH:
+				hdrLen = (hdrLen + 1) * 8
+			default:
+				ext = false
+			}
+			if !ext || len(data) < hdrLen {
+				break
+			}
+			p.Protocol = data[0]
+			data = data[hdrLen:]
+		}
+
+	default:
+		return false
+	}
+
+	if p.FragmentOffset == 0 {
+		hdrLen := 0
+		switch p.Protocol {
+		case TCPProtocolNumber:
+			if len(data) >= TCPMinimumSize && data[12]>>4 >= 5 {
+				hdrLen = min(int(data[12]>>4)*4, len(data))
+				p.TCP = TCP(data[:hdrLen])
+			}
+		case UDPProtocolNumber:
+			if len(data) >= UDPMinimumSize {
+				hdrLen = UDPMinimumSize
+				p.UDP = UDP(data[:hdrLen])
+			}
+		case ICMPv4ProtocolNumber:
+			if p.IPv4 != nil && len(data) >= ICMPv4MinimumSize {
+				hdrLen = ICMPv4MinimumSize
+				p.ICMPv4 = ICMPv4(data[:hdrLen])
+			}
+		case ICMPv6ProtocolNumber:
+			if p.IPv6 != nil && len(data) >= ICMPv6MinimumSize {
+				hdrLen = ICMPv6MinimumSize
+				p.ICMPv6 = ICMPv6(data[:hdrLen])
+			}
+		}
+		data = data[hdrLen:]
+	}
+
+	p.HeaderLength = packetLen - len(data)
+	if len(data) != 0 {
+		p.Payload = data
+	}
+	p.Truncated = totalLen > len(buf)
+	if totalLen < len(buf) {
+		p.Next = buf[packetLen:]
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+package header
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// parseResult is what WinDivertHelperParsePacket returns for a packet, with
+// the headers, data and next packet as offsets into the buffer, -1 if
+// absent.
+type parseResult struct {
+	ok                  bool
+	ipv4, ipv6          int
+	protocol            uint8
+	icmpv4, icmpv6      int
+	tcp, udp            int
+	payload, payloadLen int
+	next, nextLen       int
+}
+
+// The results below were produced by WinDivertHelperParsePacket of
+// divert/windivert_helper.c, built with a small shim of windows.h. A batch
+// is walked through Next until the parser fails or no packet is left.
+
+var parseTests = []struct {
+	name    string
+	packet  string
+	results []parseResult
+}{
+	{
+		"tcp4",
+		"4500002c00010000400666c90a0000010a0000029c4000500000000000000000500220000000000016030100",
+		[]parseResult{{true, 0, -1, 6, -1, -1, 20, -1, 40, 4, -1, 0}},
+	},
+	{
+		"tcp4opts",
+		"4600003200010000400663c20a0000010a000002010101009c40005000000000000000006002200000000000000000006162",
+		[]parseResult{{true, 0, -1, 6, -1, -1, 24, -1, 48, 2, -1, 0}},
+	},
+	{
+		"icmp4",
+		"4500001e00010000400166dc0a0000010a0000020800f7fc000100027879",
+		[]parseResult{{true, 0, -1, 1, 20, -1, -1, -1, 28, 2, -1, 0}},
+	},
+	{
+		"icmpv6in4",
+		"4500001c00010000403a66a50a0000010a0000020800f7fc00010002",
+		[]parseResult{{true, 0, -1, 58, -1, -1, -1, -1, 20, 8, -1, 0}},
+	},
+	{
+		"frag4first",
+		"4500002c00012000400646c90a0000010a0000029c4000500000000000000000500220000000000061626364",
+		[]parseResult{{true, 0, -1, 6, -1, -1, 20, -1, 40, 4, -1, 0}},
+	},
+	{
+		"frag4",
+		"45000020000100b94006661c0a0000010a0000029c4000506162636465666768",
+		[]parseResult{{true, 0, -1, 6, -1, -1, -1, -1, 20, 12, -1, 0}},
+	},
+	{
+		"frag4last",
+		"4500002000010001401166c90a0000010a0000029c400035000c000061626364",
+		[]parseResult{{true, 0, -1, 17, -1, -1, -1, -1, 20, 12, -1, 0}},
+	},
+	{
+		"tcpshortoff",
+		"4500002c00010000400666c90a0000010a0000029c4000500000000000000000400220000000000061626364",
+		[]parseResult{{true, 0, -1, 6, -1, -1, -1, -1, 20, 24, -1, 0}},
+	},
+	{
+		"tcptruncoff",
+		"4500002c00010000400666c90a0000010a0000029c4000500000000000000000f00220000000000000000000",
+		[]parseResult{{true, 0, -1, 6, -1, -1, 20, -1, -1, 0, -1, 0}},
+	},
+	{
+		"tcpshort",
+		"4500002000010000400666d50a0000010a0000029c4000500000000000000000",
+		[]parseResult{{true, 0, -1, 6, -1, -1, -1, -1, 20, 12, -1, 0}},
+	},
+	{
+		"trunc4",
+		"4500006400010000400666910a0000010a0000029c4000500000000000000000500220000000000061626364",
+		[]parseResult{{false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"ihl4",
+		"4400001400010000400667e10a0000010a000002",
+		[]parseResult{{false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"ihlbig",
+		"4f0000140001000040065ce10a0000010a000002",
+		[]parseResult{{false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"short",
+		"4500001c00010000401166ce0a0000010a0000",
+		[]parseResult{{false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"badver",
+		"5500001c00010000401166ce0a0000010a0000029c40003500080000",
+		[]parseResult{{false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"udp6",
+		"60000000000b1140fe80000000000000000000000000000120010db80000000000000000000000029c400035000b0000616263",
+		[]parseResult{{true, -1, 0, 17, -1, -1, -1, 40, 48, 3, -1, 0}},
+	},
+	{
+		"icmp6",
+		"6000000000083a40fe80000000000000000000000000000120010db80000000000000000000000028000537d00010002",
+		[]parseResult{{true, -1, 0, 58, -1, 40, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"icmp4in6",
+		"6000000000080140fe80000000000000000000000000000120010db80000000000000000000000020800f7fc00010002",
+		[]parseResult{{true, -1, 0, 1, -1, -1, -1, -1, 40, 8, -1, 0}},
+	},
+	{
+		"ext6",
+		"60000000002e0040fe80000000000000000000000000000120010db80000000000000000000000023c000104000000000601010c0000000000000000000000009c400050000000000000000050022000000000007879",
+		[]parseResult{{true, -1, 0, 6, -1, -1, 64, -1, 84, 2, -1, 0}},
+	},
+	{
+		"ah6",
+		"6000000000143340fe80000000000000000000000000000120010db80000000000000000000000021101000000000000000000009c40003500080000",
+		[]parseResult{{true, -1, 0, 17, -1, -1, -1, 52, -1, 0, -1, 0}},
+	},
+	{
+		"frag6",
+		"6000000000102c40fe80000000000000000000000000000120010db8000000000000000000000002060005c8000000019c40005061626364",
+		[]parseResult{{true, -1, 0, 6, -1, -1, -1, -1, 48, 8, -1, 0}},
+	},
+	{
+		"frag6first",
+		"6000000000122c40fe80000000000000000000000000000120010db800000000000000000000000211000001000000019c400035000a00006162",
+		[]parseResult{{true, -1, 0, 17, -1, -1, -1, 48, 56, 2, -1, 0}},
+	},
+	{
+		"frag6twice",
+		"6000000000182c40fe80000000000000000000000000000120010db80000000000000000000000022c0000010000000111000000000000019c40003500080000",
+		[]parseResult{{true, -1, 0, 44, -1, -1, -1, -1, 48, 16, -1, 0}},
+	},
+	{
+		"ext6trunc",
+		"6000000000080040fe80000000000000000000000000000120010db80000000000000000000000020603000000000000",
+		[]parseResult{{true, -1, 0, 0, -1, -1, -1, -1, 40, 8, -1, 0}},
+	},
+	{
+		"trunc6",
+		"6000000000281140fe80000000000000000000000000000120010db80000000000000000000000029c400035000c000061626364",
+		[]parseResult{{false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+	{
+		"batch",
+		"4500001e00010000401166cc0a0000010a0000029c400035000a000061626000000000083a40fe80000000000000000000000000000120010db80000000000000000000000028000537d0001000245000020000100b94006661c0a0000010a0000029c40005061626364656667684500002c00010000400666c90a0000010a0000029c4000500000000000000000500220000000000016030100",
+		[]parseResult{{true, 0, -1, 17, -1, -1, -1, 20, 28, 2, 30, 124}, {true, -1, 30, 58, -1, 70, -1, -1, -1, 0, 78, 76}, {true, 78, -1, 6, -1, -1, -1, -1, 98, 12, 110, 44}, {true, 110, -1, 6, -1, -1, 130, -1, 150, 4, -1, 0}},
+	},
+	{
+		"batchtrunc",
+		"60000000000b1140fe80000000000000000000000000000120010db80000000000000000000000029c400035000b00006162634500006400010000400666910a0000010a0000029c4000500000000000000000500220000000000061626364",
+		[]parseResult{{true, -1, 0, 17, -1, -1, -1, 40, 48, 3, 51, 44}, {false, -1, -1, 0, -1, -1, -1, -1, -1, 0, -1, 0}},
+	},
+}
+
+// offset returns the offset of sub in buf, or -1 if sub is nil.
+func offset(buf, sub []byte) int {
+	if sub == nil {
+		return -1
+	}
+	return cap(buf) - cap(sub)
+}
+
+func TestParsePacket(t *testing.T) {
+	for _, tt := range parseTests {
+		buf, err := hex.DecodeString(tt.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := buf
+		for i, want := range tt.results {
+			p, ok := ParsePacket(next)
+			got := parseResult{
+				ok:         ok,
+				ipv4:       offset(buf, p.IPv4),
+				ipv6:       offset(buf, p.IPv6),
+				protocol:   p.Protocol,
+				icmpv4:     offset(buf, p.ICMPv4),
+				icmpv6:     offset(buf, p.ICMPv6),
+				tcp:        offset(buf, p.TCP),
+				udp:        offset(buf, p.UDP),
+				payload:    offset(buf, p.Payload),
+				payloadLen: len(p.Payload),
+				next:       offset(buf, p.Next),
+				nextLen:    len(p.Next),
+			}
+			if got != want {
+				t.Errorf("ParsePacket(%s) packet %d = %+v, want %+v", tt.name, i, got, want)
+			}
+			if ok && p.Payload != nil && offset(buf, p.Payload)-offset(buf, next) != p.HeaderLength {
+				t.Errorf("ParsePacket(%s) packet %d: HeaderLength %d, payload at %d", tt.name, i, p.HeaderLength, offset(buf, p.Payload)-offset(buf, next))
+			}
+			next = p.Next
+		}
+		if _, ok := ParsePacket(next); ok && tt.results[len(tt.results)-1].ok {
+			t.Errorf("ParsePacket(%s) parsed more than %d packets", tt.name, len(tt.results))
+		}
+	}
+}
+
+func parseTest(t *testing.T, name string) []byte {
+	t.Helper()
+	for _, tt := range parseTests {
+		if tt.name == name {
+			buf, err := hex.DecodeString(tt.packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return buf
+		}
+	}
+	t.Fatalf("no packet %s", name)
+	return nil
+}
+
+func TestParsePacketFragment(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		more   bool
+		offset uint16
+	}{
+		{"frag4first", true, 0},
+		{"frag4", false, 1480},
+		{"frag4last", false, 8},
+		{"frag6", false, 1480},
+		{"frag6first", true, 0},
+	} {
+		p, ok := ParsePacket(parseTest(t, tt.name))
+		if !ok || !p.Fragment || p.MoreFragments != tt.more || p.FragmentOffset != tt.offset {
+			t.Errorf("ParsePacket(%s): %v, Fragment %v, MoreFragments %v, FragmentOffset %d, want true true %v %d",
+				tt.name, ok, p.Fragment, p.MoreFragments, p.FragmentOffset, tt.more, tt.offset)
+		}
+	}
+	if p, _ := ParsePacket(parseTest(t, "tcp4")); p.Fragment || p.MoreFragments || p.FragmentOffset != 0 {
+		t.Errorf("ParsePacket(tcp4): Fragment %v", p.Fragment)
+	}
+}
+
+// TestPacketParseTruncated checks that Parse accepts packets shorter than
+// their IP header claims, which ParsePacket rejects.
+func TestPacketParseTruncated(t *testing.T) {
+	var p Packet
+	if !p.Parse(parseTest(t, "trunc4")) || !p.Truncated || p.TCP == nil || string(p.Payload) != "abcd" || p.Next != nil {
+		t.Errorf("Parse(trunc4): Truncated %v, TCP %x, Payload %q, Next %x", p.Truncated, p.TCP, p.Payload, p.Next)
+	}
+	if !p.Parse(parseTest(t, "trunc6")) || !p.Truncated || p.UDP == nil || string(p.Payload) != "abcd" {
+		t.Errorf("Parse(trunc6): Truncated %v, UDP %x, Payload %q", p.Truncated, p.UDP, p.Payload)
+	}
+	if !p.Parse(parseTest(t, "tcp4")) || p.Truncated {
+		t.Errorf("Parse(tcp4): Truncated %v", p.Truncated)
+	}
+	if p.Parse(parseTest(t, "short")) || p.Parse(parseTest(t, "badver")) || p.Parse(parseTest(t, "ihl4")) {
+		t.Error("Parse accepted a broken IP header")
+	}
+}
@@ -0,0 +1,157 @@
+package header
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+var (
+	errInvalidPacket = errors.New("invalid IPv4 or IPv6 packet")
+	errNoPorts       = errors.New("packet without TCP or UDP header")
+)
+
+// The Rewrite functions change a field of the first packet of buf in place
+// and update the IPv4 and transport checksums incrementally, including the
+// pseudo-header part of the latter, so the packet needs no CalcChecksums
+// afterwards. A packet with a wrong checksum keeps it wrong. UDP packets
+// without a checksum keep having none.
+//
+// To change several fields of a packet, parse it once and use the methods
+// of Packet instead.
+
+// RewriteSrcAddr sets the source address of the packet.
+func RewriteSrcAddr(buf []byte, addr netip.Addr) error {
+	return rewrite(buf, func(p *Packet) error { return p.RewriteSrcAddr(addr) })
+}
+
+// RewriteDstAddr sets the destination address of the packet.
+func RewriteDstAddr(buf []byte, addr netip.Addr) error {
+	return rewrite(buf, func(p *Packet) error { return p.RewriteDstAddr(addr) })
+}
+
+// RewriteSrcPort sets the source port of a TCP or UDP packet.
+func RewriteSrcPort(buf []byte, port uint16) error {
+	return rewrite(buf, func(p *Packet) error { return p.RewriteSrcPort(port) })
+}
+
+// RewriteDstPort sets the destination port of a TCP or UDP packet.
+func RewriteDstPort(buf []byte, port uint16) error {
+	return rewrite(buf, func(p *Packet) error { return p.RewriteDstPort(port) })
+}
+
+// RewriteTTL sets the TTL of an IPv4 packet or the hop limit of an IPv6
+// packet.
+func RewriteTTL(buf []byte, ttl uint8) error {
+	return rewrite(buf, func(p *Packet) error { return p.RewriteTTL(ttl) })
+}
+
+func rewrite(buf []byte, f func(*Packet) error) error {
+	var p Packet
+	if !p.Parse(buf) {
+		return errInvalidPacket
+	}
+	return f(&p)
+}
+
+// RewriteSrcAddr is like the RewriteSrcAddr function.
+func (p *Packet) RewriteSrcAddr(addr netip.Addr) error {
+	if p.IPv4 != nil {
+		return p.rewriteAddr(p.IPv4[12:16], addr)
+	}
+	return p.rewriteAddr(p.IPv6[8:24], addr)
+}
+
+// RewriteDstAddr is like the RewriteDstAddr function.
+func (p *Packet) RewriteDstAddr(addr netip.Addr) error {
+	if p.IPv4 != nil {
+		return p.rewriteAddr(p.IPv4[16:20], addr)
+	}
+	return p.rewriteAddr(p.IPv6[24:40], addr)
+}
+
+// rewriteAddr replaces the address field b of the IP header by addr.
+func (p *Packet) rewriteAddr(b []byte, addr netip.Addr) error {
+	var a [16]byte
+	if p.IPv4 != nil {
+		if !addr.Unmap().Is4() {
+			return errAddrFamily
+		}
+		a4 := addr.Unmap().As4()
+		copy(a[:], a4[:])
+	} else {
+		if !addr.Is6() {
+			return errAddrFamily
+		}
+		a = addr.As16()
+	}
+	addrBytes := a[:len(b)]
+
+	if p.IPv4 != nil {
+		p.IPv4.SetChecksum(^checksumUpdate2ByteAlignedAddress(^p.IPv4.Checksum(), b, addrBytes))
+	}
+	switch {
+	case p.TCP != nil:
+		p.TCP.SetChecksum(^checksumUpdate2ByteAlignedAddress(^p.TCP.Checksum(), b, addrBytes))
+	case p.UDP != nil:
+		if xsum := p.UDP.Checksum(); xsum != 0 {
+			p.UDP.SetChecksum(udpChecksum(^checksumUpdate2ByteAlignedAddress(^xsum, b, addrBytes)))
+		}
+	case p.ICMPv6 != nil:
+		p.ICMPv6.SetChecksum(^checksumUpdate2ByteAlignedAddress(^p.ICMPv6.Checksum(), b, addrBytes))
+	}
+	copy(b, addrBytes)
+	return nil
+}
+
+// RewriteSrcPort is like the RewriteSrcPort function.
+func (p *Packet) RewriteSrcPort(port uint16) error {
+	return p.rewritePort(0, port)
+}
+
+// RewriteDstPort is like the RewriteDstPort function.
+func (p *Packet) RewriteDstPort(port uint16) error {
+	return p.rewritePort(2, port)
+}
+
+// rewritePort sets the port at offset off of the transport header.
+func (p *Packet) rewritePort(off int, port uint16) error {
+	switch {
+	case p.TCP != nil:
+		old := binary.BigEndian.Uint16(p.TCP[off:])
+		p.TCP.SetChecksum(^checksumUpdate2ByteAlignedUint16(^p.TCP.Checksum(), old, port))
+		binary.BigEndian.PutUint16(p.TCP[off:], port)
+	case p.UDP != nil:
+		old := binary.BigEndian.Uint16(p.UDP[off:])
+		if xsum := p.UDP.Checksum(); xsum != 0 {
+			p.UDP.SetChecksum(udpChecksum(^checksumUpdate2ByteAlignedUint16(^xsum, old, port)))
+		}
+		binary.BigEndian.PutUint16(p.UDP[off:], port)
+	default:
+		return errNoPorts
+	}
+	return nil
+}
+
+// RewriteTTL is like the RewriteTTL function.
+func (p *Packet) RewriteTTL(ttl uint8) error {
+	if p.IPv6 != nil {
+		p.IPv6[7] = ttl
+		return nil
+	}
+	// The TTL shares a 16 bit word of the checksum with the protocol.
+	old := binary.BigEndian.Uint16(p.IPv4[8:])
+	word := uint16(ttl)<<8 | old&0xFF
+	p.IPv4.SetChecksum(^checksumUpdate2ByteAlignedUint16(^p.IPv4.Checksum(), old, word))
+	p.IPv4[8] = ttl
+	return nil
+}
+
+// udpChecksum maps a computed checksum of 0 to 0xFFFF, since 0 means no
+// checksum for UDP.
+func udpChecksum(xsum uint16) uint16 {
+	if xsum == 0 {
+		return 0xFFFF
+	}
+	return xsum
+}
@@ -0,0 +1,189 @@
+package header
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+func buildPacket(t *testing.T, network NetworkFields, transport TransportFields) []byte {
+	t.Helper()
+	b := Builder{Network: network, Transport: transport, Payload: []byte("rewrite")}
+	pkt, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestRewrite(t *testing.T) {
+	v4 := &IPv4Fields{TTL: 64, SrcAddr: src4, DstAddr: dst4}
+	v6 := &IPv6Fields{HopLimit: 64, SrcAddr: src6, DstAddr: dst6}
+	tcp := &TCPFields{SrcPort: 40000, DstPort: 443, Flags: TCPFlagSyn}
+	udp := &UDPFields{SrcPort: 40000, DstPort: 53}
+
+	newAddr4 := netip.MustParseAddr("192.168.255.254")
+	newAddr6 := netip.MustParseAddr("2001:db8:ffff::fffe")
+	for _, tt := range []struct {
+		name string
+		pkt  []byte
+		addr netip.Addr
+	}{
+		{"tcp4", buildPacket(t, v4, tcp), newAddr4},
+		{"udp4", buildPacket(t, v4, udp), newAddr4},
+		{"icmp4", buildPacket(t, v4, &ICMPv4Fields{Type: 8}), newAddr4},
+		{"tcp6", buildPacket(t, v6, tcp), newAddr6},
+		{"udp6", buildPacket(t, v6, udp), newAddr6},
+		{"icmp6", buildPacket(t, v6, &ICMPv6Fields{Type: 128}), newAddr6},
+	} {
+		for _, rw := range []struct {
+			name string
+			f    func([]byte) error
+			// get returns the rewritten field.
+			get  func(p *Packet) any
+			want any
+		}{
+			{"RewriteSrcAddr", func(b []byte) error { return RewriteSrcAddr(b, tt.addr) }, srcAddr, tt.addr},
+			{"RewriteDstAddr", func(b []byte) error { return RewriteDstAddr(b, tt.addr) }, dstAddr, tt.addr},
+			{"RewriteSrcPort", func(b []byte) error { return RewriteSrcPort(b, 0xfffe) }, srcPort, uint16(0xfffe)},
+			{"RewriteDstPort", func(b []byte) error { return RewriteDstPort(b, 1) }, dstPort, uint16(1)},
+			{"RewriteTTL", func(b []byte) error { return RewriteTTL(b, 255) }, ttl, uint8(255)},
+		} {
+			buf := bytes.Clone(tt.pkt)
+			err := rw.f(buf)
+			if isICMP := tt.name[:4] == "icmp"; isICMP && (rw.name == "RewriteSrcPort" || rw.name == "RewriteDstPort") {
+				if err != errNoPorts || !bytes.Equal(buf, tt.pkt) {
+					t.Errorf("%s(%s): %v, want %v", rw.name, tt.name, err, errNoPorts)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s(%s): %v", rw.name, tt.name, err)
+				continue
+			}
+			p, _ := ParsePacket(buf)
+			if got := rw.get(&p); got != rw.want {
+				t.Errorf("%s(%s) set %v, want %v", rw.name, tt.name, got, rw.want)
+			}
+			checkChecksums(t, rw.name+"("+tt.name+")", buf)
+		}
+	}
+}
+
+func srcAddr(p *Packet) any {
+	if p.IPv4 != nil {
+		return p.IPv4.SourceAddress()
+	}
+	return p.IPv6.SourceAddress()
+}
+
+func dstAddr(p *Packet) any {
+	if p.IPv4 != nil {
+		return p.IPv4.DestinationAddress()
+	}
+	return p.IPv6.DestinationAddress()
+}
+
+func srcPort(p *Packet) any {
+	if p.TCP != nil {
+		return p.TCP.SourcePort()
+	}
+	return p.UDP.SourcePort()
+}
+
+func dstPort(p *Packet) any {
+	if p.TCP != nil {
+		return p.TCP.DestinationPort()
+	}
+	return p.UDP.DestinationPort()
+}
+
+func ttl(p *Packet) any {
+	if p.IPv4 != nil {
+		return p.IPv4.TTL()
+	}
+	return p.IPv6.HopLimit()
+}
+
+// TestRewriteUDPChecksum checks that a UDP packet without a checksum keeps
+// having none, and that a checksum folding to 0 is written as 0xFFFF.
+func TestRewriteUDPChecksum(t *testing.T) {
+	for _, network := range []NetworkFields{
+		&IPv4Fields{SrcAddr: src4, DstAddr: dst4},
+		&IPv6Fields{SrcAddr: src6, DstAddr: dst6},
+	} {
+		pkt := buildPacket(t, network, &UDPFields{SrcPort: 40000, DstPort: 53})
+		p, _ := ParsePacket(pkt)
+		p.UDP.SetChecksum(0)
+		if err := p.RewriteSrcPort(1); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.RewriteDstAddr(srcAddr(&p).(netip.Addr)); err != nil {
+			t.Fatal(err)
+		}
+		if xsum := p.UDP.Checksum(); xsum != 0 {
+			t.Errorf("rewritten UDP packet without checksum has checksum %#x", xsum)
+		}
+
+		// Find the source port for which the checksum is 0xFFFF.
+		pkt = buildPacket(t, network, &UDPFields{SrcPort: 40000, DstPort: 53})
+		p, _ = ParsePacket(pkt)
+		port := -1
+		for i := range 0x10000 {
+			buf := bytes.Clone(pkt)
+			binary.BigEndian.PutUint16(buf[len(p.IPv4)+len(p.IPv6):], uint16(i))
+			CalcChecksums(buf, 0)
+			if q, _ := ParsePacket(buf); q.UDP.Checksum() == 0xFFFF {
+				port = i
+				break
+			}
+		}
+		if port < 0 {
+			t.Fatal("no port with a checksum of 0xFFFF")
+		}
+		if err := RewriteSrcPort(pkt, uint16(port)); err != nil {
+			t.Fatal(err)
+		}
+		if xsum := p.UDP.Checksum(); xsum != 0xFFFF {
+			t.Errorf("RewriteSrcPort(%d) set checksum %#x, want 0xffff", port, xsum)
+		}
+		checkChecksums(t, "RewriteSrcPort", pkt)
+	}
+}
+
+func TestRewriteError(t *testing.T) {
+	tcp4 := buildPacket(t, &IPv4Fields{SrcAddr: src4, DstAddr: dst4}, &TCPFields{})
+	tcp6 := buildPacket(t, &IPv6Fields{SrcAddr: src6, DstAddr: dst6}, &TCPFields{})
+	frag := buildPacket(t, &IPv4Fields{SrcAddr: src4, DstAddr: dst4, Protocol: TCPProtocolNumber, FragmentOffset: 8}, nil)
+	for _, tt := range []struct {
+		name string
+		pkt  []byte
+		f    func([]byte) error
+		err  error
+	}{
+		{"IPv6 address in IPv4", tcp4, func(b []byte) error { return RewriteSrcAddr(b, dst6) }, errAddrFamily},
+		{"IPv4 address in IPv6", tcp6, func(b []byte) error { return RewriteDstAddr(b, dst4) }, errAddrFamily},
+		{"invalid address", tcp4, func(b []byte) error { return RewriteDstAddr(b, netip.Addr{}) }, errAddrFamily},
+		{"port of a fragment", frag, func(b []byte) error { return RewriteDstPort(b, 1) }, errNoPorts},
+		{"short packet", tcp4[:10], func(b []byte) error { return RewriteTTL(b, 1) }, errInvalidPacket},
+	} {
+		buf := bytes.Clone(tt.pkt)
+		if err := tt.f(buf); err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+		if !bytes.Equal(buf, tt.pkt) {
+			t.Errorf("%s: packet changed", tt.name)
+		}
+	}
+
+	// An IPv4-mapped address is accepted for an IPv4 packet.
+	mapped := netip.MustParseAddr("::ffff:192.168.0.1")
+	if err := RewriteSrcAddr(tcp4, mapped); err != nil {
+		t.Errorf("RewriteSrcAddr of an IPv4-mapped address: %v", err)
+	}
+	if p, _ := ParsePacket(tcp4); p.IPv4.SourceAddress() != mapped.Unmap() {
+		t.Errorf("source address %v, want %v", p.IPv4.SourceAddress(), mapped.Unmap())
+	}
+	checkChecksums(t, "RewriteSrcAddr", tcp4)
+}
@@ -0,0 +1,80 @@
+package header
+
+import "encoding/binary"
+
+const (
+	// TCPMinimumSize is the minimum size of a valid TCP header.
+	TCPMinimumSize = 20
+
+	// TCPProtocolNumber is TCP's transport protocol number.
+	TCPProtocolNumber = 6
+)
+
+// Flags of the TCP header.
+const (
+	TCPFlagFin = 1 << iota
+	TCPFlagSyn
+	TCPFlagRst
+	TCPFlagPsh
+	TCPFlagAck
+	TCPFlagUrg
+)
+
+// TCP represents a TCP header stored in a byte array.
+type TCP []byte
+
+// SourcePort returns the "source port" field.
+func (b TCP) SourcePort() uint16 {
+	return binary.BigEndian.Uint16(b[0:])
+}
+
+// DestinationPort returns the "destination port" field.
+func (b TCP) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// SequenceNumber returns the "sequence number" field.
+func (b TCP) SequenceNumber() uint32 {
+	return binary.BigEndian.Uint32(b[4:])
+}
+
+// AckNumber returns the "ack number" field.
+func (b TCP) AckNumber() uint32 {
+	return binary.BigEndian.Uint32(b[8:])
+}
+
+// DataOffset returns the "data offset" field, the header length in bytes.
+func (b TCP) DataOffset() uint8 {
+	return (b[12] >> 4) * 4
+}
+
+// Flags returns the flags field, see TCPFlagFin and friends.
+func (b TCP) Flags() uint8 {
+	return b[13] & 0x3F
+}
+
+// WindowSize returns the "window size" field.
+func (b TCP) WindowSize() uint16 {
+	return binary.BigEndian.Uint16(b[14:])
+}
+
+// Checksum returns the "checksum" field.
+func (b TCP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[16:])
+}
+
+// SetChecksum sets the "checksum" field.
+func (b TCP) SetChecksum(xsum uint16) {
+	PutChecksum(b[16:], xsum)
+}
+
+// UrgentPointer returns the "urgent pointer" field.
+func (b TCP) UrgentPointer() uint16 {
+	return binary.BigEndian.Uint16(b[18:])
+}
+
+// Options returns the options of the header. They are cut short if the
+// header is truncated.
+func (b TCP) Options() []byte {
+	return b[TCPMinimumSize:min(int(b.DataOffset()), len(b))]
+}
@@ -0,0 +1,39 @@
+package header
+
+import "encoding/binary"
+
+const (
+	// UDPMinimumSize is the size of the UDP header.
+	UDPMinimumSize = 8
+
+	// UDPProtocolNumber is UDP's transport protocol number.
+	UDPProtocolNumber = 17
+)
+
+// UDP represents a UDP header stored in a byte array.
+type UDP []byte
+
+// SourcePort returns the "source port" field.
+func (b UDP) SourcePort() uint16 {
+	return binary.BigEndian.Uint16(b[0:])
+}
+
+// DestinationPort returns the "destination port" field.
+func (b UDP) DestinationPort() uint16 {
+	return binary.BigEndian.Uint16(b[2:])
+}
+
+// Length returns the "length" field.
+func (b UDP) Length() uint16 {
+	return binary.BigEndian.Uint16(b[4:])
+}
+
+// Checksum returns the "checksum" field.
+func (b UDP) Checksum() uint16 {
+	return binary.BigEndian.Uint16(b[6:])
+}
+
+// SetChecksum sets the "checksum" field.
+func (b UDP) SetChecksum(xsum uint16) {
+	PutChecksum(b[6:], xsum)
+}
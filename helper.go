@@ -0,0 +1,100 @@
+package divert
+
+import (
+	"github.com/imgk/divert-go/filter"
+	"github.com/imgk/divert-go/header"
+)
+
+// checkFilter validates the filter before it is passed to the driver, so
+// a bad filter is reported as a *FilterError rather than ErrInvalidParameter.
+func checkFilter(s string, layer Layer) error {
+	return toFilterError(filter.Validate(s, filter.Layer(layer)))
+}
+
+// CompileFilter compiles a filter string into the object representation
+// of WinDivertHelperCompileFilter, which Open accepts in place of the string.
+// A bad filter is reported as a *FilterError.
+func CompileFilter(s string, layer Layer) ([]byte, error) {
+	object, err := filter.CompileFilter(s, filter.Layer(layer))
+	if err != nil {
+		return nil, toFilterError(err)
+	}
+	return object, nil
+}
+
+// FormatFilter formats a filter object as a filter string. For a reflect
+// event the object is the received data and layer is Reflect().Layer().
+func FormatFilter(object []byte, layer Layer) (string, error) {
+	return filter.FormatFilter(object, filter.Layer(layer))
+}
+
+// EvalFilter reports whether a packet and its address match the filter,
+// like WinDivertHelperEvalFilter but without a call into the DLL. To
+// evaluate the same filter many times, use filter.Compile and
+// Address.FilterAddress instead.
+func EvalFilter(s string, packet []byte, addr *Address) (bool, error) {
+	fa := addr.FilterAddress()
+	return filter.EvalFilter(s, packet, &fa)
+}
+
+// CalcChecksums recomputes the checksums of the first packet in buffer
+// like WinDivertHelperCalcChecksums, see header.CalcChecksums. The
+// checksum-valid bits of address, which may be nil, are set for the
+// checksums written.
+func CalcChecksums(buffer []byte, address *Address, flags uint64) bool {
+	done, ok := header.CalcChecksums(buffer, flags)
+	if address != nil {
+		if done&header.IPChecksum != 0 {
+			address.SetIPChecksum(true)
+		}
+		if done&header.TCPChecksum != 0 {
+			address.SetTCPChecksum(true)
+		}
+		if done&header.UDPChecksum != 0 {
+			address.SetUDPChecksum(true)
+		}
+	}
+	return ok
+}
+
+// HashPacket returns the hash of the first packet in buffer like
+// WinDivertHelperHashPacket, see header.HashPacket.
+func HashPacket(buffer []byte, seed uint64) uint64 {
+	return header.HashPacket(buffer, seed)
+}
+
+// ParseIPv4Address parses a dotted IPv4 address into host byte order like
+// WinDivertHelperParseIPv4Address.
+func ParseIPv4Address(s string) (uint32, error) {
+	return filter.ParseIPv4Address(s)
+}
+
+// ParseIPv6Address parses an IPv6 address like
+// WinDivertHelperParseIPv6Address, see filter.ParseIPv6Address.
+func ParseIPv6Address(s string) ([4]uint32, error) {
+	return filter.ParseIPv6Address(s)
+}
+
+// FormatIPv4Address formats an IPv4 address in host byte order like
+// WinDivertHelperFormatIPv4Address.
+func FormatIPv4Address(addr uint32) string {
+	return filter.FormatIPv4Address(addr)
+}
+
+// FormatIPv6Address formats an IPv6 address like
+// WinDivertHelperFormatIPv6Address.
+func FormatIPv6Address(addr [4]uint32) string {
+	return filter.FormatIPv6Address(addr)
+}
+
+// HtonIPv6Address converts an IPv6 address to network byte order like
+// WinDivertHelperHtonIPv6Address.
+func HtonIPv6Address(addr [4]uint32) [4]uint32 {
+	return filter.HtonIPv6Address(addr)
+}
+
+// NtohIPv6Address converts an IPv6 address to host byte order like
+// WinDivertHelperNtohIPv6Address.
+func NtohIPv6Address(addr [4]uint32) [4]uint32 {
+	return filter.NtohIPv6Address(addr)
+}
@@ -0,0 +1,52 @@
+package divert
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/imgk/divert-go/header"
+)
+
+func TestCalcChecksumsAddress(t *testing.T) {
+	const (
+		tcp4 = "4500002d000100004006dead0a0000010a0000029c400050000000000000000050022000000000001603010005"
+		udp6 = "60000000000b1140fe80000000000000000000000000000120010db80000000000000000000000029c400035000b0000616263"
+		frag = "4500002c000120004006dead0a0000010a0000029c4000500000000000000000500220000000000061626364"
+	)
+	for _, tt := range []struct {
+		packet       string
+		flags        uint64
+		ok           bool
+		ip, tcp, udp bool
+	}{
+		{tcp4, 0, true, true, true, false},
+		{tcp4, header.NoIPChecksum, true, false, true, false},
+		{tcp4, header.NoTCPChecksum, true, true, false, false},
+		{udp6, 0, true, false, false, true},
+		{udp6, header.NoUDPChecksum, true, false, false, false},
+		// The IPv4 checksum of a fragment is written, its TCP checksum not.
+		{frag, 0, false, true, false, false},
+	} {
+		buf, err := hex.DecodeString(tt.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addr Address
+		ok := CalcChecksums(buf, &addr, tt.flags)
+		if ok != tt.ok || addr.IPChecksum() != tt.ip || addr.TCPChecksum() != tt.tcp || addr.UDPChecksum() != tt.udp {
+			t.Errorf("CalcChecksums(%.8s…, %#x) = %v, bits %v %v %v, want %v, %v %v %v", tt.packet, tt.flags,
+				ok, addr.IPChecksum(), addr.TCPChecksum(), addr.UDPChecksum(), tt.ok, tt.ip, tt.tcp, tt.udp)
+		}
+	}
+
+	// Like WinDivertHelperCalcChecksums, bits are set but never cleared.
+	buf, _ := hex.DecodeString(tcp4)
+	var addr Address
+	addr.SetUDPChecksum(true)
+	if !CalcChecksums(buf, &addr, header.NoIPChecksum) || addr.IPChecksum() || !addr.TCPChecksum() || !addr.UDPChecksum() {
+		t.Errorf("bits %v %v %v, want false true true", addr.IPChecksum(), addr.TCPChecksum(), addr.UDPChecksum())
+	}
+	if !CalcChecksums(buf, nil, 0) {
+		t.Error("CalcChecksums without address failed")
+	}
+}
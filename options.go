@@ -0,0 +1,103 @@
+package divert
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Options configures a handle opened by OpenWithOptions or OpenWith.
+type Options struct {
+	Priority int16
+	// Flags is a combination of FlagSniff, FlagDrop, FlagRecvOnly,
+	// FlagSendOnly, FlagNoInstall and FlagFragments.
+	Flags uint64
+	// QueueLength, QueueTime and QueueSize are set with SetParam after
+	// the handle is opened. Zero keeps the default of the driver.
+	QueueLength uint64
+	QueueTime   uint64
+	QueueSize   uint64
+}
+
+var (
+	errSniffDrop    = errors.New("Flags Sniff and Drop can not be combined")
+	errRecvSendOnly = errors.New("Flags RecvOnly and SendOnly can not be combined")
+)
+
+// flagsAll is WINDIVERT_FLAGS_ALL.
+const flagsAll = FlagSniff | FlagDrop | FlagRecvOnly | FlagSendOnly | FlagNoInstall | FlagFragments
+
+// requiredFlags returns the flags the driver requires at the layer.
+func requiredFlags(layer Layer) uint64 {
+	switch layer {
+	case LayerFlow, LayerReflect:
+		return FlagSniff | FlagRecvOnly
+	case LayerSocket:
+		return FlagRecvOnly
+	default:
+		return 0
+	}
+}
+
+func formatFlags(flags uint64) string {
+	return strings.Join(FlagNames(flags), "|")
+}
+
+// Validate checks the options for a handle of layer the way the driver
+// does, so that a bad combination is reported without opening a handle.
+func (o *Options) Validate(layer Layer) error {
+	switch layer {
+	case LayerNetwork, LayerNetworkForward, LayerFlow, LayerSocket, LayerReflect:
+	default:
+		return fmt.Errorf("Layer %d is not valid", layer)
+	}
+	if o.Priority < PriorityLowest || o.Priority > PriorityHighest {
+		return errPriority
+	}
+	if o.Flags&^flagsAll != 0 {
+		return fmt.Errorf("Flags %v are not valid", formatFlags(o.Flags&^flagsAll))
+	}
+	if o.Flags&(FlagSniff|FlagDrop) == FlagSniff|FlagDrop {
+		return errSniffDrop
+	}
+	if o.Flags&(FlagRecvOnly|FlagSendOnly) == FlagRecvOnly|FlagSendOnly {
+		return errRecvSendOnly
+	}
+	if req := requiredFlags(layer); o.Flags&req != req {
+		return fmt.Errorf("Layer %v requires flags %v", layer, formatFlags(req))
+	}
+	if o.Flags&FlagFragments != 0 && layer != LayerNetwork && layer != LayerNetworkForward {
+		return fmt.Errorf("Flag Fragments is only valid at the network layers, not %v", layer)
+	}
+	if o.QueueLength != 0 && (o.QueueLength < QueueLengthMin || o.QueueLength > QueueLengthMax) {
+		return errQueueLength
+	}
+	if o.QueueTime != 0 && (o.QueueTime < QueueTimeMin || o.QueueTime > QueueTimeMax) {
+		return errQueueTime
+	}
+	if o.QueueSize != 0 && (o.QueueSize < QueueSizeMin || o.QueueSize > QueueSizeMax) {
+		return errQueueSize
+	}
+	return nil
+}
+
+// apply sets the queue parameters of the options on h.
+func (o *Options) apply(h PacketHandle) error {
+	params := [...]struct {
+		param Param
+		value uint64
+	}{
+		{QueueLength, o.QueueLength},
+		{QueueTime, o.QueueTime},
+		{QueueSize, o.QueueSize},
+	}
+	for _, p := range params {
+		if p.value == 0 {
+			continue
+		}
+		if err := h.SetParam(p.param, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package divert
+
+import "testing"
+
+func TestOptionsValidate(t *testing.T) {
+	const sniffRecv = FlagSniff | FlagRecvOnly
+	for _, tt := range []struct {
+		layer Layer
+		opts  Options
+		err   string
+	}{
+		{LayerNetwork, Options{}, ""},
+		{LayerNetworkForward, Options{Priority: PriorityHighest, Flags: FlagDrop | FlagSendOnly | FlagNoInstall}, ""},
+		{LayerNetwork, Options{Priority: PriorityLowest, Flags: FlagSniff | FlagFragments}, ""},
+		{LayerFlow, Options{Flags: sniffRecv}, ""},
+		{LayerReflect, Options{Flags: sniffRecv | FlagNoInstall}, ""},
+		{LayerSocket, Options{Flags: FlagRecvOnly}, ""},
+		{LayerSocket, Options{Flags: sniffRecv}, ""},
+		{LayerNetwork, Options{QueueLength: QueueLengthMax, QueueTime: QueueTimeMin, QueueSize: QueueSizeMax}, ""},
+
+		{Layer(5), Options{}, "Layer 5 is not valid"},
+		{LayerNetwork, Options{Priority: PriorityHighest + 1}, errPriority.Error()},
+		{LayerNetwork, Options{Priority: PriorityLowest - 1}, errPriority.Error()},
+		{LayerNetwork, Options{Flags: FlagSniff | 0x100}, "Flags 0x100 are not valid"},
+		{LayerNetwork, Options{Flags: FlagSniff | FlagDrop}, errSniffDrop.Error()},
+		{LayerNetwork, Options{Flags: FlagRecvOnly | FlagSendOnly}, errRecvSendOnly.Error()},
+
+		// The flow and reflect layers need Sniff and RecvOnly.
+		{LayerFlow, Options{}, "Layer WINDIVERT_LAYER_FLOW requires flags Sniff|RecvOnly"},
+		{LayerFlow, Options{Flags: FlagSniff}, "Layer WINDIVERT_LAYER_FLOW requires flags Sniff|RecvOnly"},
+		{LayerReflect, Options{Flags: FlagRecvOnly}, "Layer WINDIVERT_LAYER_REFLECT requires flags Sniff|RecvOnly"},
+		// The socket layer needs RecvOnly.
+		{LayerSocket, Options{Flags: FlagSniff}, "Layer WINDIVERT_LAYER_SOCKET requires flags RecvOnly"},
+		{LayerSocket, Options{Flags: FlagSendOnly}, "Layer WINDIVERT_LAYER_SOCKET requires flags RecvOnly"},
+
+		// Fragments is only valid at the network layers.
+		{LayerFlow, Options{Flags: sniffRecv | FlagFragments}, "Flag Fragments is only valid at the network layers, not WINDIVERT_LAYER_FLOW"},
+		{LayerSocket, Options{Flags: FlagRecvOnly | FlagFragments}, "Flag Fragments is only valid at the network layers, not WINDIVERT_LAYER_SOCKET"},
+		{LayerReflect, Options{Flags: sniffRecv | FlagFragments}, "Flag Fragments is only valid at the network layers, not WINDIVERT_LAYER_REFLECT"},
+
+		{LayerNetwork, Options{QueueLength: QueueLengthMin - 1}, errQueueLength.Error()},
+		{LayerNetwork, Options{QueueLength: QueueLengthMax + 1}, errQueueLength.Error()},
+		{LayerNetwork, Options{QueueTime: QueueTimeMin - 1}, errQueueTime.Error()},
+		{LayerNetwork, Options{QueueTime: QueueTimeMax + 1}, errQueueTime.Error()},
+		{LayerNetwork, Options{QueueSize: QueueSizeMin - 1}, errQueueSize.Error()},
+		{LayerNetwork, Options{QueueSize: QueueSizeMax + 1}, errQueueSize.Error()},
+	} {
+		err := tt.opts.Validate(tt.layer)
+		if s := errString(err); s != tt.err {
+			t.Errorf("%+v.Validate(%v) = %q, want %q", tt.opts, tt.layer, s, tt.err)
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
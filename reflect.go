@@ -0,0 +1,106 @@
+package divert
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/imgk/divert-go/filter"
+)
+
+var errReflectEvent = errors.New("address is not a reflect layer event")
+
+// openFlags names the flags of Open, in the order they are formatted.
+var openFlags = [...]struct {
+	flag uint64
+	name string
+}{
+	{FlagSniff, "Sniff"},
+	{FlagDrop, "Drop"},
+	{FlagRecvOnly, "RecvOnly"},
+	{FlagSendOnly, "SendOnly"},
+	{FlagNoInstall, "NoInstall"},
+	{FlagFragments, "Fragments"},
+}
+
+// FlagNames returns the names of the flags of Open set in flags, e.g.
+// "Sniff" for FlagSniff. Unknown bits are returned as one hexadecimal
+// number.
+func FlagNames(flags uint64) []string {
+	var names []string
+	for _, f := range openFlags {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, "0x"+strconv.FormatUint(flags, 16))
+	}
+	return names
+}
+
+// ReflectEvent describes a WinDivert handle opened or closed by another
+// process, as received from a handle of the reflect layer.
+type ReflectEvent struct {
+	// Event is EventReflectOpen or EventReflectClose.
+	Event Event
+	HandleInfo
+	// FlagNames are the names of HandleInfo.Flags, see FlagNames.
+	FlagNames []string
+	// Filter is the filter the handle was opened with, nil if the event
+	// carried no filter object.
+	Filter *filter.Filter
+}
+
+// DecodeReflectEvent decodes an address and the data received with it
+// from a handle of the reflect layer. The data is the filter object of
+// the handle, which is decompiled for the layer of the handle.
+func DecodeReflectEvent(a *Address, data []byte) (*ReflectEvent, error) {
+	ev, err := DecodeEvent(a)
+	if err != nil {
+		return nil, err
+	}
+	var h HandleInfo
+	switch e := ev.(type) {
+	case ReflectOpen:
+		h = e.HandleInfo
+	case ReflectClose:
+		h = e.HandleInfo
+	default:
+		return nil, errReflectEvent
+	}
+	re := &ReflectEvent{Event: ev.Event(), HandleInfo: h, FlagNames: FlagNames(h.Flags)}
+	if len(data) != 0 && data[0] != 0 {
+		re.Filter, err = filter.Decompile(data, filter.Layer(h.Layer))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return re, nil
+}
+
+// String formats the event for logging, e.g.
+// `WINDIVERT_EVENT_REFLECT_OPEN pid=1234 layer=WINDIVERT_LAYER_NETWORK
+// priority=0 flags=Sniff filter="tcp.DstPort == 80"`.
+func (e *ReflectEvent) String() string {
+	b := strings.Builder{}
+	b.WriteString(e.Event.String())
+	b.WriteString(" pid=")
+	b.WriteString(strconv.FormatUint(uint64(e.ProcessID), 10))
+	b.WriteString(" layer=")
+	b.WriteString(e.Layer.String())
+	b.WriteString(" priority=")
+	b.WriteString(strconv.Itoa(int(e.Priority)))
+	b.WriteString(" flags=")
+	if len(e.FlagNames) == 0 {
+		b.WriteString("0")
+	} else {
+		b.WriteString(strings.Join(e.FlagNames, "|"))
+	}
+	if e.Filter != nil {
+		b.WriteString(" filter=")
+		b.WriteString(strconv.Quote(e.Filter.String()))
+	}
+	return b.String()
+}
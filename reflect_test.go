@@ -0,0 +1,105 @@
+package divert
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/imgk/divert-go/filter"
+)
+
+func TestFlagNames(t *testing.T) {
+	for _, tt := range []struct {
+		flags uint64
+		names []string
+	}{
+		{0, nil},
+		{FlagSniff, []string{"Sniff"}},
+		{FlagFragments | FlagDrop | FlagNoInstall, []string{"Drop", "NoInstall", "Fragments"}},
+		{FlagSniff | FlagRecvOnly | FlagSendOnly, []string{"Sniff", "RecvOnly", "SendOnly"}},
+		// Unknown bits are gathered in one number.
+		{FlagSniff | 0x100 | 1<<40, []string{"Sniff", "0x10000000100"}},
+		{0x80, []string{"0x80"}},
+	} {
+		if names := FlagNames(tt.flags); !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("FlagNames(%#x) = %q, want %q", tt.flags, names, tt.names)
+		}
+	}
+}
+
+func reflectAddress(event Event, layer Layer, flags uint64) *Address {
+	a := &Address{}
+	a.SetLayer(LayerReflect)
+	a.SetEvent(event)
+	a.Timestamp = 200
+	rf := a.Reflect()
+	rf.TimeStamp, rf.ProcessID, rf.Flags, rf.Priority = 50, 1234, flags, -5
+	rf.SetLayer(layer)
+	return a
+}
+
+func TestDecodeReflectEvent(t *testing.T) {
+	object, err := filter.CompileFilter("outbound and tcp.DstPort == 80", filter.LayerNetwork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The driver returns the object with its terminating NUL.
+	data := append(object, 0)
+
+	e, err := DecodeReflectEvent(reflectAddress(EventReflectOpen, LayerNetwork, FlagSniff|0x100), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HandleInfo{Timestamp: 200, Opened: 50, ProcessID: 1234, Layer: LayerNetwork, Flags: FlagSniff | 0x100, Priority: -5}
+	if e.Event != EventReflectOpen || e.HandleInfo != want || !reflect.DeepEqual(e.FlagNames, []string{"Sniff", "0x100"}) {
+		t.Errorf("DecodeReflectEvent = %+v", e)
+	}
+	const s = `WINDIVERT_EVENT_REFLECT_OPEN pid=1234 layer=WINDIVERT_LAYER_NETWORK priority=-5 flags=Sniff|0x100 filter="outbound and tcp.DstPort = 80"`
+	if e.String() != s {
+		t.Errorf("String() = %s, want %s", e, s)
+	}
+
+	// The filter object is decompiled for the layer of the handle.
+	object, err = filter.CompileFilter("event == CONNECT", filter.LayerSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err = DecodeReflectEvent(reflectAddress(EventReflectClose, LayerSocket, 0), append(object, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const s2 = `WINDIVERT_EVENT_REFLECT_CLOSE pid=1234 layer=WINDIVERT_LAYER_SOCKET priority=-5 flags=0 filter="event = CONNECT"`
+	if e.String() != s2 {
+		t.Errorf("String() = %s, want %s", e, s2)
+	}
+
+	// Without data the event has no filter.
+	for _, data := range [][]byte{nil, {0}} {
+		e, err = DecodeReflectEvent(reflectAddress(EventReflectClose, LayerFlow, FlagSniff|FlagRecvOnly), data)
+		if err != nil || e.Filter != nil {
+			t.Errorf("DecodeReflectEvent(%q) = %v, %v, want no filter", data, e, err)
+			continue
+		}
+		const s = `WINDIVERT_EVENT_REFLECT_CLOSE pid=1234 layer=WINDIVERT_LAYER_FLOW priority=-5 flags=Sniff|RecvOnly`
+		if e.String() != s {
+			t.Errorf("String() = %s, want %s", e, s)
+		}
+	}
+}
+
+func TestDecodeReflectEventError(t *testing.T) {
+	var sock Address
+	sock.SetLayer(LayerSocket)
+	sock.SetEvent(EventSocketConnect)
+	if _, err := DecodeReflectEvent(&sock, nil); err != errReflectEvent {
+		t.Errorf("DecodeReflectEvent of a socket event: %v, want %v", err, errReflectEvent)
+	}
+
+	var network Address
+	if _, err := DecodeReflectEvent(&network, nil); err == nil {
+		t.Error("DecodeReflectEvent of a network address succeeded")
+	}
+
+	if _, err := DecodeReflectEvent(reflectAddress(EventReflectOpen, LayerNetwork, 0), []byte("@WinDiv_bad\x00")); err == nil {
+		t.Error("DecodeReflectEvent of a bad filter object succeeded")
+	}
+}